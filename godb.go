@@ -0,0 +1,100 @@
+// Package godb is an embedded key-value store built on a log-structured
+// merge tree.
+//
+// A database is opened with Open and closed with Stop:
+//
+//	db, err := godb.Open("data", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Stop()
+//
+//	err = db.Put("key", []byte("value"))
+//	value, ok, err := db.GetWithError("key")
+//
+// The storage engine itself is internal, this package is the only supported
+// way to use it.
+package godb
+
+import "godb/internal/api"
+
+type (
+	// Database is an open database. It is safe for concurrent use.
+	Database = api.Database
+	// Options configures a database, see DefaultOptions.
+	Options = api.Options
+	// SyncMode decides when the WAL is fsynced.
+	SyncMode = api.SyncMode
+	// Compression selects the codec of SSTable data blocks.
+	Compression = api.Compression
+	// BlockCacheStats reports the hits, misses and size of the block cache.
+	BlockCacheStats = api.BlockCacheStats
+	// TableProperties describe the key range and content of an SSTable.
+	TableProperties = api.TableProperties
+	// WALStats counts the records and group commits written to the WAL.
+	WALStats = api.WALStats
+	// WALRecoveryMode decides how Start handles a corrupted WAL.
+	WALRecoveryMode = api.WALRecoveryMode
+	// WALRecovery summarizes the WAL replayed by Start.
+	WALRecovery = api.WALRecovery
+
+	// WriteBatch groups writes applied atomically by Database.Write.
+	WriteBatch = api.WriteBatch
+	// WriteOptions overrides the durability of a single write.
+	WriteOptions = api.WriteOptions
+
+	// Iterator walks keys in order, it must be closed after use.
+	Iterator = api.Iterator
+	// IteratorOptions bounds the keys an Iterator visits.
+	IteratorOptions = api.IteratorOptions
+
+	// Snapshot reads the database as of the moment it was taken.
+	Snapshot = api.Snapshot
+	// Txn is an optimistic transaction, see Database.Begin.
+	Txn = api.Txn
+
+	// CorruptionError tells the file, section and offset of corrupted data.
+	CorruptionError = api.CorruptionError
+)
+
+const (
+	SyncAlways   = api.SyncAlways
+	SyncNone     = api.SyncNone
+	SyncPeriodic = api.SyncPeriodic
+	SyncBatch    = api.SyncBatch
+	SyncNoWAL    = api.SyncNoWAL
+
+	LZCompression      = api.LZCompression
+	NoCompression      = api.NoCompression
+	DeflateCompression = api.DeflateCompression
+
+	TruncateWALRecovery = api.TruncateWALRecovery
+	StrictWALRecovery   = api.StrictWALRecovery
+	SkipWALRecovery     = api.SkipWALRecovery
+)
+
+var (
+	ErrInvalidOptions   = api.ErrInvalidOptions
+	ErrDatabaseNotFound = api.ErrDatabaseNotFound
+	ErrDatabaseExists   = api.ErrDatabaseExists
+	ErrDatabaseStopped  = api.ErrDatabaseStopped
+
+	ErrConflict = api.ErrConflict
+	ErrTxnDone  = api.ErrTxnDone
+
+	ErrCorruption = api.ErrCorruption
+)
+
+// Open opens the database at path, creating it when opts allow. A nil opts
+// means DefaultOptions.
+func Open(path string, opts *Options) (*Database, error) {
+	return api.Open(path, opts)
+}
+
+func DefaultOptions() *Options {
+	return api.DefaultOptions()
+}
+
+func NewWriteBatch() *WriteBatch {
+	return api.NewWriteBatch()
+}
@@ -0,0 +1,120 @@
+package godb_test
+
+import (
+	"fmt"
+	"godb"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The tests of this file only use the public surface, they fail to compile
+// when it changes in an incompatible way.
+
+func openTestDatabase(t *testing.T, dir string) *godb.Database {
+	opts := godb.DefaultOptions()
+	opts.MemTableByteSize = 4 << 10
+	opts.BlockByteSize = 256
+
+	db, err := godb.Open(dir, opts)
+	require.NoError(t, err)
+	return db
+}
+
+func TestCompat_ReadWriteAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+
+	db := openTestDatabase(t, dir)
+	for i := range 500 {
+		require.NoError(t, db.Put(fmt.Sprintf("key:%04d", i), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	require.NoError(t, db.Delete("key:0000"))
+
+	batch := godb.NewWriteBatch()
+	batch.Put("batch:a", []byte("a"))
+	batch.Put("batch:b", []byte("b"))
+	batch.Delete("key:0001")
+	batch.DeleteRange("key:0400", "key:0500")
+	require.Equal(t, 4, batch.Len())
+	require.NoError(t, db.Write(batch))
+	require.NoError(t, db.Stop())
+
+	db = openTestDatabase(t, dir)
+	defer func() { require.NoError(t, db.Stop()) }()
+
+	for i := range 500 {
+		v, ok := db.Get(fmt.Sprintf("key:%04d", i))
+		if i < 2 || i >= 400 {
+			require.False(t, ok, i)
+			continue
+		}
+		require.True(t, ok, i)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), v)
+	}
+
+	var it *godb.Iterator
+	it, err := db.NewIterator(&godb.IteratorOptions{Prefix: "batch:"})
+	require.NoError(t, err)
+	keys := make([]string, 0)
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	require.Equal(t, []string{"batch:a", "batch:b"}, keys)
+
+	count := 0
+	require.NoError(t, db.Scan(&godb.IteratorOptions{LowerBound: "key:", UpperBound: "key;"}, func(key string, value []byte) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 398, count)
+}
+
+func TestCompat_SnapshotsAndTransactions(t *testing.T) {
+	db := openTestDatabase(t, t.TempDir())
+	defer func() { require.NoError(t, db.Stop()) }()
+
+	require.NoError(t, db.Put("key", []byte("v1")))
+
+	var snapshot *godb.Snapshot = db.NewSnapshot()
+	defer snapshot.Release()
+	require.NoError(t, db.Put("key", []byte("v2")))
+
+	v, ok := snapshot.Get("key")
+	require.True(t, ok)
+	require.Equal(t, []byte("v1"), v)
+
+	var first, second *godb.Txn = db.Begin(), db.Begin()
+	for _, txn := range []*godb.Txn{first, second} {
+		_, _, err := txn.Get("key")
+		require.NoError(t, err)
+		require.NoError(t, txn.Put("key", []byte("txn")))
+	}
+	require.NoError(t, first.Commit())
+	require.ErrorIs(t, second.Commit(), godb.ErrConflict)
+	require.ErrorIs(t, second.Commit(), godb.ErrTxnDone)
+
+	v, ok = db.Get("key")
+	require.True(t, ok)
+	require.Equal(t, []byte("txn"), v)
+}
+
+func TestCompat_OpenErrors(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	createIfMissing := false
+	_, err := godb.Open(dir, &godb.Options{CreateIfMissing: &createIfMissing})
+	require.ErrorIs(t, err, godb.ErrDatabaseNotFound)
+
+	_, err = godb.Open(dir, &godb.Options{SkipListProbability: 100})
+	require.ErrorIs(t, err, godb.ErrInvalidOptions)
+
+	db, err := godb.Open(dir, &godb.Options{SyncMode: godb.SyncNone})
+	require.NoError(t, err)
+	require.NoError(t, db.Stop())
+
+	_, err = godb.Open(dir, &godb.Options{ErrorIfExists: true})
+	require.ErrorIs(t, err, godb.ErrDatabaseExists)
+}
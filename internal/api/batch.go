@@ -0,0 +1,74 @@
+package api
+
+type batchOpKind int
+
+const (
+	batchPut batchOpKind = iota
+	batchDelete
+	batchDeleteRange
+)
+
+type batchOp struct {
+	kind  batchOpKind
+	key   string
+	value []byte
+
+	// end is the exclusive end of a DeleteRange, key being its start
+	end string
+}
+
+// WriteBatch accumulates writes that Database.Write applies atomically, in the
+// order they were added.
+type WriteBatch struct {
+	ops []batchOp
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{ops: make([]batchOp, 0)}
+}
+
+func (b *WriteBatch) Put(key string, value []byte) {
+	b.ops = append(b.ops, batchOp{
+		kind:  batchPut,
+		key:   key,
+		value: append([]byte{}, value...),
+	})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{kind: batchDelete, key: key})
+}
+
+// DeleteRange deletes every key in [start, end) that exists when the batch is
+// written, including keys put earlier in the same batch.
+func (b *WriteBatch) DeleteRange(start, end string) {
+	b.ops = append(b.ops, batchOp{kind: batchDeleteRange, key: start, end: end})
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// byteSize is the size of the keys and values of the batch.
+func (b *WriteBatch) byteSize() int {
+	size := 0
+	for _, op := range b.ops {
+		size += len(op.key) + len(op.value) + len(op.end)
+	}
+
+	return size
+}
+
+func (b *WriteBatch) hasDeleteRange() bool {
+	for _, op := range b.ops {
+		if op.kind == batchDeleteRange {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
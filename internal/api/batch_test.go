@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"fmt"
+	"godb/internal/api"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_WriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "data"), 0755))
+
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	for i := range 10 {
+		require.NoError(t, db.Put(fmt.Sprintf("user:42:field:%d", i), []byte("old")))
+	}
+	require.NoError(t, db.Put("user:43:field:0", []byte("other")))
+
+	batch := api.NewWriteBatch()
+	batch.Put("user:42:name", []byte("Konstantinos"))
+	batch.Put("user:42:email", []byte("k@example.com"))
+	batch.Delete("user:42:field:0")
+	batch.DeleteRange("user:42:field:5", "user:42:field:8")
+	batch.Put("user:42:field:9", []byte("new"))
+	batch.Put("user:42:tmp", []byte("gone"))
+	batch.DeleteRange("user:42:tmp", "user:42:tmq")
+	require.Equal(t, 7, batch.Len())
+
+	require.NoError(t, db.Write(batch))
+
+	check := func(db *api.Database) {
+		expected := map[string]string{
+			"user:42:name":    "Konstantinos",
+			"user:42:email":   "k@example.com",
+			"user:42:field:1": "old",
+			"user:42:field:2": "old",
+			"user:42:field:3": "old",
+			"user:42:field:4": "old",
+			"user:42:field:8": "old",
+			"user:42:field:9": "new",
+			"user:43:field:0": "other",
+		}
+		for key, value := range expected {
+			v, ok := db.Get(key)
+			require.True(t, ok, key)
+			require.Equal(t, []byte(value), v, key)
+		}
+
+		for _, key := range []string{"user:42:field:0", "user:42:field:5", "user:42:field:6", "user:42:field:7", "user:42:tmp"} {
+			_, ok := db.Get(key)
+			require.False(t, ok, key)
+		}
+	}
+
+	check(db)
+	require.NoError(t, db.Stop())
+
+	// The batch is replayed from the WAL
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	check(db)
+
+	batch.Reset()
+	require.Equal(t, 0, batch.Len())
+	require.NoError(t, db.Write(batch))
+	require.NoError(t, db.Stop())
+}
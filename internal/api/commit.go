@@ -0,0 +1,185 @@
+package api
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"godb/internal/tooling/guard"
+)
+
+// maxGroupByteSize bounds the batches a leader commits at once, so that a
+// small write does not wait long behind a large group.
+const maxGroupByteSize = 1 << 20
+
+// writer is a batch waiting in the write queue of the database.
+type writer struct {
+	batch *WriteBatch
+	// check, when set, runs once the writer leads the queue, every write
+	// before it applied, and fails the write with the error it returns
+	check func() error
+	// sync fsyncs the WAL for the writer, disableWAL keeps it out of the WAL
+	sync       bool
+	disableWAL bool
+
+	entries []engine.WALMemEntry
+	err     error
+	done    bool
+}
+
+// newWriter returns a writer for batch, durable as opts and the SyncMode
+// say. boundary tells a batch written as such, which SyncBatch fsyncs, from a
+// single Put or Delete.
+func (d *Database) newWriter(batch *WriteBatch, opts *WriteOptions, boundary bool) *writer {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
+	return &writer{
+		batch:      batch,
+		sync:       opts.Sync || boundary && d.syncMode == SyncBatch,
+		disableWAL: opts.DisableWAL || d.syncMode == SyncNoWAL,
+	}
+}
+
+// grouped reports whether w may be committed by another writer. A writer
+// whose entries depend on the writes before it has to lead its own group,
+// those writes being applied by then, and one skipping the WAL has no WAL
+// write to join.
+func (w *writer) grouped() bool {
+	return w.check == nil && !w.batch.hasDeleteRange() && !w.disableWAL
+}
+
+// write queues w and returns once it is committed or failed. The writer at
+// the head of the queue leads: it takes the writers queued behind it, commits
+// them with a single WAL write and fsync, d.mu released meanwhile, applies
+// them to the memtable in order and releases them with the shared result.
+func (d *Database) write(w *writer) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return ErrDatabaseStopped
+	}
+
+	d.writers = append(d.writers, w)
+	for !w.done && d.writers[0] != w {
+		d.writersCond.Wait()
+	}
+	if w.done {
+		return w.err
+	}
+
+	group, err := d.leadGroup(w)
+	for _, member := range group {
+		member.err = err
+		member.done = true
+	}
+
+	clear(d.writers[:len(group)])
+	d.writers = d.writers[len(group):]
+	d.writersCond.Broadcast()
+
+	return w.err
+}
+
+// leadGroup commits the writers at the head of the queue, leader first, and
+// returns those it committed. Must be called with d.mu held, it is released
+// while the group stalls and while the WAL is written.
+func (d *Database) leadGroup(leader *writer) ([]*writer, error) {
+	group := []*writer{leader}
+
+	if leader.check != nil {
+		if err := leader.check(); err != nil {
+			return group, err
+		}
+	}
+
+	entries, err := d.batchEntries(leader.batch)
+	if err != nil {
+		return group, fmt.Errorf("batch entries: %w", err)
+	}
+	leader.entries = entries
+
+	// A writer skipping the WAL commits alone
+	followers := d.writers[1:]
+	if leader.disableWAL {
+		followers = nil
+	}
+
+	byteSize := leader.batch.byteSize()
+	for _, w := range followers {
+		byteSize += w.batch.byteSize()
+		if !w.grouped() || byteSize > maxGroupByteSize {
+			break
+		}
+
+		w.entries, err = d.batchEntries(w.batch)
+		guard.Assert(err == nil, "Only DeleteRange fails, it is never grouped")
+		group = append(group, w)
+	}
+
+	for {
+		// A full memtable is rotated before the group is written, so that a
+		// failure fails the group rather than a write already applied
+		if d.memTable.Load().ByteSize() >= d.memTableByteSize {
+			if err := d.rotateMemTable(); err != nil {
+				return group, fmt.Errorf("rotate memtable: %w", err)
+			}
+		}
+
+		// Stall until flushes make room for the memtable in the write
+		// buffer, d.mu released so that readers are not stalled too
+		memTable := d.memTable.Load()
+		d.mu.Unlock()
+		err := d.flusher.WaitBelow(d.writeBufferByteSize - memTable.ByteSize())
+		d.mu.Lock()
+		if err != nil {
+			return group, fmt.Errorf("wait for flush: %w", err)
+		}
+
+		// Only a rotation adds to the flush queue, the room is still there
+		// unless the memtable was rotated meanwhile
+		if d.memTable.Load() == memTable {
+			break
+		}
+	}
+
+	batches := make([][]engine.WALMemEntry, 0, len(group))
+	count := 0
+	sync := false
+	for _, w := range group {
+		if len(w.entries) > 0 {
+			batches = append(batches, w.entries)
+			count += len(w.entries)
+		}
+		sync = sync || w.sync
+	}
+	if count == 0 {
+		return group, nil
+	}
+
+	seq := d.seq.Load() + 1
+	if leader.disableWAL {
+		engine.AssignSeqs(seq, leader.entries)
+		d.unlogged = true
+	} else {
+		// Only the leader writes, the writers behind it wait for the group
+		d.mu.Unlock()
+		err = d.wal.AppendBatches(seq, batches)
+		if err == nil && sync && d.syncMode != SyncAlways {
+			err = d.wal.Sync()
+		}
+		d.mu.Lock()
+		if err != nil {
+			return group, fmt.Errorf("wal append batches: %w", err)
+		}
+	}
+
+	for _, entries := range batches {
+		applyToMemTable(d.memTable.Load(), entries)
+	}
+
+	// Readers see the whole group at once
+	d.seq.Store(seq + uint64(count) - 1)
+
+	return group, nil
+}
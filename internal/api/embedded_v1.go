@@ -2,45 +2,108 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"godb/internal/engine"
 	"godb/internal/tooling/guard"
+	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrDatabaseStopped fails the writes made once Stop is called.
+var ErrDatabaseStopped = errors.New("database stopped")
+
+// ErrCorruption matches errors reading data that does not match its
+// checksum, which are a *CorruptionError telling where it was found.
+var ErrCorruption = engine.ErrCorruption
+
+type CorruptionError = engine.CorruptionError
+
 type Database struct {
 	ctx     context.Context
 	ctxcncl context.CancelFunc
 
 	// Engine Items
-	wal             *engine.WAL
-	memTable        *engine.MemTable
+	manifest *engine.Manifest
+	wal      *engine.WAL
+	// memTable is swapped with d.mu held, readers load it without
+	memTable        atomic.Pointer[engine.MemTable]
 	flusher         *engine.Flusher
 	sstableSearcher *engine.SSTableSearcher
+	compactor       *engine.Compactor
+	snapshots       *engine.SnapshotList
 
 	// Mutexes
 	mu *sync.Mutex
 
+	// writers is the write queue, its head commits the writers behind it.
+	// Both are guarded by d.mu
+	writers     []*writer
+	writersCond *sync.Cond
+	// unlogged tells the memtable holds writes missing from the WAL, which
+	// Stop has to flush. Guarded by d.mu
+	unlogged bool
+	// stopped refuses the writes made once Stop is called. Guarded by d.mu
+	stopped bool
+
+	// seq is the sequence number of the last write visible to readers
+	seq atomic.Uint64
+
 	// General Configuration
 	path string
 
+	// Open Configuration
+	createIfMissing bool
+	errorIfExists   bool
+
+	// WAL Configuration
+	syncMode   SyncMode
+	syncPeriod time.Duration
+	// syncerDone stops the background fsyncs of SyncPeriodic
+	syncerDone chan struct{}
+	syncerWg   sync.WaitGroup
+	// walRecoveryMode handles the bad records met by Start, recovery is
+	// what it kept and dropped
+	walRecoveryMode WALRecoveryMode
+	recovery        *WALRecovery
+
 	// MemTable Configuration
 	maxLevel            int
 	skipListProbability int
-	maxSize             int
+	memTableByteSize    int
+	writeBufferByteSize int
 
 	// Flusher Configuration
 	flusherMaxWorkers int
 
 	// SStable Configuration
-	maxDatablockByteSize int
+	sstableConfig   engine.SSTableConfig
+	blockCache      *engine.BlockCache
+	maxOpenFiles    int
+	verifyChecksums bool
+
+	// Compactor Configuration
+	l0CompactionTrigger int
+	baseLevelByteSize   int64
+	levelMultiplier     int64
+	targetFileByteSize  int64
 }
 
-func NewDatabase(path string) *Database {
+// NewDatabase returns a database at path configured by opts, nil meaning
+// DefaultOptions. Nothing is read from disk until Start.
+func NewDatabase(path string, opts *Options) (*Database, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
 	ctx := context.Background()
 	ctx, ctxcncl := context.WithCancel(ctx)
 
-	return &Database{
+	d := &Database{
 		ctx:     ctx,
 		ctxcncl: ctxcncl,
 
@@ -48,148 +111,609 @@ func NewDatabase(path string) *Database {
 
 		path: path,
 
-		maxLevel:            4,
-		skipListProbability: 50,
-		maxSize:             200,
+		createIfMissing: *opts.CreateIfMissing,
+		errorIfExists:   opts.ErrorIfExists,
+
+		syncMode:        opts.SyncMode,
+		syncPeriod:      opts.SyncPeriod,
+		walRecoveryMode: opts.WALRecoveryMode,
+
+		maxLevel:            opts.SkipListMaxLevel,
+		skipListProbability: opts.SkipListProbability,
+		memTableByteSize:    opts.MemTableByteSize,
+		writeBufferByteSize: opts.WriteBufferByteSize,
+
+		flusherMaxWorkers: opts.FlusherWorkers,
+
+		sstableConfig: engine.SSTableConfig{
+			DatablockByteSize: opts.BlockByteSize,
+			RestartInterval:   opts.RestartInterval,
+			BloomBitsPerKey:   opts.BloomBitsPerKey,
+			Compression:       opts.Compression.engineType(),
+		},
+		blockCache:      engine.NewBlockCache(opts.BlockCacheByteSize),
+		maxOpenFiles:    opts.MaxOpenFiles,
+		verifyChecksums: !opts.SkipChecksumVerification,
+
+		l0CompactionTrigger: opts.L0CompactionTrigger,
+		baseLevelByteSize:   opts.BaseLevelByteSize,
+		levelMultiplier:     int64(opts.LevelMultiplier),
+		targetFileByteSize:  opts.TargetFileByteSize,
+	}
+	d.writersCond = sync.NewCond(d.mu)
+	d.snapshots = engine.NewSnapshotList(&d.seq)
+
+	return d, nil
+}
+
+// Open returns a started database.
+func Open(path string, opts *Options) (*Database, error) {
+	d, err := NewDatabase(path, opts)
+	if err != nil {
+		return nil, err
+	}
 
-		flusherMaxWorkers:    3,
-		maxDatablockByteSize: 200,
+	if err := d.Start(); err != nil {
+		return nil, err
 	}
+
+	return d, nil
+}
+
+// WALRecovery summarizes the replay of the WAL by Start: the records and
+// bytes recovered, those dropped and the corruptions found.
+type WALRecovery = engine.WALRecovery
+
+// Recovery returns what the replay of the WAL by Start kept and dropped, bad
+// records handled as the WALRecoveryMode says.
+func (d *Database) Recovery() *WALRecovery {
+	return d.recovery
 }
 
-func (d *Database) Start() error {
-	wal, err := engine.NewWAL(d.path)
+func (d *Database) Start() (err error) {
+	exists, err := engine.DatabaseExists(d.path)
+	if err != nil {
+		return fmt.Errorf("database exists: %w", err)
+	}
+
+	switch {
+	case exists && d.errorIfExists:
+		return fmt.Errorf("%w: %s", ErrDatabaseExists, d.path)
+	case !exists && !d.createIfMissing:
+		return fmt.Errorf("%w: %s", ErrDatabaseNotFound, d.path)
+	case !exists:
+		if err := os.MkdirAll(d.path, 0755); err != nil {
+			return fmt.Errorf("mkdir: %w", err)
+		}
+	}
+
+	manifest, err := engine.OpenManifest(d.path)
+	if err != nil {
+		return fmt.Errorf("open manifest: %w", err)
+	}
+	d.manifest = manifest
+	d.seq.Store(manifest.LastSeq())
+
+	// A failed start, such as a strict replay meeting a bad record, leaves
+	// nothing open, so that it may be started again
+	defer func() {
+		if err != nil {
+			d.abortStart()
+		}
+	}()
+
+	// Segments older than the manifest LogNum are flushed, a crash may have
+	// kept them from being removed
+	if err := engine.RemoveObsoleteWALs(d.path, manifest.LogNum()); err != nil {
+		return fmt.Errorf("remove obsolete wals: %w", err)
+	}
+
+	entries, recovery, err := engine.ReplayWALs(d.path, manifest.LogNum(), d.walRecoveryMode.engineType())
+	if err != nil {
+		return fmt.Errorf("replay wals: %w", err)
+	}
+	d.recovery = recovery
+
+	// The replayed segments stay until the memtable holding their writes is
+	// flushed, new writes go to a segment of their own
+	wal, err := engine.NewWAL(d.path, manifest.NewFileNum(), d.syncMode == SyncAlways)
 	if err != nil {
 		return fmt.Errorf("new wal: %w", err)
 	}
 	d.wal = wal
 
-	memTable, err := engine.NewMemTable(d.maxLevel, d.skipListProbability)
+	memTable, err := d.newMemTable()
 	if err != nil {
 		return fmt.Errorf("new mem table: %w", err)
 	}
-	d.memTable = memTable
+	d.memTable.Store(memTable)
+	d.stopped = false
 
-	entries, err := d.wal.Load()
-	if err != nil {
-		return fmt.Errorf("load wal: %w", err)
+	applyToMemTable(memTable, entries)
+	for _, entry := range entries {
+		d.seq.Store(max(d.seq.Load(), entry.Seq()))
 	}
 
-	if len(entries) > 0 {
-		for _, v := range entries {
-			var err error
-			if v.Op() == engine.WALDEL {
-				err = memTable.Delete(string(v.Key()))
-			} else {
-				err = memTable.Insert(string(v.Key()), v.Value())
-			}
-			guard.Assert(
-				err == nil,
-				`
-				Only reason to receive error here is memTable being frozen 
-				which is not possible
-				`,
-			)
-		}
+	d.sstableSearcher = engine.NewSSTableSearcher(
+		d.path,
+		d.manifest,
+		d.maxOpenFiles,
+		d.verifyChecksums,
+		d.blockCache,
+	)
+	if err = d.sstableSearcher.Start(); err != nil {
+		return fmt.Errorf("sstable searcher start: %w", err)
 	}
 
-	d.flusher = engine.NewFlusher(d.path, d.flusherMaxWorkers, d.maxDatablockByteSize)
+	d.compactor = engine.NewCompactor(
+		d.manifest,
+		d.sstableSearcher,
+		d.snapshots,
+		d.sstableConfig,
+		d.l0CompactionTrigger,
+		d.baseLevelByteSize,
+		d.levelMultiplier,
+		d.targetFileByteSize,
+	)
+
+	d.flusher = engine.NewFlusher(
+		d.path,
+		d.flusherMaxWorkers,
+		d.sstableConfig,
+		d.manifest,
+		d.sstableSearcher,
+		d.snapshots,
+		d.compactor,
+	)
 	if err := d.flusher.Start(d.ctx); err != nil {
 		return fmt.Errorf("flusher start: %w", err)
 	}
 
-	d.sstableSearcher = engine.NewSSTableSearcher(d.path)
-	if err = d.sstableSearcher.Start(); err != nil {
-		return fmt.Errorf("sstable searcher start: %w", err)
+	if err := d.compactor.Start(d.ctx); err != nil {
+		return fmt.Errorf("compactor start: %w", err)
+	}
+
+	if d.syncMode == SyncPeriodic {
+		d.syncerDone = make(chan struct{})
+		d.syncerWg.Add(1)
+		go d.syncer()
 	}
 
 	return nil
 }
 
-func (d *Database) Put(key string, value []byte) error {
-	if err := d.wal.Append(engine.WALPUT, []byte(key), value); err != nil {
-		return fmt.Errorf("wal append: %w", err)
+// abortStart closes what Start opened before it failed. Their errors are
+// dropped, the one that failed Start is reported. They are closed in the
+// reverse order Start opened them, each before what it uses.
+func (d *Database) abortStart() {
+	if d.compactor != nil {
+		d.compactor.Stop()
+	}
+	if d.flusher != nil {
+		d.flusher.Stop()
+	}
+	if d.sstableSearcher != nil {
+		d.sstableSearcher.Close()
 	}
+	if d.wal != nil {
+		d.wal.Close()
+	}
+	d.manifest.Close()
+
+	d.flusher, d.compactor, d.sstableSearcher = nil, nil, nil
+	d.wal, d.manifest = nil, nil
+}
 
-	err := d.memTable.Insert(key, value)
-	guard.Assert(err == nil, "This should never be a frozen memtable")
+// syncer fsyncs the WAL every sync period until Stop. A failed fsync fails
+// the writes after it, the WAL remembers it.
+func (d *Database) syncer() {
+	defer d.syncerWg.Done()
 
-	if d.memTable.Size() > d.maxSize {
-		d.rotateMemTable()
+	ticker := time.NewTicker(d.syncPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.syncerDone:
+			return
+		case <-ticker.C:
+			d.wal.Sync()
+		}
 	}
+}
 
-	return nil
+func (d *Database) Put(key string, value []byte) error {
+	batch := NewWriteBatch()
+	batch.Put(key, value)
+
+	return d.write(d.newWriter(batch, nil, false))
 }
 
+// Write applies every operation of the batch atomically. The batch is
+// appended to the WAL as a single record, possibly committed along with the
+// batches of concurrent writers, and applied to the memtable in write order.
+func (d *Database) Write(batch *WriteBatch) error {
+	return d.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions is Write with the durability of opts, see WriteOptions.
+func (d *Database) WriteWithOptions(batch *WriteBatch, opts *WriteOptions) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return d.write(d.newWriter(batch, opts, true))
+}
+
+// Get returns the value of key. A key that can not be read, its SSTable
+// corrupted for one, reads as missing.
+//
+// Deprecated: Get can not tell data lost to corruption from a missing key,
+// use GetWithError.
 func (d *Database) Get(key string) ([]byte, bool) {
-	v, isTombstone, ok := d.memTable.Search(key)
+	v, ok, _ := d.GetWithError(key)
+	return v, ok
+}
+
+// GetWithError returns the value of key, or the error reading it, such as an
+// ErrCorruption.
+func (d *Database) GetWithError(key string) ([]byte, bool, error) {
+	// Pinned for the duration of the read, so that compaction keeps what it
+	// may find
+	snapshot := d.snapshots.New()
+	defer d.snapshots.Release(snapshot)
+
+	return d.get(key, snapshot.Seq())
+}
+
+// NewSnapshot returns a consistent read view of the database as of now. It
+// must be released after use.
+func (d *Database) NewSnapshot() *Snapshot {
+	return &Snapshot{db: d, snapshot: d.snapshots.New()}
+}
+
+func (d *Database) get(key string, seq uint64) ([]byte, bool, error) {
+	v, isTombstone, ok := d.memTable.Load().Search(key, seq)
 	switch {
 	case isTombstone:
-		return nil, false
+		return nil, false, nil
 	case ok:
-		return v, true
+		return v, true, nil
 	}
 
-	v, isTombstone, ok = d.searchInROMemTables(key)
+	v, isTombstone, ok = d.searchInROMemTables(key, seq)
 	switch {
 	case isTombstone:
-		return nil, false
+		return nil, false, nil
 	case ok:
-		return v, true
+		return v, true, nil
 	}
 
-	v, ok, err := d.sstableSearcher.Search(key)
+	v, ok, err := d.sstableSearcher.Search(key, seq)
 	if err != nil {
-		return []byte{}, false
+		return nil, false, fmt.Errorf("sstable search: %w", err)
 	}
 
-	return v, ok
+	if !ok {
+		return nil, false, nil
+	}
+
+	return v, true, nil
 }
 
 func (d *Database) Delete(key string) error {
-	if err := d.wal.Append(engine.WALDEL, []byte(key), nil); err != nil {
-		return fmt.Errorf("wal append: %w", err)
+	batch := NewWriteBatch()
+	batch.Delete(key)
+
+	return d.write(d.newWriter(batch, nil, false))
+}
+
+// NewIterator returns an iterator over the active memtable, the memtables
+// waiting to be flushed and every SSTable, reading the database as of its
+// creation. It must be closed after use.
+func (d *Database) NewIterator(opts *IteratorOptions) (*Iterator, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.newIterator(opts, d.seq.Load())
+}
+
+// Scan calls fn for every live key within opts in ascending order until fn
+// returns false.
+func (d *Database) Scan(opts *IteratorOptions, fn func(key string, value []byte) bool) error {
+	it, err := d.NewIterator(opts)
+	if err != nil {
+		return fmt.Errorf("new iterator: %w", err)
 	}
 
-	err := d.memTable.Delete(key)
-	guard.Assert(err == nil, "This should never be a frozen memtable")
+	for it.First(); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
 
-	return nil
+	if err := it.Err(); err != nil {
+		it.Close()
+		return fmt.Errorf("iterator: %w", err)
+	}
+
+	return it.Close()
+}
+
+type BlockCacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	ByteSize int64
+}
+
+// WriteBufferByteSize returns the memory held by the memtable and by those
+// waiting to be flushed.
+func (d *Database) WriteBufferByteSize() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.memTable.Load().ByteSize() + d.flusher.ByteSize()
+}
+
+func (d *Database) BlockCacheStats() BlockCacheStats {
+	stats := d.blockCache.Stats()
+	return BlockCacheStats{Hits: stats.Hits, Misses: stats.Misses, ByteSize: stats.ByteSize}
+}
+
+// WALStats counts the records and the group commits written to the WAL.
+type WALStats = engine.WALStats
+
+func (d *Database) WALStats() WALStats {
+	return d.wal.Stats()
+}
+
+// TableProperties describe the content of an SSTable: its key range, entry
+// and tombstone counts, sizes and sequence numbers.
+type TableProperties = engine.SSTableProperties
+
+// TableProperties returns the properties of every live SSTable. Tables
+// written before they carried properties are left out.
+func (d *Database) TableProperties() ([]TableProperties, error) {
+	properties, err := d.sstableSearcher.Properties()
+	if err != nil {
+		return nil, fmt.Errorf("sstable properties: %w", err)
+	}
+
+	tables := make([]TableProperties, 0, len(properties))
+	for _, p := range properties {
+		if p != nil {
+			tables = append(tables, *p)
+		}
+	}
+
+	return tables, nil
 }
 
 func (d *Database) Stop() error {
-	if err := d.flusher.Stop(); err != nil {
-		return fmt.Errorf("flusher stop: %w", err)
+	// New writes are refused and the queued ones let through first, so that
+	// the memtable is not rotated under a WAL write of the leader. A write
+	// stalled on a failing flush fails once the flush is given up
+	d.flusher.StopRetrying()
+	d.mu.Lock()
+	d.stopped = true
+	for len(d.writers) > 0 {
+		d.writersCond.Wait()
+	}
+
+	// Writes missing from the WAL only survive in an SSTable
+	if d.unlogged {
+		if err := d.rotateMemTable(); err != nil {
+			d.mu.Unlock()
+			return fmt.Errorf("rotate memtable: %w", err)
+		}
+	}
+	d.mu.Unlock()
+
+	if d.syncerDone != nil {
+		close(d.syncerDone)
+		d.syncerWg.Wait()
+		d.syncerDone = nil
+	}
+
+	// A failed flush is reported once everything else is closed
+	flushErr := d.flusher.Stop()
+
+	if err := d.compactor.Stop(); err != nil {
+		return fmt.Errorf("compactor stop: %w", err)
+	}
+
+	if err := d.sstableSearcher.Close(); err != nil {
+		return fmt.Errorf("sstable searcher close: %w", err)
+	}
+
+	if err := d.manifest.Close(); err != nil {
+		return fmt.Errorf("manifest close: %w", err)
+	}
+
+	// The last writes of SyncPeriodic and SyncBatch reach the disk
+	if d.syncMode != SyncNone {
+		if err := d.wal.Sync(); err != nil {
+			return fmt.Errorf("wal sync: %w", err)
+		}
+	}
+
+	if err := d.wal.Close(); err != nil {
+		return fmt.Errorf("wal close: %w", err)
+	}
+
+	if flushErr != nil {
+		return fmt.Errorf("flusher stop: %w", flushErr)
 	}
 
 	return nil
 }
 
 // Helpers
-func (d *Database) searchInROMemTables(key string) ([]byte, bool, bool) {
-	for i := len(d.flusher.ROnlyMemTables()) - 1; i >= 0; i-- {
-		v, isTombstone, ok := d.flusher.ROnlyMemTables()[i].Search(key)
+func (d *Database) searchInROMemTables(key string, seq uint64) ([]byte, bool, bool) {
+	rOnlyMemTables := d.flusher.ROnlyMemTables()
+	for i := len(rOnlyMemTables) - 1; i >= 0; i-- {
+		v, isTombstone, ok := rOnlyMemTables[i].Search(key, seq)
 		switch {
 		case isTombstone:
 			return nil, true, false
 		case ok:
-			return v, false, false
+			return v, false, true
 		}
 	}
 
 	return nil, false, false
 }
 
-func (d *Database) rotateMemTable() {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// newIterator returns an iterator reading as of seq. It must be called with
+// d.mu held, so that the memtable does not rotate while the sources are
+// collected. The iterator holds the SSTables it reads, so seq needs no
+// snapshot when it is the last sequence number: compaction can not drop what
+// is visible at it before the tables are held.
+func (d *Database) newIterator(opts *IteratorOptions, seq uint64) (*Iterator, error) {
+	children, err := d.iteratorSources(iteratorBounds(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	return newIterator(engine.NewMergingIterator(children...), opts, seq), nil
+}
+
+// iteratorSources returns an iterator per memtable and SSTable, newest
+// first, as the merging iterator expects them. SSTables holding no key within
+// [lower, upper) are left out. Must be called with d.mu held.
+func (d *Database) iteratorSources(lower, upper string) ([]engine.Iterator, error) {
+	rOnlyMemTables := d.flusher.ROnlyMemTables()
+
+	children := make([]engine.Iterator, 0, len(rOnlyMemTables)+1)
+	children = append(children, d.memTable.Load().NewIterator())
+	for i := len(rOnlyMemTables) - 1; i >= 0; i-- {
+		children = append(children, rOnlyMemTables[i].NewIterator())
+	}
+
+	sstableIterators, err := d.sstableSearcher.NewIterators(lower, upper)
+	if err != nil {
+		return nil, fmt.Errorf("sstable iterators: %w", err)
+	}
+	children = append(children, sstableIterators...)
+
+	return children, nil
+}
+
+// latestSeq returns the sequence number of the last write to key. Must be
+// called with d.mu held, so that no write slips in after the check.
+func (d *Database) latestSeq(key string) (uint64, bool, error) {
+	if seq, ok := d.memTable.Load().LatestSeq(key); ok {
+		return seq, true, nil
+	}
+
+	rOnlyMemTables := d.flusher.ROnlyMemTables()
+	for i := len(rOnlyMemTables) - 1; i >= 0; i-- {
+		if seq, ok := rOnlyMemTables[i].LatestSeq(key); ok {
+			return seq, true, nil
+		}
+	}
+
+	return d.sstableSearcher.LatestSeq(key)
+}
+
+// batchEntries turns the batch into WAL entries, expanding every DeleteRange
+// into deletes of the keys it covers. Must be called with d.mu held.
+func (d *Database) batchEntries(batch *WriteBatch) ([]engine.WALMemEntry, error) {
+	entries := make([]engine.WALMemEntry, 0, batch.Len())
+	for i, op := range batch.ops {
+		switch op.kind {
+		case batchPut:
+			entries = append(entries, engine.NewWALMemEntry(engine.WALPUT, []byte(op.key), op.value))
+		case batchDelete:
+			entries = append(entries, engine.NewWALMemEntry(engine.WALDEL, []byte(op.key), nil))
+		case batchDeleteRange:
+			keys, err := d.rangeKeys(op.key, op.end, batch.ops[:i])
+			if err != nil {
+				return nil, fmt.Errorf("range keys: %w", err)
+			}
+
+			for _, key := range keys {
+				entries = append(entries, engine.NewWALMemEntry(engine.WALDEL, []byte(key), nil))
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// rangeKeys returns the keys in [start, end) that are live in the database or
+// put by the preceding operations of the batch.
+func (d *Database) rangeKeys(start, end string, preceding []batchOp) ([]string, error) {
+	set := make(map[string]struct{})
+
+	it, err := d.newIterator(&IteratorOptions{LowerBound: start, UpperBound: end}, d.seq.Load())
+	if err != nil {
+		return nil, fmt.Errorf("new iterator: %w", err)
+	}
+
+	for it.First(); it.Valid(); it.Next() {
+		set[it.Key()] = struct{}{}
+	}
+
+	if err := it.Err(); err != nil {
+		it.Close()
+		return nil, fmt.Errorf("iterator: %w", err)
+	}
 
-	// Double checking
-	if d.memTable.Size() < d.maxSize {
-		return
+	if err := it.Close(); err != nil {
+		return nil, err
 	}
 
-	newMemTable, err := engine.NewMemTable(d.maxLevel, d.skipListProbability)
+	for _, op := range preceding {
+		if op.kind == batchPut && op.key >= start && (end == "" || op.key < end) {
+			set[op.key] = struct{}{}
+		}
+	}
+
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys, nil
+}
+
+func applyToMemTable(m *engine.MemTable, entries []engine.WALMemEntry) {
+	for _, v := range entries {
+		var err error
+		if v.Op() == engine.WALDEL {
+			err = m.Delete(v.Seq(), string(v.Key()))
+		} else {
+			err = m.Insert(v.Seq(), string(v.Key()), v.Value())
+		}
+		guard.Assert(
+			err == nil,
+			`
+			Only reason to receive error here is memTable being frozen 
+			which is not possible
+			`,
+		)
+	}
+}
+
+// newMemTable returns an empty memtable, its arena chunks a fraction of the
+// memtable so that small memtables do not allocate much more than they hold.
+func (d *Database) newMemTable() (*engine.MemTable, error) {
+	chunkByteSize := min(max(d.memTableByteSize/4, 4<<10), 1<<20)
+	return engine.NewArenaMemTable(d.maxLevel, d.skipListProbability, chunkByteSize)
+}
+
+// rotateMemTable freezes the memtable, queues it to be flushed and starts an
+// empty one with a WAL segment of its own. Must be called with d.mu held and
+// no WAL write in flight.
+func (d *Database) rotateMemTable() error {
+	logNum := d.manifest.NewFileNum()
+	if err := d.wal.Rotate(logNum); err != nil {
+		return fmt.Errorf("wal rotate: %w", err)
+	}
+
+	newMemTable, err := d.newMemTable()
 	guard.Assert(
 		err == nil,
 		`
@@ -198,10 +722,11 @@ func (d *Database) rotateMemTable() {
 		`,
 	)
 
-	oldMemTable := d.memTable
-	d.flusher.AppendROnlyMemTable(oldMemTable)
-	d.flusher.EnqueueToBeFlushed(oldMemTable)
-	d.memTable = newMemTable
-	d.wal.Append(engine.WALFLUSH, nil, nil)
+	oldMemTable := d.memTable.Load()
+	d.flusher.EnqueueToBeFlushed(oldMemTable, logNum)
+	d.memTable.Store(newMemTable)
+	d.unlogged = false
 	oldMemTable.Freeze()
+
+	return nil
 }
@@ -1,15 +1,39 @@
 package api_test
 
 import (
+	"bufio"
 	"fmt"
 	"godb/internal/api"
+	"godb/internal/engine"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
 
+// newTestDatabase returns a database with a small memtable and small blocks,
+// so that tests flush and compact without writing much.
+func newTestDatabase(t *testing.T, dir string) *api.Database {
+	db, err := api.NewDatabase(dir, &api.Options{
+		MemTableByteSize: 4 << 10,
+		BlockByteSize:    256,
+	})
+	require.NoError(t, err)
+	return db
+}
+
 func TestDatabase_MediumDataset(t *testing.T) {
-	db := api.NewDatabase("../../db")
+	db := newTestDatabase(t, t.TempDir())
 
 	require.NoError(t, db.Start())
 
@@ -17,6 +41,24 @@ func TestDatabase_MediumDataset(t *testing.T) {
 		users          = 200
 		columnsPerUser = 5
 	)
+	// ----------------------------------------------------
+	// Phase 1: Insert every column of every user
+	// ----------------------------------------------------
+	for u := 1; u <= users; u++ {
+		for c := 1; c <= columnsPerUser; c++ {
+			key := fmt.Sprintf("user:%d:field:%d", u, c)
+			require.NoError(t, db.Put(key, []byte(fmt.Sprintf("value-%d-%d", u, c))))
+		}
+	}
+
+	// ----------------------------------------------------
+	// Phase 2: Update the first column
+	// ----------------------------------------------------
+	for u := 1; u <= users; u++ {
+		key := fmt.Sprintf("user:%d:field:1", u)
+		require.NoError(t, db.Put(key, []byte(fmt.Sprintf("updated-%d", u))))
+	}
+
 	// ----------------------------------------------------
 	// Phase 3: Validate reads
 	// ----------------------------------------------------
@@ -64,3 +106,993 @@ func TestDatabase_MediumDataset(t *testing.T) {
 
 	require.NoError(t, db.Stop())
 }
+
+func TestDatabase_FlushedKeysVisibleInSameSession(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+
+	// Far past the memtable size, so most keys only live in SSTables
+	const keys = 3000
+	for i := range keys {
+		key := fmt.Sprintf("key:%05d", i)
+		require.NoError(t, db.Put(key, []byte(fmt.Sprintf("value-%d", i))))
+	}
+
+	check := func() {
+		for i := range keys {
+			key := fmt.Sprintf("key:%05d", i)
+			v, ok := db.Get(key)
+			require.True(t, ok, key)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), v, key)
+		}
+	}
+
+	check()
+
+	// Every queued memtable is flushed and retired once the flusher stops
+	require.NoError(t, db.Stop())
+	check()
+}
+
+func TestDatabase_GetReportsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	for i := range 100 {
+		require.NoError(t, db.Put(fmt.Sprintf("key:%04d", i), make([]byte, 64)))
+	}
+	require.NoError(t, db.Stop())
+
+	// Flip a byte of the first data block of every table, the first key
+	// written lives in one of them
+	tables, err := filepath.Glob(filepath.Join(dir, "data", "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, tables)
+	for _, p := range tables {
+		content, err := os.ReadFile(p)
+		require.NoError(t, err)
+		content[20] ^= 0xff
+		require.NoError(t, os.WriteFile(p, content, 0644))
+	}
+
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	_, _, err = db.GetWithError("key:0000")
+	require.ErrorIs(t, err, api.ErrCorruption)
+	_, ok := db.Get("key:0000")
+	require.False(t, ok)
+
+	snapshot := db.NewSnapshot()
+	defer snapshot.Release()
+	_, _, err = snapshot.GetWithError("key:0000")
+	require.ErrorIs(t, err, api.ErrCorruption)
+
+	txn := db.Begin()
+	defer txn.Rollback()
+	_, _, err = txn.Get("key:0000")
+	require.ErrorIs(t, err, api.ErrCorruption)
+}
+
+func TestDatabase_StoresTombstoneLookalike(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	require.NoError(t, db.Put("literal", []byte("__TOMBSTONE__")))
+	require.NoError(t, db.Put("deleted", []byte("value")))
+	require.NoError(t, db.Delete("deleted"))
+
+	check := func() {
+		v, ok := db.Get("literal")
+		require.True(t, ok)
+		require.Equal(t, []byte("__TOMBSTONE__"), v)
+
+		_, ok = db.Get("deleted")
+		require.False(t, ok)
+
+		keys := make([]string, 0)
+		require.NoError(t, db.Scan(nil, func(key string, value []byte) bool {
+			keys = append(keys, key)
+			return true
+		}))
+		require.Contains(t, keys, "literal")
+		require.NotContains(t, keys, "deleted")
+	}
+
+	// From the memtable, then from SSTables once flushed
+	check()
+	for i := range 1000 {
+		require.NoError(t, db.Put(fmt.Sprintf("filler:%04d", i), []byte("value")))
+	}
+	check()
+
+	// From the WAL and the SSTables after a restart
+	require.NoError(t, db.Stop())
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	check()
+	require.NoError(t, db.Stop())
+}
+
+func TestDatabase_RotatesOnMemTableBytes(t *testing.T) {
+	// The tables flushed once writes stop, the active memtable is left to
+	// the WAL
+	flushed := func(write func(db *api.Database)) []api.TableProperties {
+		dir := t.TempDir()
+		db := newTestDatabase(t, dir)
+		require.NoError(t, db.Start())
+		write(db)
+		require.NoError(t, db.Stop())
+
+		db = newTestDatabase(t, dir)
+		require.NoError(t, db.Start())
+		defer db.Stop()
+
+		tables, err := db.TableProperties()
+		require.NoError(t, err)
+		return tables
+	}
+
+	// Deletes fill the memtable as well
+	tables := flushed(func(db *api.Database) {
+		for i := range 60 {
+			require.NoError(t, db.Delete(fmt.Sprintf("key:%04d", i)))
+		}
+	})
+	require.Len(t, tables, 1)
+	require.Greater(t, tables[0].NumTombstones, uint64(0))
+	require.Equal(t, tables[0].NumEntries, tables[0].NumTombstones)
+
+	// A value larger than the memtable fills it at once
+	tables = flushed(func(db *api.Database) {
+		require.NoError(t, db.Put("large", make([]byte, 8<<10)))
+		require.NoError(t, db.Put("small", []byte("value")))
+	})
+	require.Len(t, tables, 1)
+	require.Equal(t, "large", tables[0].Smallest)
+	require.Equal(t, "large", tables[0].Largest)
+}
+
+func TestDatabase_FlushDropsShadowedVersions(t *testing.T) {
+	// Versions of a key overwritten 20 times, a snapshot taken after the
+	// 10th when snapshotAt is set, are flushed along with a large value
+	flushed := func(snapshotAt int) api.TableProperties {
+		db := newTestDatabase(t, t.TempDir())
+		require.NoError(t, db.Start())
+
+		for i := 1; i <= 20; i++ {
+			require.NoError(t, db.Put("key", []byte(fmt.Sprintf("value-%d", i))))
+			if i == snapshotAt {
+				snapshot := db.NewSnapshot()
+				defer snapshot.Release()
+			}
+		}
+		require.NoError(t, db.Put("large", make([]byte, 4<<10)))
+		require.NoError(t, db.Put("next", []byte("value")))
+		require.NoError(t, db.Stop())
+
+		tables, err := db.TableProperties()
+		require.NoError(t, err)
+		require.Len(t, tables, 1)
+		return tables[0]
+	}
+
+	// Only the last version of key is left to read
+	require.Equal(t, uint64(2), flushed(0).NumEntries)
+
+	// The snapshot still reads the 10th version, the later ones are kept
+	require.Equal(t, uint64(11+1), flushed(10).NumEntries)
+}
+
+// fillWriteBuffer writes to db in the background until its write buffer of
+// 16KB is full and a write stalls on the flushes. It returns what the writes
+// end with.
+func fillWriteBuffer(t *testing.T, db *api.Database) <-chan error {
+	written := make(chan error, 1)
+	go func() {
+		for i := range 1000 {
+			if err := db.Put(fmt.Sprintf("key:%05d", i), make([]byte, 64)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	require.Eventually(t, func() bool {
+		return db.WriteBufferByteSize() >= 16<<10
+	}, 5*time.Second, time.Millisecond)
+	return written
+}
+
+func TestDatabase_WritesRecoverFromFailedFlushes(t *testing.T) {
+	dir := t.TempDir()
+
+	// The disk is full until told otherwise
+	var failures atomic.Int64
+	var full atomic.Bool
+	full.Store(true)
+	engine.SyncHook = func(path string) error {
+		if full.Load() && filepath.Ext(path) == ".sst" {
+			failures.Add(1)
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	// Writes stall on the full write buffer while the flushes are retried
+	written := fillWriteBuffer(t, db)
+	require.Eventually(t, func() bool {
+		return failures.Load() >= 3
+	}, 5*time.Second, time.Millisecond)
+	require.Empty(t, written)
+
+	// Once the disk has room the flushes succeed and the writes resume
+	full.Store(false)
+	require.NoError(t, <-written)
+	require.NoError(t, db.Stop())
+
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+	for i := range 1000 {
+		_, ok := db.Get(fmt.Sprintf("key:%05d", i))
+		require.True(t, ok, i)
+	}
+}
+
+func TestDatabase_StopFailsWritesStalledOnFailedFlushes(t *testing.T) {
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == ".sst" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+
+	// The flushes are given up on, failing the stalled write, and reported
+	written := fillWriteBuffer(t, db)
+	require.ErrorIs(t, db.Stop(), syscall.ENOSPC)
+	require.ErrorIs(t, <-written, syscall.ENOSPC)
+}
+
+func TestDatabase_WriteBufferBoundsMemTables(t *testing.T) {
+	db, err := api.NewDatabase(t.TempDir(), &api.Options{
+		MemTableByteSize:    4 << 10,
+		WriteBufferByteSize: 8 << 10,
+		BlockByteSize:       256,
+		FlusherWorkers:      1,
+		SyncMode:            api.SyncNone,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	for i := range 2000 {
+		require.NoError(t, db.Put(fmt.Sprintf("key:%05d", i), []byte("value")))
+		require.Less(t, db.WriteBufferByteSize(), 8<<10+1<<10)
+	}
+}
+
+func TestDatabase_StalledWriteKeepsReadsGoing(t *testing.T) {
+	// Flushes hang until released, so that writes stall on a full write buffer
+	release := make(chan struct{})
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == ".sst" {
+			<-release
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+
+	written := make(chan error, 1)
+	go func() {
+		for i := range 1000 {
+			if err := db.Put(fmt.Sprintf("key:%05d", i), make([]byte, 64)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	// within runs fn and fails the test when the stall holds it up
+	within := func(fn func()) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fn()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "held up by the stalled write")
+		}
+	}
+
+	for stalled := false; !stalled; time.Sleep(time.Millisecond) {
+		within(func() { stalled = db.WriteBufferByteSize() >= 16<<10 })
+	}
+
+	// Iterators and snapshots are not held up by the write waiting for a flush
+	var itErr, snapshotItErr error
+	within(func() {
+		var it *api.Iterator
+		if it, itErr = db.NewIterator(nil); itErr == nil {
+			it.Close()
+		}
+
+		snapshot := db.NewSnapshot()
+		defer snapshot.Release()
+		if it, snapshotItErr = snapshot.NewIterator(nil); snapshotItErr == nil {
+			it.Close()
+		}
+	})
+	require.NoError(t, itErr)
+	require.NoError(t, snapshotItErr)
+
+	select {
+	case err := <-written:
+		require.FailNow(t, "the write did not stall", "%v", err)
+	default:
+	}
+
+	close(release)
+	require.NoError(t, <-written)
+	require.NoError(t, db.Stop())
+}
+
+func TestDatabase_RotationDoesNotWaitForFlushes(t *testing.T) {
+	// Flushes hang until released
+	release := make(chan struct{})
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == ".sst" {
+			<-release
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	db, err := api.NewDatabase(t.TempDir(), &api.Options{
+		MemTableByteSize:    4 << 10,
+		WriteBufferByteSize: 1 << 20,
+		FlusherWorkers:      1,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+
+	// Far more memtables than flusher workers fill up, none of them flushed
+	written := make(chan error, 1)
+	go func() {
+		for i := range 1000 {
+			if err := db.Put(fmt.Sprintf("key:%05d", i), make([]byte, 64)); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	select {
+	case err := <-written:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "writes held up by the flushes")
+	}
+	require.Greater(t, db.WriteBufferByteSize(), 20*4<<10)
+
+	close(release)
+	require.NoError(t, db.Stop())
+}
+
+func TestDatabase_ParallelPutAndGet(t *testing.T) {
+	db, err := api.NewDatabase(t.TempDir(), &api.Options{
+		MemTableByteSize: 16 << 10,
+		BlockByteSize:    256,
+		SyncMode:         api.SyncNone,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	const (
+		writers   = 4
+		readers   = 8
+		perWriter = 1000
+	)
+
+	// written[w] is the number of keys writer w is done with
+	var written [writers]atomic.Int64
+	var wg sync.WaitGroup
+
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := fmt.Sprintf("w%d:%05d", w, i)
+				require.NoError(t, db.Put(key, []byte(key)))
+				written[w].Add(1)
+			}
+		}()
+	}
+
+	var readersDone sync.WaitGroup
+	stop := make(chan struct{})
+	for r := range readers {
+		readersDone.Add(1)
+		go func() {
+			defer readersDone.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// Every acknowledged write is visible, through memtable
+				// rotations and flushes
+				w := (r + i) % writers
+				n := written[w].Load()
+				if n == 0 {
+					continue
+				}
+				key := fmt.Sprintf("w%d:%05d", w, rand.Int63n(n))
+				v, ok := db.Get(key)
+				require.True(t, ok, key)
+				require.Equal(t, key, string(v))
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readersDone.Wait()
+
+	count := 0
+	require.NoError(t, db.Scan(nil, func(key string, value []byte) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, writers*perWriter, count)
+}
+
+func TestDatabase_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	const (
+		writers   = 32
+		perWriter = 50
+	)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				key := fmt.Sprintf("w%02d:%03d", w, i)
+				require.NoError(t, db.Put(key, []byte(key)))
+			}
+
+			// A DeleteRange leads its own group, it sees every write before it
+			batch := api.NewWriteBatch()
+			batch.Put(fmt.Sprintf("w%02d:zzz", w), []byte("gone"))
+			batch.DeleteRange(fmt.Sprintf("w%02d:025", w), fmt.Sprintf("w%02d:~", w))
+			require.NoError(t, db.Write(batch))
+		}()
+	}
+	wg.Wait()
+
+	stats := db.WALStats()
+	require.GreaterOrEqual(t, stats.Records, uint64(writers*(perWriter+1)))
+	require.LessOrEqual(t, stats.Groups, stats.Records)
+	// Rotations fsync the segment they close on top of every group
+	require.GreaterOrEqual(t, stats.Syncs, stats.Groups)
+	require.GreaterOrEqual(t, stats.MaxGroupRecords, uint64(1))
+
+	check := func(db *api.Database) {
+		count := 0
+		require.NoError(t, db.Scan(nil, func(key string, value []byte) bool {
+			require.Equal(t, key, string(value))
+			count++
+			return true
+		}))
+		require.Equal(t, writers*25, count)
+	}
+	check(db)
+	require.NoError(t, db.Stop())
+
+	// Every group was replayed as it was written
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+	check(db)
+}
+
+// BenchmarkDatabase_Put measures the throughput of concurrent writers with
+// every write synced, and how many records a group commit takes on average.
+func BenchmarkDatabase_Put(b *testing.B) {
+	for _, writers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			db, err := api.Open(b.TempDir(), &api.Options{SyncMode: api.SyncAlways})
+			require.NoError(b, err)
+			defer db.Stop()
+
+			value := make([]byte, 100)
+			var next atomic.Int64
+			var wg sync.WaitGroup
+
+			b.ResetTimer()
+			for range writers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := next.Add(1); i <= int64(b.N); i = next.Add(1) {
+						if err := db.Put(fmt.Sprintf("key:%016d", i), value); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+
+			stats := db.WALStats()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "writes/s")
+			b.ReportMetric(float64(stats.Records)/float64(max(stats.Groups, 1)), "records/group")
+		})
+	}
+}
+
+// crashCopy copies the files of the database in dir to a new directory as a
+// crash would leave them. A process crash keeps the whole WAL, a machine
+// crash only the first walByteSize bytes of its single segment, the ones
+// fsynced.
+func crashCopy(t *testing.T, dir string, walByteSize int64) string {
+	crashed := t.TempDir()
+
+	require.NoError(t, os.CopyFS(crashed, os.DirFS(dir)))
+	if walByteSize >= 0 {
+		segments, err := filepath.Glob(filepath.Join(crashed, "*.log"))
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+		require.NoError(t, os.Truncate(segments[0], walByteSize))
+	}
+
+	return crashed
+}
+
+func TestDatabase_SyncModes(t *testing.T) {
+	const processCrash = -1
+
+	tests := []struct {
+		name string
+		mode api.SyncMode
+		// write returns the keys a crash may not lose
+		write func(t *testing.T, db *api.Database) []string
+		// machineCrash cuts the WAL to what was fsynced, rather than keeping
+		// it all as a process crash does
+		machineCrash bool
+	}{
+		{
+			name:         "always survives a machine crash",
+			mode:         api.SyncAlways,
+			machineCrash: true,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				require.NoError(t, db.Put("b", []byte("b")))
+				return []string{"a", "b"}
+			},
+		},
+		{
+			name: "none survives a process crash",
+			mode: api.SyncNone,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				return []string{"a"}
+			},
+		},
+		{
+			name:         "none loses unsynced writes to a machine crash",
+			mode:         api.SyncNone,
+			machineCrash: true,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				return nil
+			},
+		},
+		{
+			name:         "periodic loses nothing older than a period",
+			mode:         api.SyncPeriodic,
+			machineCrash: true,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				require.Eventually(t, func() bool {
+					stats := db.WALStats()
+					return stats.SyncedBytes == stats.Bytes
+				}, time.Second, time.Millisecond)
+
+				require.NoError(t, db.Put("b", []byte("b")))
+				return []string{"a"}
+			},
+		},
+		{
+			name:         "batch syncs on batches only",
+			mode:         api.SyncBatch,
+			machineCrash: true,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				batch := api.NewWriteBatch()
+				batch.Put("b", []byte("b"))
+				require.NoError(t, db.Write(batch))
+				require.NoError(t, db.Put("c", []byte("c")))
+				return []string{"a", "b"}
+			},
+		},
+		{
+			name: "no WAL loses everything to a process crash",
+			mode: api.SyncNoWAL,
+			write: func(t *testing.T, db *api.Database) []string {
+				require.NoError(t, db.Put("a", []byte("a")))
+				return nil
+			},
+		},
+		{
+			name:         "a write asking for sync survives a machine crash",
+			mode:         api.SyncNone,
+			machineCrash: true,
+			write: func(t *testing.T, db *api.Database) []string {
+				batch := api.NewWriteBatch()
+				batch.Put("a", []byte("a"))
+				require.NoError(t, db.WriteWithOptions(batch, &api.WriteOptions{Sync: true}))
+				require.NoError(t, db.Put("b", []byte("b")))
+				return []string{"a"}
+			},
+		},
+		{
+			name: "a write skipping the WAL is lost to a process crash",
+			mode: api.SyncAlways,
+			write: func(t *testing.T, db *api.Database) []string {
+				batch := api.NewWriteBatch()
+				batch.Put("a", []byte("a"))
+				require.NoError(t, db.WriteWithOptions(batch, &api.WriteOptions{DisableWAL: true}))
+				require.NoError(t, db.Put("b", []byte("b")))
+				return []string{"b"}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := &api.Options{
+				SyncMode:   tt.mode,
+				SyncPeriod: 5 * time.Millisecond,
+			}
+			db, err := api.NewDatabase(dir, opts)
+			require.NoError(t, err)
+			require.NoError(t, db.Start())
+
+			durable := tt.write(t, db)
+			all := []string{"a", "b", "c"}
+
+			walByteSize := int64(processCrash)
+			if tt.machineCrash {
+				walByteSize = int64(db.WALStats().SyncedBytes)
+			}
+			crashed := crashCopy(t, dir, walByteSize)
+
+			// Reopened from the crash, the database holds the durable writes
+			// and none of the others
+			db2, err := api.NewDatabase(crashed, opts)
+			require.NoError(t, err)
+			require.NoError(t, db2.Start())
+			for _, key := range all {
+				v, ok := db2.Get(key)
+				require.Equal(t, slices.Contains(durable, key), ok, key)
+				if ok {
+					require.Equal(t, key, string(v))
+				}
+			}
+			require.NoError(t, db2.Stop())
+
+			// Stopped cleanly, whatever the mode, nothing is lost
+			written := make(map[string]bool)
+			for _, key := range all {
+				_, written[key] = db.Get(key)
+			}
+			require.NoError(t, db.Stop())
+
+			db, err = api.NewDatabase(dir, opts)
+			require.NoError(t, err)
+			require.NoError(t, db.Start())
+			defer db.Stop()
+			for _, key := range all {
+				_, ok := db.Get(key)
+				require.Equal(t, written[key], ok, key)
+			}
+		})
+	}
+}
+
+func TestDatabase_StopWaitsForQueuedWrites(t *testing.T) {
+	dir := t.TempDir()
+
+	// The next fsync of the WAL hangs until released
+	var armed atomic.Bool
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == ".log" && armed.CompareAndSwap(true, false) {
+			close(blocked)
+			<-release
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	// A write skipping the WAL has Stop rotate the memtable
+	batch := api.NewWriteBatch()
+	batch.Put("unlogged", []byte("value"))
+	require.NoError(t, db.WriteWithOptions(batch, &api.WriteOptions{DisableWAL: true}))
+
+	armed.Store(true)
+	written := make(chan error, 1)
+	go func() { written <- db.Put("logged", []byte("value")) }()
+	<-blocked
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- db.Stop() }()
+
+	// Probes queue behind the write in the WAL until Stop refuses them, the
+	// write then goes through before Stop returns
+	for refused := false; !refused; {
+		probe := make(chan error, 1)
+		go func() { probe <- db.Put("probe", []byte("value")) }()
+		select {
+		case err := <-probe:
+			require.ErrorIs(t, err, api.ErrDatabaseStopped)
+			refused = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(release)
+	require.NoError(t, <-written)
+	require.NoError(t, <-stopped)
+	require.ErrorIs(t, db.Put("late", []byte("value")), api.ErrDatabaseStopped)
+
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	defer db.Stop()
+	for _, key := range []string{"unlogged", "logged"} {
+		_, ok := db.Get(key)
+		require.True(t, ok, key)
+	}
+	_, ok := db.Get("late")
+	require.False(t, ok)
+}
+
+func TestDatabase_WALRecoveryModes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := api.NewDatabase(dir, &api.Options{})
+	require.NoError(t, err)
+	require.NoError(t, db.Start())
+	require.NoError(t, db.Put("a", []byte("a")))
+	require.NoError(t, db.Put("b", []byte("b")))
+
+	// A crash mid-append leaves a torn record at the end of the segment
+	torn := func(t *testing.T) string {
+		crashed := crashCopy(t, dir, -1)
+		segments, err := filepath.Glob(filepath.Join(crashed, "*.log"))
+		require.NoError(t, err)
+		require.Len(t, segments, 1)
+
+		f, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 1, 0, 'c'})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		return crashed
+	}
+
+	t.Run("strict fails", func(t *testing.T) {
+		fds, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("open files are not listed")
+		}
+
+		db2, err := api.NewDatabase(torn(t), &api.Options{WALRecoveryMode: api.StrictWALRecovery})
+		require.NoError(t, err)
+		require.ErrorIs(t, db2.Start(), api.ErrCorruption)
+
+		// Nothing is left open, a failed start can be tried again
+		after, err := os.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		require.Len(t, after, len(fds))
+		require.ErrorIs(t, db2.Start(), api.ErrCorruption)
+	})
+
+	for name, mode := range map[string]api.WALRecoveryMode{
+		"truncate drops the torn record": api.TruncateWALRecovery,
+		"skip drops the torn record":     api.SkipWALRecovery,
+	} {
+		t.Run(name, func(t *testing.T) {
+			db2, err := api.NewDatabase(torn(t), &api.Options{WALRecoveryMode: mode})
+			require.NoError(t, err)
+			require.NoError(t, db2.Start())
+			recovery := db2.Recovery()
+
+			require.Equal(t, 2, recovery.Records)
+			require.Equal(t, int64(db.WALStats().Bytes), recovery.RecoveredBytes)
+			require.Equal(t, 1, recovery.DroppedRecords)
+			require.Equal(t, int64(5), recovery.DroppedBytes)
+			require.Len(t, recovery.Corruptions, 1)
+
+			for _, key := range []string{"a", "b"} {
+				v, ok := db2.Get(key)
+				require.True(t, ok, key)
+				require.Equal(t, key, string(v))
+			}
+			require.NoError(t, db2.Stop())
+		})
+	}
+	require.NoError(t, db.Stop())
+}
+
+func TestDatabase_RemovesFlushedWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	segments := func() []string {
+		segments, err := filepath.Glob(filepath.Join(dir, "*.log"))
+		require.NoError(t, err)
+		return segments
+	}
+
+	for i := range 2000 {
+		require.NoError(t, db.Put(fmt.Sprintf("key:%05d", i), []byte("value")))
+	}
+
+	// Stop flushes every queued memtable, only the segment of the active one
+	// is left to replay
+	tables, err := db.TableProperties()
+	require.NoError(t, err)
+	require.NotEmpty(t, tables)
+	require.NoError(t, db.Stop())
+	require.Len(t, segments(), 1)
+
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	for i := range 2000 {
+		v, ok := db.Get(fmt.Sprintf("key:%05d", i))
+		require.True(t, ok)
+		require.Equal(t, "value", string(v))
+	}
+
+	// The replayed segment goes with the next flush, along with the one
+	// opened by Start
+	replayed := segments()
+	require.Len(t, replayed, 2)
+	for i := range 1000 {
+		require.NoError(t, db.Put(fmt.Sprintf("more:%05d", i), []byte("value")))
+	}
+	require.NoError(t, db.Stop())
+	require.Len(t, segments(), 1)
+	require.NotContains(t, replayed, segments()[0])
+}
+
+func killedOptions() *api.Options {
+	return &api.Options{
+		MemTableByteSize: 4 << 10,
+		BlockByteSize:    256,
+		SyncMode:         api.SyncNone,
+	}
+}
+
+// TestDatabase_KilledHelper is the process TestDatabase_KilledMidFlush kills.
+// It puts keys from GODB_KILLED_FROM on, prints the index of every one
+// acknowledged and kills itself right before its GODB_KILLED_AT-th fsync.
+func TestDatabase_KilledHelper(t *testing.T) {
+	dir := os.Getenv("GODB_KILLED_DIR")
+	if dir == "" {
+		t.Skip("run by TestDatabase_KilledMidFlush")
+	}
+
+	from, err := strconv.Atoi(os.Getenv("GODB_KILLED_FROM"))
+	require.NoError(t, err)
+	killAt, err := strconv.Atoi(os.Getenv("GODB_KILLED_AT"))
+	require.NoError(t, err)
+
+	var syncs atomic.Int64
+	engine.SyncHook = func(path string) error {
+		if syncs.Add(1) == int64(killAt) {
+			fmt.Println("killed before the fsync of", filepath.Base(path))
+			syscall.Kill(os.Getpid(), syscall.SIGKILL)
+		}
+		return nil
+	}
+
+	db, err := api.Open(dir, killedOptions())
+	require.NoError(t, err)
+	for i := from; ; i++ {
+		key := fmt.Sprintf("key:%06d", i)
+		require.NoError(t, db.Put(key, []byte(key)))
+		fmt.Println(i)
+	}
+}
+
+// TestDatabase_KilledMidFlush kills a process writing with memtables small
+// enough to be flushing all the time, before a different fsync every round,
+// so that it dies during recovery and at every step of a flush, and checks
+// that no acknowledged write is lost.
+func TestDatabase_KilledMidFlush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("kills processes")
+	}
+
+	dir := t.TempDir()
+	acked := -1
+	for round := range 10 {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDatabase_KilledHelper$")
+		cmd.Env = append(os.Environ(),
+			"GODB_KILLED_DIR="+dir,
+			fmt.Sprintf("GODB_KILLED_FROM=%d", acked+1),
+			fmt.Sprintf("GODB_KILLED_AT=%d", 1+round*4),
+		)
+		stdout, err := cmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, cmd.Start())
+
+		output := make([]string, 0)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if i, err := strconv.Atoi(scanner.Text()); err == nil {
+				acked = i
+			} else {
+				output = append(output, scanner.Text())
+			}
+		}
+
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, cmd.Wait(), &exitErr)
+		require.False(t, exitErr.Exited(), "the helper failed: %v", output)
+		require.Contains(t, strings.Join(output, "\n"), "killed before the fsync of")
+
+		db, err := api.Open(dir, killedOptions())
+		require.NoError(t, err)
+		for i := 0; i <= acked; i++ {
+			key := fmt.Sprintf("key:%06d", i)
+			v, ok := db.Get(key)
+			require.True(t, ok, "round %d lost %s", round, key)
+			require.Equal(t, key, string(v))
+		}
+		require.NoError(t, db.Stop())
+	}
+
+	db, err := api.Open(dir, killedOptions())
+	require.NoError(t, err)
+	defer db.Stop()
+	tables, err := db.TableProperties()
+	require.NoError(t, err)
+	require.NotEmpty(t, tables)
+}
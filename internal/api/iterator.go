@@ -0,0 +1,253 @@
+package api
+
+import (
+	"fmt"
+	"godb/internal/engine"
+)
+
+type IteratorOptions struct {
+	// LowerBound is inclusive and UpperBound exclusive. Empty means unbounded.
+	LowerBound string
+	UpperBound string
+
+	// Prefix restricts the iteration to keys starting with it, on top of the
+	// bounds.
+	Prefix string
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// Iterator walks the keys live at its sequence number in order. Shadowed
+// versions, deleted keys and later writes are hidden.
+//
+// While moving forward the underlying iterator sits on the newest entry of the
+// current key. While moving in reverse it sits before every entry of the
+// current key, so key and value are kept aside.
+type Iterator struct {
+	iter engine.Iterator
+	seq  uint64
+
+	lowerBound string
+	upperBound string
+
+	direction direction
+	valid     bool
+	key       string
+	value     []byte
+
+	// observe is called with every key the iterator lands on, when set
+	observe func(key string)
+}
+
+func newIterator(iter engine.Iterator, opts *IteratorOptions, seq uint64) *Iterator {
+	it := &Iterator{iter: iter, seq: seq}
+	if opts == nil {
+		return it
+	}
+
+	it.lowerBound, it.upperBound = iteratorBounds(opts)
+
+	return it
+}
+
+// iteratorBounds returns the range [lower, upper) opts restrict the iteration
+// to, the prefix included. Empty bounds are unbounded.
+func iteratorBounds(opts *IteratorOptions) (lower, upper string) {
+	if opts == nil {
+		return "", ""
+	}
+
+	lower, upper = opts.LowerBound, opts.UpperBound
+	if opts.Prefix != "" {
+		if opts.Prefix > lower {
+			lower = opts.Prefix
+		}
+
+		prefixUpper, ok := prefixUpperBound(opts.Prefix)
+		if ok && (upper == "" || prefixUpper < upper) {
+			upper = prefixUpper
+		}
+	}
+
+	return lower, upper
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) First() {
+	it.direction = forward
+	if it.lowerBound != "" {
+		it.iter.Seek(it.lowerBound)
+	} else {
+		it.iter.SeekToFirst()
+	}
+
+	it.findNextEntry(false, "")
+}
+
+func (it *Iterator) Last() {
+	it.direction = reverse
+	if it.upperBound != "" {
+		it.iter.Seek(it.upperBound)
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+	} else {
+		it.iter.SeekToLast()
+	}
+
+	it.findPrevEntry()
+}
+
+// Seek positions the iterator at the first live key >= key.
+func (it *Iterator) Seek(key string) {
+	if key < it.lowerBound {
+		key = it.lowerBound
+	}
+
+	it.direction = forward
+	it.iter.Seek(key)
+	it.findNextEntry(false, "")
+}
+
+func (it *Iterator) Next() {
+	if it.direction == reverse {
+		if it.iter.Valid() {
+			it.iter.Next()
+		} else {
+			it.iter.SeekToFirst()
+		}
+		it.direction = forward
+	}
+
+	it.findNextEntry(true, it.key)
+}
+
+func (it *Iterator) Prev() {
+	if it.direction == forward {
+		if it.iter.Valid() {
+			it.iter.Prev()
+		} else {
+			it.iter.SeekToLast()
+		}
+		it.direction = reverse
+	}
+
+	it.findPrevEntry()
+}
+
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+func (it *Iterator) Err() error {
+	return it.iter.Err()
+}
+
+func (it *Iterator) Close() error {
+	if err := it.iter.Close(); err != nil {
+		return fmt.Errorf("iterator close: %w", err)
+	}
+
+	return nil
+}
+
+func (it *Iterator) findNextEntry(skipping bool, skipKey string) {
+	for it.iter.Valid() {
+		key := it.iter.Key()
+		if it.upperBound != "" && key >= it.upperBound {
+			break
+		}
+
+		switch {
+		case it.iter.Seq() > it.seq:
+			it.iter.Next()
+		case skipping && key == skipKey:
+			it.iter.Next()
+		case it.iter.Tombstone():
+			skipping = true
+			skipKey = key
+			it.iter.Next()
+		default:
+			it.key = key
+			it.value = it.iter.Value()
+			it.valid = true
+			if it.observe != nil {
+				it.observe(key)
+			}
+			return
+		}
+	}
+
+	it.valid = false
+}
+
+func (it *Iterator) findPrevEntry() {
+	// Entries of a key are visited oldest first, the last one seen decides.
+	deleted := true
+	for it.iter.Valid() {
+		key := it.iter.Key()
+		if it.lowerBound != "" && key < it.lowerBound {
+			break
+		}
+
+		if !deleted && key < it.key {
+			break
+		}
+
+		if it.iter.Seq() > it.seq {
+			it.iter.Prev()
+			continue
+		}
+
+		deleted = it.iter.Tombstone()
+		if deleted {
+			it.key = ""
+			it.value = nil
+		} else {
+			it.key = key
+			it.value = it.iter.Value()
+		}
+
+		it.iter.Prev()
+	}
+
+	// Run off the start, Next moves back to the first key
+	it.valid = !deleted
+	if !it.valid {
+		it.key = ""
+		it.value = nil
+		return
+	}
+
+	if it.observe != nil {
+		it.observe(it.key)
+	}
+}
+
+// prefixUpperBound returns the smallest key greater than every key starting
+// with prefix, false when there is none.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,206 @@
+package api_test
+
+import (
+	"fmt"
+	"godb/internal/api"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type kv struct {
+	key   string
+	value string
+}
+
+func TestIterator_MergesMemTablesAndSSTables(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "data"), 0755))
+
+	expected := make(map[string]string)
+	put := func(db *api.Database, key, value string) {
+		require.NoError(t, db.Put(key, []byte(value)))
+		expected[key] = value
+	}
+	del := func(db *api.Database, key string) {
+		require.NoError(t, db.Delete(key))
+		delete(expected, key)
+	}
+
+	// First session ends up in SSTables and, from its last memtable, the WAL
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	for i := range 1000 {
+		put(db, fmt.Sprintf("key:%04d", i), fmt.Sprintf("value-%d", i))
+	}
+	for i := 0; i < 1000; i += 7 {
+		del(db, fmt.Sprintf("key:%04d", i))
+	}
+	for i := 0; i < 1000; i += 3 {
+		put(db, fmt.Sprintf("key:%04d", i), fmt.Sprintf("updated-%d", i))
+	}
+	require.NoError(t, db.Stop())
+
+	// Second session shadows part of it with tombstones in the memtable
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+	for i := 0; i < 1000; i += 11 {
+		del(db, fmt.Sprintf("key:%04d", i))
+	}
+	defer func() { require.NoError(t, db.Stop()) }()
+
+	reference := make([]kv, 0, len(expected))
+	for k, v := range expected {
+		reference = append(reference, kv{k, v})
+	}
+	slices.SortFunc(reference, func(a, b kv) int { return strings.Compare(a.key, b.key) })
+
+	filter := func(keep func(key string) bool) []kv {
+		result := make([]kv, 0)
+		for _, e := range reference {
+			if keep(e.key) {
+				result = append(result, e)
+			}
+		}
+		return result
+	}
+
+	collectForward := func(opts *api.IteratorOptions) []kv {
+		it, err := db.NewIterator(opts)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+
+		result := make([]kv, 0)
+		for it.First(); it.Valid(); it.Next() {
+			result = append(result, kv{it.Key(), string(it.Value())})
+		}
+		require.NoError(t, it.Err())
+		return result
+	}
+
+	collectReverse := func(opts *api.IteratorOptions) []kv {
+		it, err := db.NewIterator(opts)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+
+		result := make([]kv, 0)
+		for it.Last(); it.Valid(); it.Prev() {
+			result = append(result, kv{it.Key(), string(it.Value())})
+		}
+		require.NoError(t, it.Err())
+		slices.Reverse(result)
+		return result
+	}
+
+	t.Run("full range", func(t *testing.T) {
+		require.Equal(t, reference, collectForward(nil))
+		require.Equal(t, reference, collectReverse(nil))
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		opts := &api.IteratorOptions{LowerBound: "key:0100", UpperBound: "key:0200"}
+		want := filter(func(key string) bool { return key >= "key:0100" && key < "key:0200" })
+
+		require.Equal(t, want, collectForward(opts))
+		require.Equal(t, want, collectReverse(opts))
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		opts := &api.IteratorOptions{Prefix: "key:04"}
+		want := filter(func(key string) bool { return strings.HasPrefix(key, "key:04") })
+
+		require.NotEmpty(t, want)
+		require.Equal(t, want, collectForward(opts))
+		require.Equal(t, want, collectReverse(opts))
+	})
+
+	t.Run("seek and change direction", func(t *testing.T) {
+		it, err := db.NewIterator(nil)
+		require.NoError(t, err)
+		defer func() { require.NoError(t, it.Close()) }()
+
+		pos, _ := slices.BinarySearchFunc(reference, "key:0500x", func(e kv, key string) int {
+			return strings.Compare(e.key, key)
+		})
+
+		it.Seek("key:0500x")
+		require.True(t, it.Valid())
+		require.Equal(t, reference[pos].key, it.Key())
+
+		for range 10 {
+			it.Next()
+			pos++
+			require.Equal(t, reference[pos], kv{it.Key(), string(it.Value())})
+		}
+		for range 15 {
+			it.Prev()
+			pos--
+			require.Equal(t, reference[pos], kv{it.Key(), string(it.Value())})
+		}
+		it.Next()
+		pos++
+		require.Equal(t, reference[pos], kv{it.Key(), string(it.Value())})
+	})
+
+	t.Run("prev after running off either end", func(t *testing.T) {
+		for _, opts := range []*api.IteratorOptions{nil, {UpperBound: "key:0500"}} {
+			want := filter(func(key string) bool { return opts == nil || key < opts.UpperBound })
+
+			it, err := db.NewIterator(opts)
+			require.NoError(t, err)
+
+			for it.First(); it.Valid(); it.Next() {
+			}
+			it.Prev()
+			require.True(t, it.Valid())
+			require.Equal(t, want[len(want)-1], kv{it.Key(), string(it.Value())})
+
+			for it.Last(); it.Valid(); it.Prev() {
+			}
+			it.Next()
+			require.True(t, it.Valid())
+			require.Equal(t, want[0], kv{it.Key(), string(it.Value())})
+
+			require.NoError(t, it.Close())
+		}
+	})
+
+	t.Run("scan stops early", func(t *testing.T) {
+		result := make([]kv, 0)
+		err := db.Scan(&api.IteratorOptions{LowerBound: "key:0900"}, func(key string, value []byte) bool {
+			result = append(result, kv{key, string(value)})
+			return len(result) < 5
+		})
+		require.NoError(t, err)
+		require.Equal(t, filter(func(key string) bool { return key >= "key:0900" })[:5], result)
+	})
+}
+
+func TestIterator_EmptyDatabase(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+	defer func() { require.NoError(t, db.Stop()) }()
+
+	it, err := db.NewIterator(nil)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, it.Close()) }()
+
+	it.First()
+	require.False(t, it.Valid())
+	it.Prev()
+	require.False(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+
+	it.Last()
+	require.False(t, it.Valid())
+	it.Next()
+	require.False(t, it.Valid())
+	it.Prev()
+	require.False(t, it.Valid())
+	require.NoError(t, it.Err())
+}
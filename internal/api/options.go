@@ -0,0 +1,295 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/engine"
+	"time"
+)
+
+// SyncMode decides when the WAL is fsynced, and so what a crash loses. Every
+// mode but SyncNoWAL survives a process crash: the WAL is written before a
+// write returns and the OS keeps it. They differ on a machine crash.
+type SyncMode int
+
+const (
+	// SyncAlways fsyncs the WAL before a write returns, an acknowledged write
+	// survives a machine crash.
+	SyncAlways SyncMode = iota
+	// SyncNone leaves the WAL to the OS page cache, a process crash loses
+	// nothing but a machine crash loses the writes not written back yet.
+	SyncNone
+	// SyncPeriodic fsyncs the WAL every SyncPeriod in the background, a
+	// machine crash loses at most the writes of the last period.
+	SyncPeriodic
+	// SyncBatch fsyncs the WAL when a WriteBatch or a transaction is written,
+	// not on Put and Delete. A machine crash loses the single writes since
+	// the last batch, the batch making every write before it durable too.
+	SyncBatch
+	// SyncNoWAL writes nothing to the WAL. Writes are durable once their
+	// memtable is flushed, Stop flushes the last one; a crash, of the process
+	// or the machine, loses every write not flushed yet.
+	SyncNoWAL
+)
+
+// WriteOptions overrides the durability of a single write, nil meaning the
+// SyncMode of the database.
+type WriteOptions struct {
+	// Sync fsyncs the WAL before the write returns, whatever the SyncMode.
+	Sync bool
+	// DisableWAL skips the WAL for the write, which is then lost on a crash
+	// before its memtable is flushed, as with SyncNoWAL.
+	DisableWAL bool
+}
+
+// WALRecoveryMode decides what Start does with a WAL record that is cut
+// short or does not match its checksum.
+type WALRecoveryMode int
+
+const (
+	// TruncateWALRecovery replays the WAL up to the first bad record and cuts
+	// it there, the default. A power cut in the middle of an append leaves a
+	// torn tail that is dropped this way, along with any record after it.
+	TruncateWALRecovery WALRecoveryMode = iota
+	// StrictWALRecovery fails Start on the first bad record.
+	StrictWALRecovery
+	// SkipWALRecovery drops the bad records and replays the records after
+	// them, Recovery reports what was dropped. Writes of a dropped record are
+	// lost while later ones are kept.
+	SkipWALRecovery
+)
+
+type Compression int
+
+const (
+	// LZCompression is a fast LZ77 codec, the default.
+	LZCompression Compression = iota
+	NoCompression
+	// DeflateCompression compresses better than LZCompression at a higher
+	// CPU cost.
+	DeflateCompression
+)
+
+// Options configures a database. Zero fields take their default, so that a
+// partly filled Options behaves as DefaultOptions with those fields changed.
+type Options struct {
+	// MemTableByteSize is the approximate memory, keys, values and skiplist
+	// nodes, the memtable holds before it is flushed to an SSTable.
+	MemTableByteSize int
+	// WriteBufferByteSize bounds the memory of the memtable and of those
+	// waiting to be flushed together. Writes wait for flushes once it is
+	// reached. Zero means four memtables.
+	WriteBufferByteSize int
+
+	// SkipListMaxLevel and SkipListProbability, a percentage, shape the
+	// memtable skiplist.
+	SkipListMaxLevel    int
+	SkipListProbability int
+
+	// BlockByteSize is the size a data block grows to before the next one is
+	// started.
+	BlockByteSize int
+	// RestartInterval is the number of keys between two restart points of a
+	// data block, every restart point stores its key in full.
+	RestartInterval int
+	// Compression of data blocks, a block saving less than an eighth of its
+	// size is stored uncompressed.
+	Compression Compression
+
+	// BloomBitsPerKey sizes the bloom filter of every SSTable, 10 gives about
+	// 1% false positives.
+	BloomBitsPerKey int
+
+	// BlockCacheByteSize is the size of the data blocks kept in memory
+	// across reads.
+	BlockCacheByteSize int64
+
+	// SkipChecksumVerification reads data blocks without checking their
+	// checksum, trading corruption detection for CPU.
+	SkipChecksumVerification bool
+
+	// MaxOpenFiles bounds the SSTables kept open across reads. Tables in use
+	// stay open regardless.
+	MaxOpenFiles int
+
+	FlusherWorkers int
+
+	// L0CompactionTrigger is the number of level 0 SSTables that starts their
+	// compaction into level 1.
+	L0CompactionTrigger int
+	// BaseLevelByteSize is the size level 1 is compacted down from, every
+	// level below allowed LevelMultiplier times the size of the one above.
+	BaseLevelByteSize int64
+	LevelMultiplier   int
+	// TargetFileByteSize is the size a compaction grows an SSTable to before
+	// it starts the next one.
+	TargetFileByteSize int64
+
+	SyncMode SyncMode
+	// SyncPeriod is the time between two fsyncs of SyncPeriodic.
+	SyncPeriod time.Duration
+	// WALRecoveryMode handles the bad WAL records met by Start.
+	WALRecoveryMode WALRecoveryMode
+
+	// CreateIfMissing creates a database when path holds none, Start failing
+	// otherwise. Nil means true.
+	CreateIfMissing *bool
+	// ErrorIfExists fails Start when path already holds a database.
+	ErrorIfExists bool
+}
+
+var (
+	ErrInvalidOptions   = errors.New("invalid options")
+	ErrDatabaseNotFound = errors.New("database not found")
+	ErrDatabaseExists   = errors.New("database already exists")
+)
+
+func DefaultOptions() *Options {
+	createIfMissing := true
+	return &Options{
+		MemTableByteSize:    4 << 20,
+		WriteBufferByteSize: 16 << 20,
+		SkipListMaxLevel:    12,
+		SkipListProbability: 25,
+		BlockByteSize:       4 << 10,
+		RestartInterval:     16,
+		Compression:         LZCompression,
+		BloomBitsPerKey:     10,
+		BlockCacheByteSize:  8 << 20,
+		MaxOpenFiles:        500,
+		FlusherWorkers:      3,
+		L0CompactionTrigger: 4,
+		BaseLevelByteSize:   10 << 20,
+		LevelMultiplier:     10,
+		TargetFileByteSize:  2 << 20,
+		SyncMode:            SyncAlways,
+		SyncPeriod:          100 * time.Millisecond,
+		CreateIfMissing:     &createIfMissing,
+	}
+}
+
+// withDefaults returns a copy of o with zero fields set to their default.
+func (o *Options) withDefaults() *Options {
+	defaults := DefaultOptions()
+	if o == nil {
+		return defaults
+	}
+
+	opts := *o
+	if opts.MemTableByteSize == 0 {
+		opts.MemTableByteSize = defaults.MemTableByteSize
+	}
+	if opts.WriteBufferByteSize == 0 {
+		opts.WriteBufferByteSize = 4 * opts.MemTableByteSize
+	}
+	if opts.SkipListMaxLevel == 0 {
+		opts.SkipListMaxLevel = defaults.SkipListMaxLevel
+	}
+	if opts.SkipListProbability == 0 {
+		opts.SkipListProbability = defaults.SkipListProbability
+	}
+	if opts.BlockByteSize == 0 {
+		opts.BlockByteSize = defaults.BlockByteSize
+	}
+	if opts.RestartInterval == 0 {
+		opts.RestartInterval = defaults.RestartInterval
+	}
+	if opts.BloomBitsPerKey == 0 {
+		opts.BloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	if opts.BlockCacheByteSize == 0 {
+		opts.BlockCacheByteSize = defaults.BlockCacheByteSize
+	}
+	if opts.MaxOpenFiles == 0 {
+		opts.MaxOpenFiles = defaults.MaxOpenFiles
+	}
+	if opts.FlusherWorkers == 0 {
+		opts.FlusherWorkers = defaults.FlusherWorkers
+	}
+	if opts.L0CompactionTrigger == 0 {
+		opts.L0CompactionTrigger = defaults.L0CompactionTrigger
+	}
+	if opts.BaseLevelByteSize == 0 {
+		opts.BaseLevelByteSize = defaults.BaseLevelByteSize
+	}
+	if opts.LevelMultiplier == 0 {
+		opts.LevelMultiplier = defaults.LevelMultiplier
+	}
+	if opts.TargetFileByteSize == 0 {
+		opts.TargetFileByteSize = defaults.TargetFileByteSize
+	}
+	if opts.SyncPeriod == 0 {
+		opts.SyncPeriod = defaults.SyncPeriod
+	}
+	if opts.CreateIfMissing == nil {
+		opts.CreateIfMissing = defaults.CreateIfMissing
+	}
+
+	return &opts
+}
+
+// validate checks options with their defaults applied.
+func (o *Options) validate() error {
+	switch {
+	case o.MemTableByteSize <= 0:
+		return fmt.Errorf("%w: memtable byte size must be positive", ErrInvalidOptions)
+	case o.WriteBufferByteSize < o.MemTableByteSize:
+		return fmt.Errorf("%w: write buffer byte size must be at least the memtable byte size", ErrInvalidOptions)
+	case o.SkipListMaxLevel <= 0 || o.SkipListMaxLevel > 32:
+		return fmt.Errorf("%w: skiplist max level must be in [1, 32]", ErrInvalidOptions)
+	case o.SkipListProbability <= 0 || o.SkipListProbability >= 100:
+		return fmt.Errorf("%w: skiplist probability must be in [1, 99]", ErrInvalidOptions)
+	case o.BlockByteSize <= 0:
+		return fmt.Errorf("%w: block byte size must be positive", ErrInvalidOptions)
+	case o.RestartInterval <= 0:
+		return fmt.Errorf("%w: restart interval must be positive", ErrInvalidOptions)
+	case o.BloomBitsPerKey <= 0 || o.BloomBitsPerKey > 64:
+		return fmt.Errorf("%w: bloom bits per key must be in [1, 64]", ErrInvalidOptions)
+	case o.BlockCacheByteSize <= 0:
+		return fmt.Errorf("%w: block cache byte size must be positive", ErrInvalidOptions)
+	case o.MaxOpenFiles <= 0:
+		return fmt.Errorf("%w: max open files must be positive", ErrInvalidOptions)
+	case o.FlusherWorkers <= 0:
+		return fmt.Errorf("%w: flusher workers must be positive", ErrInvalidOptions)
+	case o.L0CompactionTrigger <= 0:
+		return fmt.Errorf("%w: l0 compaction trigger must be positive", ErrInvalidOptions)
+	case o.BaseLevelByteSize <= 0:
+		return fmt.Errorf("%w: base level byte size must be positive", ErrInvalidOptions)
+	case o.LevelMultiplier < 2:
+		return fmt.Errorf("%w: level multiplier must be at least 2", ErrInvalidOptions)
+	case o.TargetFileByteSize <= 0:
+		return fmt.Errorf("%w: target file byte size must be positive", ErrInvalidOptions)
+	case o.Compression < LZCompression || o.Compression > DeflateCompression:
+		return fmt.Errorf("%w: unknown compression %d", ErrInvalidOptions, o.Compression)
+	case o.SyncMode < SyncAlways || o.SyncMode > SyncNoWAL:
+		return fmt.Errorf("%w: unknown sync mode %d", ErrInvalidOptions, o.SyncMode)
+	case o.SyncPeriod <= 0:
+		return fmt.Errorf("%w: sync period must be positive", ErrInvalidOptions)
+	case o.WALRecoveryMode < TruncateWALRecovery || o.WALRecoveryMode > SkipWALRecovery:
+		return fmt.Errorf("%w: unknown wal recovery mode %d", ErrInvalidOptions, o.WALRecoveryMode)
+	}
+
+	return nil
+}
+
+func (c Compression) engineType() engine.CompressionType {
+	switch c {
+	case NoCompression:
+		return engine.NoCompression
+	case DeflateCompression:
+		return engine.DeflateCompression
+	default:
+		return engine.LZCompression
+	}
+}
+
+func (m WALRecoveryMode) engineType() engine.WALRecoveryMode {
+	switch m {
+	case StrictWALRecovery:
+		return engine.WALRecoveryStrict
+	case SkipWALRecovery:
+		return engine.WALRecoverySkip
+	default:
+		return engine.WALRecoveryTruncate
+	}
+}
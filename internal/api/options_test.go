@@ -0,0 +1,73 @@
+package api_test
+
+import (
+	"godb/internal/api"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions_Validation(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *api.Options
+		err  error
+	}{
+		{name: "nil", opts: nil},
+		{name: "zero values take defaults", opts: &api.Options{}},
+		{name: "defaults", opts: api.DefaultOptions()},
+		{name: "negative memtable size", opts: &api.Options{MemTableByteSize: -1}, err: api.ErrInvalidOptions},
+		{name: "write buffer of a single memtable", opts: &api.Options{MemTableByteSize: 1 << 20, WriteBufferByteSize: 1 << 20}},
+		{name: "write buffer smaller than memtable", opts: &api.Options{MemTableByteSize: 1 << 20, WriteBufferByteSize: 1 << 10}, err: api.ErrInvalidOptions},
+		{name: "skiplist level too high", opts: &api.Options{SkipListMaxLevel: 33}, err: api.ErrInvalidOptions},
+		{name: "skiplist probability of 100", opts: &api.Options{SkipListProbability: 100}, err: api.ErrInvalidOptions},
+		{name: "negative block size", opts: &api.Options{BlockByteSize: -1}, err: api.ErrInvalidOptions},
+		{name: "negative restart interval", opts: &api.Options{RestartInterval: -1}, err: api.ErrInvalidOptions},
+		{name: "too many bloom bits", opts: &api.Options{BloomBitsPerKey: 65}, err: api.ErrInvalidOptions},
+		{name: "negative flusher workers", opts: &api.Options{FlusherWorkers: -1}, err: api.ErrInvalidOptions},
+		{name: "negative l0 compaction trigger", opts: &api.Options{L0CompactionTrigger: -1}, err: api.ErrInvalidOptions},
+		{name: "negative base level size", opts: &api.Options{BaseLevelByteSize: -1}, err: api.ErrInvalidOptions},
+		{name: "level multiplier of 1", opts: &api.Options{LevelMultiplier: 1}, err: api.ErrInvalidOptions},
+		{name: "negative target file size", opts: &api.Options{TargetFileByteSize: -1}, err: api.ErrInvalidOptions},
+		{name: "unknown sync mode", opts: &api.Options{SyncMode: 7}, err: api.ErrInvalidOptions},
+		{name: "unknown wal recovery mode", opts: &api.Options{WALRecoveryMode: 7}, err: api.ErrInvalidOptions},
+		{name: "negative sync period", opts: &api.Options{SyncMode: api.SyncPeriodic, SyncPeriod: -time.Millisecond}, err: api.ErrInvalidOptions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := api.NewDatabase(t.TempDir(), tt.opts)
+			if tt.err == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOptions_CreateIfMissingAndErrorIfExists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "db")
+
+	createIfMissing := false
+	_, err := api.Open(dir, &api.Options{CreateIfMissing: &createIfMissing})
+	require.ErrorIs(t, err, api.ErrDatabaseNotFound)
+
+	// A partly filled Options creates the database, as DefaultOptions does
+	db, err := api.Open(dir, &api.Options{MemTableByteSize: 1 << 20, SyncMode: api.SyncNone})
+	require.NoError(t, err)
+	require.NoError(t, db.Put("key", []byte("value")))
+	require.NoError(t, db.Stop())
+
+	_, err = api.Open(dir, &api.Options{ErrorIfExists: true})
+	require.ErrorIs(t, err, api.ErrDatabaseExists)
+
+	db, err = api.Open(dir, &api.Options{CreateIfMissing: &createIfMissing})
+	require.NoError(t, err)
+	v, ok := db.Get("key")
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), v)
+	require.NoError(t, db.Stop())
+}
@@ -0,0 +1,40 @@
+package api
+
+import "godb/internal/engine"
+
+// Snapshot is a consistent read view of the database. Writes made after it
+// was taken are invisible through it, and compaction keeps every version it
+// can see until it is released.
+type Snapshot struct {
+	db       *Database
+	snapshot *engine.Snapshot
+}
+
+// Get returns the value of key as of the snapshot, a key that can not be read
+// reading as missing.
+//
+// Deprecated: Get can not tell data lost to corruption from a missing key,
+// use GetWithError.
+func (s *Snapshot) Get(key string) ([]byte, bool) {
+	v, ok, _ := s.GetWithError(key)
+	return v, ok
+}
+
+// GetWithError returns the value of key as of the snapshot, or the error
+// reading it.
+func (s *Snapshot) GetWithError(key string) ([]byte, bool, error) {
+	return s.db.get(key, s.snapshot.Seq())
+}
+
+// NewIterator returns an iterator reading as of the snapshot. It must be
+// closed after use, the snapshot may be released before.
+func (s *Snapshot) NewIterator(opts *IteratorOptions) (*Iterator, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.db.newIterator(opts, s.snapshot.Seq())
+}
+
+func (s *Snapshot) Release() {
+	s.db.snapshots.Release(s.snapshot)
+}
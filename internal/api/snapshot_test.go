@@ -0,0 +1,77 @@
+package api_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDatabase_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	db := newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	const keys = 500
+	for i := range keys {
+		require.NoError(t, db.Put(fmt.Sprintf("key:%04d", i), []byte("v1")))
+	}
+
+	snapshot := db.NewSnapshot()
+
+	// Enough writes to rotate and flush the memtable several times, so that
+	// both versions of most keys end up in SSTables
+	for i := range keys {
+		key := fmt.Sprintf("key:%04d", i)
+		if i%5 == 0 {
+			require.NoError(t, db.Delete(key))
+		} else {
+			require.NoError(t, db.Put(key, []byte("v2")))
+		}
+	}
+	require.NoError(t, db.Put("key:new", []byte("v2")))
+
+	for i := range keys {
+		key := fmt.Sprintf("key:%04d", i)
+
+		v, ok := snapshot.Get(key)
+		require.True(t, ok, key)
+		require.Equal(t, []byte("v1"), v, key)
+
+		v, ok = db.Get(key)
+		require.Equal(t, i%5 != 0, ok, key)
+		if ok {
+			require.Equal(t, []byte("v2"), v, key)
+		}
+	}
+
+	_, ok := snapshot.Get("key:new")
+	require.False(t, ok)
+
+	it, err := snapshot.NewIterator(nil)
+	require.NoError(t, err)
+	count := 0
+	for it.First(); it.Valid(); it.Next() {
+		require.Equal(t, []byte("v1"), it.Value(), it.Key())
+		count++
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+	require.Equal(t, keys, count)
+
+	snapshot.Release()
+	require.NoError(t, db.Stop())
+
+	// Sequence numbers keep growing across restarts, newer writes must not
+	// be shadowed by flushed older ones
+	db = newTestDatabase(t, dir)
+	require.NoError(t, db.Start())
+
+	require.NoError(t, db.Put("key:0001", []byte("v3")))
+	v, ok := db.Get("key:0001")
+	require.True(t, ok)
+	require.Equal(t, []byte("v3"), v)
+
+	require.NoError(t, db.Stop())
+}
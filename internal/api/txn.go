@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"godb/internal/engine"
+	"godb/internal/tooling/guard"
+)
+
+var (
+	ErrConflict = errors.New("transaction conflict")
+	ErrTxnDone  = errors.New("transaction already committed or rolled back")
+)
+
+// Txn is an optimistic transaction. It reads from a snapshot taken by Begin
+// and buffers its writes, which other readers only see once Commit succeeds.
+// Commit fails with ErrConflict when a key the transaction read was written
+// by someone else after Begin.
+type Txn struct {
+	db       *Database
+	snapshot *engine.Snapshot
+
+	batch  *WriteBatch
+	writes map[string]txnWrite
+	reads  map[string]struct{}
+
+	done bool
+}
+
+type txnWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// Begin starts a transaction. It must end with Commit or Rollback.
+func (d *Database) Begin() *Txn {
+	return &Txn{
+		db:       d,
+		snapshot: d.snapshots.New(),
+		batch:    NewWriteBatch(),
+		writes:   make(map[string]txnWrite),
+		reads:    make(map[string]struct{}),
+	}
+}
+
+// Get returns the value of key as of Begin, or as last written by the
+// transaction itself.
+func (t *Txn) Get(key string) ([]byte, bool, error) {
+	if t.done {
+		return nil, false, ErrTxnDone
+	}
+
+	if w, ok := t.writes[key]; ok {
+		if w.deleted {
+			return nil, false, nil
+		}
+		return w.value, true, nil
+	}
+
+	t.reads[key] = struct{}{}
+	return t.db.get(key, t.snapshot.Seq())
+}
+
+func (t *Txn) Put(key string, value []byte) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.batch.Put(key, value)
+	t.writes[key] = txnWrite{value: append([]byte{}, value...)}
+	return nil
+}
+
+func (t *Txn) Delete(key string) error {
+	if t.done {
+		return ErrTxnDone
+	}
+
+	t.batch.Delete(key)
+	t.writes[key] = txnWrite{deleted: true}
+	return nil
+}
+
+// NewIterator returns an iterator over the database as of Begin with the
+// writes of the transaction on top. Every key it lands on joins the read set.
+// It must be closed after use and not used once the transaction ends.
+func (t *Txn) NewIterator(opts *IteratorOptions) (*Iterator, error) {
+	if t.done {
+		return nil, ErrTxnDone
+	}
+
+	// The buffered writes as a memtable newer than any other source, at the
+	// sequence number of the snapshot so that the iterator sees them
+	writes, err := engine.NewMemTable(t.db.maxLevel, t.db.skipListProbability)
+	guard.Assert(err == nil, "The database validated the skiplist parameters")
+	for key, w := range t.writes {
+		if w.deleted {
+			err = writes.Delete(t.snapshot.Seq(), key)
+		} else {
+			err = writes.Insert(t.snapshot.Seq(), key, w.value)
+		}
+		guard.Assert(err == nil, "The memtable is never frozen")
+	}
+
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	sources, err := t.db.iteratorSources(iteratorBounds(opts))
+	if err != nil {
+		return nil, fmt.Errorf("iterator sources: %w", err)
+	}
+
+	children := append([]engine.Iterator{writes.NewIterator()}, sources...)
+	it := newIterator(engine.NewMergingIterator(children...), opts, t.snapshot.Seq())
+	it.observe = func(key string) {
+		if _, ok := t.writes[key]; !ok {
+			t.reads[key] = struct{}{}
+		}
+	}
+
+	return it, nil
+}
+
+// Commit validates the read set and applies the writes atomically, as one
+// WAL record.
+func (t *Txn) Commit() error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	defer t.db.snapshots.Release(t.snapshot)
+
+	// The check runs at the head of the write queue, nothing can be written
+	// between the validation and the writes of the transaction
+	w := t.db.newWriter(t.batch, nil, true)
+	w.check = t.validate
+	return t.db.write(w)
+}
+
+// validate fails with ErrConflict when a key read was written after the
+// snapshot. Must be called with t.db.mu held.
+func (t *Txn) validate() error {
+	for key := range t.reads {
+		seq, ok, err := t.db.latestSeq(key)
+		if err != nil {
+			return fmt.Errorf("latest seq: %w", err)
+		}
+
+		if ok && seq > t.snapshot.Seq() {
+			return ErrConflict
+		}
+	}
+
+	return nil
+}
+
+// Rollback discards the transaction. It is a no-op once the transaction
+// ended.
+func (t *Txn) Rollback() {
+	if t.done {
+		return
+	}
+	t.done = true
+
+	t.db.snapshots.Release(t.snapshot)
+}
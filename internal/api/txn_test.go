@@ -0,0 +1,137 @@
+package api_test
+
+import (
+	"errors"
+	"godb/internal/api"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxn_ConflictingReadModifyWrite(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	require.NoError(t, db.Put("counter", []byte("0")))
+
+	first := db.Begin()
+	second := db.Begin()
+
+	for _, txn := range []*api.Txn{first, second} {
+		v, ok, err := txn.Get("counter")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("0"), v)
+		require.NoError(t, txn.Put("counter", []byte("1")))
+	}
+
+	// Own writes are visible to the transaction only
+	v, _, err := first.Get("counter")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+	v, _ = db.Get("counter")
+	require.Equal(t, []byte("0"), v)
+
+	require.NoError(t, first.Commit())
+	require.ErrorIs(t, second.Commit(), api.ErrConflict)
+	require.ErrorIs(t, second.Commit(), api.ErrTxnDone)
+
+	v, _ = db.Get("counter")
+	require.Equal(t, []byte("1"), v)
+
+	// Blind writes never conflict
+	blind := db.Begin()
+	require.NoError(t, blind.Put("counter", []byte("blind")))
+	require.NoError(t, db.Put("counter", []byte("2")))
+	require.NoError(t, blind.Commit())
+
+	v, _ = db.Get("counter")
+	require.Equal(t, []byte("blind"), v)
+}
+
+func TestTxn_Iterator(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Put(key, []byte("db")))
+	}
+
+	txn := db.Begin()
+	require.NoError(t, txn.Delete("b"))
+	require.NoError(t, txn.Put("d", []byte("txn")))
+
+	// Written after Begin, invisible to the transaction
+	require.NoError(t, db.Put("e", []byte("db")))
+
+	it, err := txn.NewIterator(nil)
+	require.NoError(t, err)
+
+	got := make(map[string]string)
+	keys := make([]string, 0)
+	for it.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+		got[it.Key()] = string(it.Value())
+	}
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+
+	require.Equal(t, []string{"a", "c", "d"}, keys)
+	require.Equal(t, "txn", got["d"])
+
+	// c was read through the iterator
+	require.NoError(t, db.Put("c", []byte("changed")))
+	require.ErrorIs(t, txn.Commit(), api.ErrConflict)
+
+	_, ok := db.Get("d")
+	require.False(t, ok)
+}
+
+func TestTxn_ConcurrentIncrements(t *testing.T) {
+	db := newTestDatabase(t, t.TempDir())
+	require.NoError(t, db.Start())
+	defer db.Stop()
+
+	require.NoError(t, db.Put("counter", []byte("0")))
+
+	const (
+		workers    = 8
+		increments = 25
+	)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range increments {
+				for {
+					txn := db.Begin()
+					v, _, err := txn.Get("counter")
+					require.NoError(t, err)
+
+					n, err := strconv.Atoi(string(v))
+					require.NoError(t, err)
+					require.NoError(t, txn.Put("counter", []byte(strconv.Itoa(n+1))))
+
+					err = txn.Commit()
+					if errors.Is(err, api.ErrConflict) {
+						continue
+					}
+					require.NoError(t, err)
+					break
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, ok := db.Get("counter")
+	require.True(t, ok)
+	require.Equal(t, strconv.Itoa(workers*increments), string(v))
+}
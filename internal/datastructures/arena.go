@@ -0,0 +1,89 @@
+package datastructures
+
+import "unsafe"
+
+// Arena hands out byte slices carved from large chunks. Nothing is freed on
+// its own: a chunk goes away with the last slice into it, so everything
+// allocated together is freed together. It is not safe for concurrent use.
+type Arena struct {
+	chunkSize int
+	chunk     []byte
+	byteSize  int
+}
+
+func NewArena(chunkSize int) *Arena {
+	return &Arena{chunkSize: max(chunkSize, 1)}
+}
+
+// Alloc returns n zeroed bytes. Allocations larger than a quarter of a chunk
+// get their own, so that they do not waste the rest of the current one.
+func (a *Arena) Alloc(n int) []byte {
+	if n > a.chunkSize/4 {
+		a.byteSize += n
+		return make([]byte, n)
+	}
+
+	if n > len(a.chunk) {
+		a.chunk = make([]byte, a.chunkSize)
+		a.byteSize += a.chunkSize
+	}
+
+	b := a.chunk[:n:n]
+	a.chunk = a.chunk[n:]
+	return b
+}
+
+// Copy returns a copy of b allocated in the arena.
+func (a *Arena) Copy(b []byte) []byte {
+	c := a.Alloc(len(b))
+	copy(c, b)
+	return c
+}
+
+// CopyString returns a copy of s allocated in the arena.
+func (a *Arena) CopyString(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+
+	c := a.Alloc(len(s))
+	copy(c, s)
+	// The arena never hands the bytes out again, they stay immutable
+	return unsafe.String(&c[0], len(c))
+}
+
+// ByteSize returns the memory the arena allocated, chunks counted whole.
+func (a *Arena) ByteSize() int {
+	return a.byteSize
+}
+
+// slab hands out values of T carved from chunks of n, the way Arena does for
+// bytes. The GC sees one object per chunk rather than one per value.
+type slab[T any] struct {
+	n     int
+	chunk []T
+}
+
+func (s *slab[T]) alloc() *T {
+	if len(s.chunk) == 0 {
+		s.chunk = make([]T, s.n)
+	}
+
+	v := &s.chunk[0]
+	s.chunk = s.chunk[1:]
+	return v
+}
+
+func (s *slab[T]) allocN(n int) []T {
+	if n > s.n/4 {
+		return make([]T, n)
+	}
+
+	if n > len(s.chunk) {
+		s.chunk = make([]T, s.n)
+	}
+
+	v := s.chunk[:n:n]
+	s.chunk = s.chunk[n:]
+	return v
+}
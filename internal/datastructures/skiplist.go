@@ -1,82 +1,240 @@
 package datastructures
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"math/rand"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 )
 
-type node[T any] struct {
-	Key   string
-	Value T
-	Next  []*node[T]
+type node[K, V any] struct {
+	Key   K
+	value atomic.Pointer[V]
+	next  []atomic.Pointer[node[K, V]]
+	// prev links the bottom level backwards, for reverse iteration
+	prev atomic.Pointer[node[K, V]]
 }
 
-func newNode[T any](key string, value T, maxLevel int) *node[T] {
-	nexts := make([]*node[T], maxLevel)
-	return &node[T]{Key: key, Value: value, Next: nexts}
+// newNode returns a node with levels next pointers, taken from the slabs
+// when the list has them. Must be called with s.mu held.
+func (s *SkipList[K, V]) newNode(key K, value V, levels int) *node[K, V] {
+	var n *node[K, V]
+	if s.nodes == nil {
+		n = &node[K, V]{Key: key, next: make([]atomic.Pointer[node[K, V]], levels)}
+	} else {
+		n = s.nodes.alloc()
+		n.Key = key
+		n.next = s.towers.allocN(levels)
+	}
+
+	n.value.Store(s.newValue(value))
+	return n
 }
 
-type SkipList[T any] struct {
+// newValue returns a copy of value, taken from the slabs when the list has
+// them. Must be called with s.mu held.
+func (s *SkipList[K, V]) newValue(value V) *V {
+	var v *V
+	if s.values == nil {
+		v = new(V)
+	} else {
+		v = s.values.alloc()
+	}
+
+	*v = value
+	return v
+}
+
+func (n *node[K, V]) Next(level int) *node[K, V] {
+	return n.next[level].Load()
+}
+
+func (n *node[K, V]) Value() V {
+	return *n.value.Load()
+}
+
+// SkipList is an ordered map. Keys are unique, inserting a key already
+// present replaces its value.
+//
+// Writers are serialized, readers never block: every pointer is read and
+// written atomically and a node is fully built before it is linked, bottom
+// level first, so a reader sees each node either entirely or not at all.
+// Iterators see the writes made while they move or miss them, but always
+// walk keys in order.
+type SkipList[K, V any] struct {
 	maxLevel    int
 	probability int
+	compare     func(a, b K) int
+
+	// mu serializes writers
+	mu sync.Mutex
+	// update holds the predecessors of the node being written, guarded by mu
+	update []*node[K, V]
+
+	header *node[K, V]
+	level  atomic.Int32
+	// contentsSize is the number of nodes, byteSize their approximate
+	// memory: the node itself, its next pointers and its value
+	contentsSize atomic.Int64
+	byteSize     atomic.Int64
+
+	// nodes, towers and values, when set, allocate nodes, their next
+	// pointers and their values in chunks, guarded by mu
+	nodes  *slab[node[K, V]]
+	towers *slab[atomic.Pointer[node[K, V]]]
+	values *slab[V]
+}
 
-	header       *node[T]
-	level        int
-	contentsSize int
-
-	debug [][]string
+// NewSkipList returns a skiplist ordering keys by their natural order.
+func NewSkipList[K cmp.Ordered, V any](maxLevel, probability int) (*SkipList[K, V], error) {
+	return NewSkipListFunc[K, V](maxLevel, probability, cmp.Compare[K])
 }
 
-func NewSkipList[T any](maxLevel, probability int) (*SkipList[T], error) {
+// NewSkipListFunc returns a skiplist ordering keys by compare, which returns
+// a negative number when a < b, a positive one when a > b and zero when they
+// are the same key.
+func NewSkipListFunc[K, V any](maxLevel, probability int, compare func(a, b K) int) (*SkipList[K, V], error) {
 	if probability > 100 || probability < 0 {
 		return nil, errors.ErrUnsupported
 	}
 	if maxLevel <= 0 {
 		return nil, errors.ErrUnsupported
 	}
+	if compare == nil {
+		return nil, errors.ErrUnsupported
+	}
 
-	nexts := make([]*node[T], maxLevel)
-
-	return &SkipList[T]{
-		header:       &node[T]{Next: nexts},
-		probability:  probability,
-		maxLevel:     maxLevel,
-		contentsSize: 0,
+	return &SkipList[K, V]{
+		header:      &node[K, V]{next: make([]atomic.Pointer[node[K, V]], maxLevel)},
+		update:      make([]*node[K, V], maxLevel),
+		probability: probability,
+		maxLevel:    maxLevel,
+		compare:     compare,
 	}, nil
 }
 
-func (s *SkipList[T]) Insert(key string, value T) {
-	toUpdate := make([]*node[T], s.maxLevel)
+// NewSkipListWithSlabs returns a skiplist ordering keys by compare that
+// allocates its nodes nodesPerSlab at a time. The GC then sees a few large
+// objects instead of one per node, but no node is freed before the whole
+// slab it lives in is unreachable, which suits a list dropped all at once.
+// Replaced values are not freed either.
+func NewSkipListWithSlabs[K, V any](maxLevel, probability int, compare func(a, b K) int, nodesPerSlab int) (*SkipList[K, V], error) {
+	s, err := NewSkipListFunc[K, V](maxLevel, probability, compare)
+	if err != nil {
+		return nil, err
+	}
+	if nodesPerSlab <= 0 {
+		return nil, errors.ErrUnsupported
+	}
 
-	x := s.header
-	for i := s.level; i >= 0; i-- {
-		for x.Next[i] != nil && x.Next[i].Key < key {
-			x = x.Next[i]
-		}
+	s.nodes = &slab[node[K, V]]{n: nodesPerSlab}
+	s.towers = &slab[atomic.Pointer[node[K, V]]]{n: nodesPerSlab * 2}
+	s.values = &slab[V]{n: nodesPerSlab}
 
-		toUpdate[i] = x
+	return s, nil
+}
+
+// Insert sets the value of key and reports whether it replaced one.
+func (s *SkipList[K, V]) Insert(key K, value V) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	toUpdate := s.findPredecessors(key)
+
+	if n := toUpdate[0].Next(0); n != nil && s.compare(n.Key, key) == 0 {
+		n.value.Store(s.newValue(value))
+		return true
 	}
 
+	level := int(s.level.Load())
 	insertionLevel := randomLevel(s.maxLevel, s.probability)
-	if insertionLevel > s.level {
-		for i := s.level + 1; i <= insertionLevel; i++ {
-			toUpdate[i] = s.header
-		}
-		s.level = insertionLevel
+	for i := level + 1; i <= insertionLevel; i++ {
+		toUpdate[i] = s.header
 	}
 
-	n := newNode(key, value, insertionLevel+1)
+	// The node is complete before it becomes reachable
+	n := s.newNode(key, value, insertionLevel+1)
 	for i := 0; i <= insertionLevel; i++ {
-		n.Next[i] = toUpdate[i].Next[i]
-		toUpdate[i].Next[i] = n
+		n.next[i].Store(toUpdate[i].Next(i))
+	}
+	if toUpdate[0] != s.header {
+		n.prev.Store(toUpdate[0])
+	}
+
+	for i := 0; i <= insertionLevel; i++ {
+		toUpdate[i].next[i].Store(n)
+	}
+	if next := n.Next(0); next != nil {
+		next.prev.Store(n)
+	}
+
+	if insertionLevel > level {
+		s.level.Store(int32(insertionLevel))
 	}
 
-	// Add to the contentsSize
-	// TODO: define a way to get bytes.
-	// Temporarily just increment content size
-	s.contentsSize += 1
-	s.debug = s.Debug()
+	s.contentsSize.Add(1)
+	s.byteSize.Add(int64(nodeByteSize[K, V](insertionLevel + 1)))
+	return false
+}
+
+// Delete removes key and reports whether it was present. Readers already on
+// the node carry on from it.
+func (s *SkipList[K, V]) Delete(key K) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	toUpdate := s.findPredecessors(key)
+
+	n := toUpdate[0].Next(0)
+	if n == nil || s.compare(n.Key, key) != 0 {
+		return false
+	}
+
+	for i := len(n.next) - 1; i >= 0; i-- {
+		toUpdate[i].next[i].Store(n.Next(i))
+	}
+	if next := n.Next(0); next != nil {
+		next.prev.Store(n.prev.Load())
+	}
+
+	level := s.level.Load()
+	for level > 0 && s.header.Next(int(level)) == nil {
+		level--
+	}
+	s.level.Store(level)
+
+	s.contentsSize.Add(-1)
+	s.byteSize.Add(-int64(nodeByteSize[K, V](len(n.next))))
+	return true
+}
+
+// findPredecessors returns, for every level, the last node with a key
+// strictly smaller than key, the header when there is none. Must be called
+// with s.mu held, the result is reused by the next call.
+func (s *SkipList[K, V]) findPredecessors(key K) []*node[K, V] {
+	toUpdate := s.update
+
+	x := s.header
+	for i := int(s.level.Load()); i >= 0; i-- {
+		for next := x.Next(i); next != nil && s.compare(next.Key, key) < 0; next = x.Next(i) {
+			x = next
+		}
+
+		toUpdate[i] = x
+	}
+
+	return toUpdate
+}
+
+// nodeByteSize is the approximate memory of a node with levels next pointers.
+// Memory the key and the value point to is left to the caller.
+func nodeByteSize[K, V any](levels int) int {
+	return int(unsafe.Sizeof(node[K, V]{})) +
+		levels*int(unsafe.Sizeof(atomic.Pointer[node[K, V]]{})) +
+		int(unsafe.Sizeof(*new(V)))
 }
 
 func randomLevel(maxLevel int, probability int) int {
@@ -93,60 +251,154 @@ func randomLevel(maxLevel int, probability int) int {
 	return lvl
 }
 
-func (s *SkipList[T]) Debug() [][]string {
-	levels := make([][]string, s.level+1)
+func (s *SkipList[K, V]) Debug() [][]string {
+	level := int(s.level.Load())
+	levels := make([][]string, level+1)
 
-	for i := 0; i <= s.level; i++ {
-		level := []string{}
-		x := s.header
-
-		for x.Next[i] != nil {
-			n := x.Next[i]
-			level = append(
-				level,
-				fmt.Sprintf("%s:%v", n.Key, n.Value),
-			)
-			x = n
+	for i := 0; i <= level; i++ {
+		keys := []string{}
+		for n := s.header.Next(i); n != nil; n = n.Next(i) {
+			keys = append(keys, fmt.Sprintf("%v:%v", n.Key, n.Value()))
 		}
 
-		levels[i] = level
+		levels[i] = keys
 	}
 
 	return levels
 }
 
-func (s *SkipList[T]) Search(key string) (T, bool) {
+func (s *SkipList[K, V]) Search(key K) (V, bool) {
+	n := s.findLess(key).Next(0)
+	if n != nil && s.compare(n.Key, key) == 0 {
+		return n.Value(), true
+	}
+
+	return *new(V), false
+}
+
+// findLess returns the last node with a key strictly smaller than key,
+// or the header when there is none.
+func (s *SkipList[K, V]) findLess(key K) *node[K, V] {
 	x := s.header
-	for i := s.level; i >= 0; i-- {
-		for x.Next[i] != nil && x.Next[i].Key < key {
-			x = x.Next[i]
+	for i := int(s.level.Load()); i >= 0; i-- {
+		for next := x.Next(i); next != nil && s.compare(next.Key, key) < 0; next = x.Next(i) {
+			x = next
 		}
 	}
 
-	if x.Next[0] != nil && x.Next[0].Key == key {
-		return x.Next[0].Value, true
+	return x
+}
+
+// last returns the node with the largest key, nil when the list is empty.
+func (s *SkipList[K, V]) last() *node[K, V] {
+	x := s.header
+	for i := int(s.level.Load()); i >= 0; i-- {
+		for next := x.Next(i); next != nil; next = x.Next(i) {
+			x = next
+		}
 	}
 
-	return *new(T), false
+	if x == s.header {
+		return nil
+	}
+
+	return x
 }
 
-func (s *SkipList[T]) ContentSize() int {
-	return s.contentsSize
+// First returns the smallest key and its value.
+func (s *SkipList[K, V]) First() (K, V, bool) {
+	n := s.header.Next(0)
+	if n == nil {
+		return *new(K), *new(V), false
+	}
+
+	return n.Key, n.Value(), true
 }
 
-func (s *SkipList[T]) Iter(yield func(k string, v T) bool) {
-	x := s.header
+// Last returns the largest key and its value.
+func (s *SkipList[K, V]) Last() (K, V, bool) {
+	n := s.last()
+	if n == nil {
+		return *new(K), *new(V), false
+	}
+
+	return n.Key, n.Value(), true
+}
+
+// Len returns the number of keys.
+func (s *SkipList[K, V]) Len() int {
+	return int(s.contentsSize.Load())
+}
+
+// ByteSize returns the approximate memory of the nodes, see nodeByteSize.
+func (s *SkipList[K, V]) ByteSize() int {
+	return int(s.byteSize.Load())
+}
 
-	for {
-		nxt := x.Next[0]
-		if nxt == nil {
+// Iter yields every key and its value in order.
+func (s *SkipList[K, V]) Iter(yield func(k K, v V) bool) {
+	for x := s.header.Next(0); x != nil; x = x.Next(0) {
+		if !yield(x.Key, x.Value()) {
 			return
 		}
+	}
+}
 
-		if !yield(nxt.Key, nxt.Value) {
+// Backward yields every key and its value in reverse order.
+func (s *SkipList[K, V]) Backward(yield func(k K, v V) bool) {
+	for x := s.last(); x != nil; x = x.prev.Load() {
+		if !yield(x.Key, x.Value()) {
 			return
 		}
-
-		x = nxt
 	}
 }
+
+type SkipListIterator[K, V any] struct {
+	list *SkipList[K, V]
+	node *node[K, V]
+}
+
+// NewIterator returns an unpositioned iterator.
+func (s *SkipList[K, V]) NewIterator() *SkipListIterator[K, V] {
+	return &SkipListIterator[K, V]{list: s}
+}
+
+// Seek returns an iterator positioned at the first key >= key.
+func (s *SkipList[K, V]) Seek(key K) *SkipListIterator[K, V] {
+	it := s.NewIterator()
+	it.Seek(key)
+	return it
+}
+
+func (it *SkipListIterator[K, V]) Valid() bool {
+	return it.node != nil
+}
+
+func (it *SkipListIterator[K, V]) Key() K {
+	return it.node.Key
+}
+
+func (it *SkipListIterator[K, V]) Value() V {
+	return it.node.Value()
+}
+
+func (it *SkipListIterator[K, V]) SeekToFirst() {
+	it.node = it.list.header.Next(0)
+}
+
+func (it *SkipListIterator[K, V]) SeekToLast() {
+	it.node = it.list.last()
+}
+
+// Seek positions the iterator at the first node with a key >= key.
+func (it *SkipListIterator[K, V]) Seek(key K) {
+	it.node = it.list.findLess(key).Next(0)
+}
+
+func (it *SkipListIterator[K, V]) Next() {
+	it.node = it.node.Next(0)
+}
+
+func (it *SkipListIterator[K, V]) Prev() {
+	it.node = it.node.prev.Load()
+}
@@ -1,15 +1,23 @@
 package datastructures_test
 
 import (
+	"cmp"
+	"fmt"
 	"godb/internal/datastructures"
-	"godb/internal/tooling/guard"
+	"maps"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func Test(t *testing.T) {
 	t.Run("should run", func(t *testing.T) {
-		skiplist, err := datastructures.NewSkipList[string](4, 50)
-		guard.Assert(err == nil, "no error")
+		skiplist, err := datastructures.NewSkipList[string, string](4, 50)
+		require.NoError(t, err)
 
 		skiplist.Insert("1", "ena")
 		skiplist.Insert("2", "dyo")
@@ -23,17 +31,243 @@ func Test(t *testing.T) {
 		skiplist.Insert("20", "ikosi")
 		skiplist.Insert("5", "tombstone")
 		v, ok := skiplist.Search("5")
-		print(v)
-		print(ok)
-		v, ok = skiplist.Search("5")
-		print(v)
-		print(ok)
+		require.True(t, ok)
+		require.Equal(t, "tombstone", v)
 
 		m := make([]string, 0)
 		for k, v := range skiplist.Iter {
 			m = append(m, k+":"+v)
 		}
 
-		print(m)
+		require.Equal(t, []string{
+			"1:ena", "10:deka", "100:ekato", "13:dekatria", "2:dyo", "20:ikosi", "3:tria", "5:tombstone",
+		}, m)
 	})
 }
+
+type skipListOp struct {
+	delete bool
+	key    string
+	value  int
+}
+
+func randomOps(seed int64, n, keys int) []skipListOp {
+	r := rand.New(rand.NewSource(seed))
+	ops := make([]skipListOp, 0, n)
+	for i := range n {
+		ops = append(ops, skipListOp{
+			delete: r.Intn(4) == 0,
+			key:    fmt.Sprintf("key:%03d", r.Intn(keys)),
+			value:  i,
+		})
+	}
+
+	return ops
+}
+
+func TestSkipList_MatchesReferenceMap(t *testing.T) {
+	ascending := make([]skipListOp, 0)
+	descending := make([]skipListOp, 0)
+	for i := range 100 {
+		ascending = append(ascending, skipListOp{key: fmt.Sprintf("key:%03d", i), value: i})
+		descending = append(descending, skipListOp{key: fmt.Sprintf("key:%03d", 99-i), value: i})
+	}
+
+	tests := []struct {
+		name string
+		ops  []skipListOp
+	}{
+		{name: "empty"},
+		{name: "single key", ops: []skipListOp{{key: "a", value: 1}}},
+		{name: "ascending inserts", ops: ascending},
+		{name: "descending inserts", ops: descending},
+		{name: "overwrites", ops: []skipListOp{{key: "a", value: 1}, {key: "b", value: 2}, {key: "a", value: 3}, {key: "a", value: 4}}},
+		{name: "delete missing key", ops: []skipListOp{{key: "a", value: 1}, {delete: true, key: "b"}}},
+		{name: "delete everything", ops: []skipListOp{{key: "a", value: 1}, {key: "b", value: 2}, {delete: true, key: "b"}, {delete: true, key: "a"}}},
+		{name: "delete then insert again", ops: []skipListOp{{key: "a", value: 1}, {delete: true, key: "a"}, {key: "a", value: 2}}},
+		{name: "random few keys", ops: randomOps(1, 1000, 20)},
+		{name: "random many keys", ops: randomOps(2, 5000, 1000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := datastructures.NewSkipList[string, int](12, 25)
+			require.NoError(t, err)
+
+			reference := make(map[string]int)
+			for _, op := range tt.ops {
+				_, present := reference[op.key]
+				if op.delete {
+					require.Equal(t, present, s.Delete(op.key))
+					delete(reference, op.key)
+				} else {
+					require.Equal(t, present, s.Insert(op.key, op.value))
+					reference[op.key] = op.value
+				}
+			}
+
+			keys := slices.Sorted(maps.Keys(reference))
+			require.Equal(t, len(keys), s.Len())
+
+			for k, v := range reference {
+				got, ok := s.Search(k)
+				require.True(t, ok, k)
+				require.Equal(t, v, got, k)
+			}
+			_, ok := s.Search("missing")
+			require.False(t, ok)
+
+			var forward []string
+			for k, v := range s.Iter {
+				require.Equal(t, reference[k], v)
+				forward = append(forward, k)
+			}
+			require.Equal(t, keys, forward)
+
+			var backward []string
+			for k := range s.Backward {
+				backward = append(backward, k)
+			}
+			slices.Reverse(backward)
+			require.Equal(t, keys, backward)
+
+			first, _, ok := s.First()
+			last, _, lastOk := s.Last()
+			require.Equal(t, len(keys) > 0, ok)
+			require.Equal(t, len(keys) > 0, lastOk)
+			if len(keys) > 0 {
+				require.Equal(t, keys[0], first)
+				require.Equal(t, keys[len(keys)-1], last)
+			}
+
+			// Seeking a key or just past it lands on the first key >= it
+			for _, target := range append(slices.Clone(keys), "", "key:", "key:0505", "zzz") {
+				for _, seek := range []string{target, target + "\x00"} {
+					it := s.Seek(seek)
+					i, _ := slices.BinarySearch(keys, seek)
+					if i == len(keys) {
+						require.False(t, it.Valid(), seek)
+						continue
+					}
+
+					require.True(t, it.Valid(), seek)
+					require.Equal(t, keys[i], it.Key(), seek)
+
+					it.Prev()
+					if i == 0 {
+						require.False(t, it.Valid(), seek)
+					} else {
+						require.Equal(t, keys[i-1], it.Key(), seek)
+					}
+				}
+			}
+
+			it := s.NewIterator()
+			var reverse []string
+			for it.SeekToLast(); it.Valid(); it.Prev() {
+				reverse = append(reverse, it.Key())
+			}
+			slices.Reverse(reverse)
+			require.Equal(t, keys, reverse)
+		})
+	}
+}
+
+func TestSkipList_Comparator(t *testing.T) {
+	descending := func(a, b int) int { return cmp.Compare(b, a) }
+	s, err := datastructures.NewSkipListFunc[int, string](8, 25, descending)
+	require.NoError(t, err)
+
+	for _, k := range []int{3, 1, 4, 1, 5, 9, 2, 6} {
+		s.Insert(k, fmt.Sprint(k))
+	}
+
+	keys := make([]int, 0)
+	for k := range s.Iter {
+		keys = append(keys, k)
+	}
+	require.Equal(t, []int{9, 6, 5, 4, 3, 2, 1}, keys)
+
+	it := s.Seek(7)
+	require.True(t, it.Valid())
+	require.Equal(t, 6, it.Key())
+
+	_, err = datastructures.NewSkipListFunc[int, string](8, 25, nil)
+	require.Error(t, err)
+}
+
+func TestSkipList_ByteSize(t *testing.T) {
+	s, err := datastructures.NewSkipList[string, int](12, 25)
+	require.NoError(t, err)
+	require.Equal(t, 0, s.ByteSize())
+
+	s.Insert("a", 1)
+	size := s.ByteSize()
+	require.Greater(t, size, 0)
+
+	// Overwrites reuse the node
+	s.Insert("a", 2)
+	require.Equal(t, size, s.ByteSize())
+
+	s.Insert("b", 3)
+	require.Greater(t, s.ByteSize(), size)
+
+	s.Delete("a")
+	s.Delete("b")
+	require.Equal(t, 0, s.ByteSize())
+	require.Equal(t, 0, s.Len())
+}
+
+func TestSkipList_ConcurrentReaders(t *testing.T) {
+	s, err := datastructures.NewSkipList[int, int](12, 25)
+	require.NoError(t, err)
+
+	const keys = 20000
+	var inserted atomic.Int64
+	var wg sync.WaitGroup
+
+	// Writers interleave keys so that they race on the same predecessors
+	for w := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := w; k < keys; k += 2 {
+				s.Insert(k, k)
+				inserted.Add(1)
+			}
+		}()
+	}
+
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for inserted.Load() < keys {
+				// A key is only found with the value it was inserted with
+				k := rand.Intn(keys)
+				if v, ok := s.Search(k); ok {
+					require.Equal(t, k, v)
+				}
+
+				// Keys are walked in order whatever is inserted meanwhile
+				previous := -1
+				it := s.Seek(k)
+				for i := 0; it.Valid() && i < 50; i++ {
+					require.Greater(t, it.Key(), previous)
+					previous = it.Key()
+					it.Next()
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	require.Equal(t, keys, s.Len())
+
+	expected := 0
+	for k := range s.Iter {
+		require.Equal(t, expected, k)
+		expected++
+	}
+	require.Equal(t, keys, expected)
+}
@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const blockCacheShards = 16
+
+// BlockCache keeps recently read data blocks in memory, keyed by the table
+// file number and the offset of the block. It is split in shards, each with
+// its own lock and LRU list, so that readers of different blocks rarely wait
+// on each other.
+//
+// A nil *BlockCache caches nothing.
+type BlockCache struct {
+	shards [blockCacheShards]blockCacheShard
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type blockCacheKey struct {
+	fileNum uint64
+	offset  uint64
+}
+
+type blockCacheEntry struct {
+	key blockCacheKey
+	buf []byte
+}
+
+type blockCacheShard struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // most recently used first
+	entries  map[blockCacheKey]*list.Element
+}
+
+type BlockCacheStats struct {
+	Hits     uint64
+	Misses   uint64
+	ByteSize int64
+}
+
+// NewBlockCache returns a cache holding up to byteSize bytes of blocks.
+func NewBlockCache(byteSize int64) *BlockCache {
+	c := &BlockCache{}
+	for i := range c.shards {
+		c.shards[i] = blockCacheShard{
+			capacity: max(byteSize/blockCacheShards, 1),
+			lru:      list.New(),
+			entries:  make(map[blockCacheKey]*list.Element),
+		}
+	}
+
+	return c
+}
+
+func (c *BlockCache) shard(key blockCacheKey) *blockCacheShard {
+	// Blocks of a table are spread by offset, tables by file number
+	h := key.fileNum*0x9e3779b97f4a7c15 ^ key.offset*0xbf58476d1ce4e5b9
+	return &c.shards[(h>>32)%blockCacheShards]
+}
+
+// Get returns the block of fileNum at offset. The block must not be modified.
+func (c *BlockCache) Get(fileNum, offset uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	key := blockCacheKey{fileNum, offset}
+	s := c.shard(key)
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	return e.Value.(*blockCacheEntry).buf, true
+}
+
+// Insert adds the block of fileNum at offset, evicting the least recently
+// used blocks of its shard when it is full. The cache keeps buf, which must
+// not be modified anymore.
+func (c *BlockCache) Insert(fileNum, offset uint64, buf []byte) {
+	if c == nil {
+		return
+	}
+
+	key := blockCacheKey{fileNum, offset}
+	s := c.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(e)
+		return
+	}
+
+	// A block larger than the shard would only flush everything else out
+	if int64(len(buf)) > s.capacity {
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&blockCacheEntry{key: key, buf: buf})
+	s.size += int64(len(buf))
+
+	for s.size > s.capacity {
+		s.removeLocked(s.lru.Back())
+	}
+}
+
+// EvictFile drops every block of fileNum, once its table is deleted.
+func (c *BlockCache) EvictFile(fileNum uint64) {
+	if c == nil {
+		return
+	}
+
+	for i := range c.shards {
+		s := &c.shards[i]
+
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if key.fileNum == fileNum {
+				s.removeLocked(e)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *blockCacheShard) removeLocked(e *list.Element) {
+	entry := s.lru.Remove(e).(*blockCacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= int64(len(entry.buf))
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	if c == nil {
+		return BlockCacheStats{}
+	}
+
+	stats := BlockCacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+	for i := range c.shards {
+		s := &c.shards[i]
+
+		s.mu.Lock()
+		stats.ByteSize += s.size
+		s.mu.Unlock()
+	}
+
+	return stats
+}
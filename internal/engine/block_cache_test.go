@@ -0,0 +1,101 @@
+package engine_test
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	// 16 shards of 64 bytes
+	c := engine.NewBlockCache(16 * 64)
+	block := make([]byte, 16)
+
+	// Far more blocks than fit, whatever shard they land in
+	for offset := range uint64(1000) {
+		c.Insert(1, offset, block)
+	}
+	require.LessOrEqual(t, c.Stats().ByteSize, int64(16*64))
+
+	_, ok := c.Get(1, 0)
+	require.False(t, ok)
+	buf, ok := c.Get(1, 999)
+	require.True(t, ok)
+	require.Equal(t, block, buf)
+
+	// Blocks larger than a shard are not cached
+	c.Insert(2, 0, make([]byte, 65))
+	_, ok = c.Get(2, 0)
+	require.False(t, ok)
+
+	stats := c.Stats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(2), stats.Misses)
+}
+
+func TestBlockCache_EvictFile(t *testing.T) {
+	c := engine.NewBlockCache(1 << 20)
+	for offset := range uint64(10) {
+		c.Insert(1, offset, []byte("one"))
+		c.Insert(2, offset, []byte("two"))
+	}
+
+	c.EvictFile(1)
+	require.Equal(t, int64(10*3), c.Stats().ByteSize)
+	for offset := range uint64(10) {
+		_, ok := c.Get(1, offset)
+		require.False(t, ok)
+		buf, ok := c.Get(2, offset)
+		require.True(t, ok)
+		require.Equal(t, []byte("two"), buf)
+	}
+}
+
+func TestBlockCache_UsedBySearcher(t *testing.T) {
+	dir := t.TempDir()
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	for i := range 200 {
+		require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("key:%04d", i), []byte("value")))
+	}
+	m, _ := flushMemTables(t, dir, []*engine.MemTable{mem})
+
+	c := engine.NewBlockCache(1 << 20)
+	s := engine.NewSSTableSearcher(dir, m, 100, true, c)
+	require.NoError(t, s.Start())
+
+	for range 2 {
+		_, ok, err := s.Search("key:0100", math.MaxUint64)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	stats := s.BlockCacheStats()
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, uint64(1), stats.Hits)
+
+	// Iterators share the blocks read by lookups
+	its, err := s.NewIterators("", "")
+	require.NoError(t, err)
+	require.Len(t, its, 1)
+	count := 0
+	for its[0].SeekToFirst(); its[0].Valid(); its[0].Next() {
+		count++
+	}
+	require.NoError(t, its[0].Err())
+	require.NoError(t, its[0].Close())
+	require.Equal(t, 200, count)
+	require.Greater(t, s.BlockCacheStats().Hits, uint64(1))
+
+	// Read again, everything comes from the cache
+	misses := s.BlockCacheStats().Misses
+	its, err = s.NewIterators("", "")
+	require.NoError(t, err)
+	for its[0].SeekToFirst(); its[0].Valid(); its[0].Next() {
+	}
+	require.NoError(t, its[0].Close())
+	require.Equal(t, misses, s.BlockCacheStats().Misses)
+}
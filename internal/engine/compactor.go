@@ -0,0 +1,384 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Compactor merges SSTables down the levels in the background. Level 0 is
+// compacted once it holds too many tables, every other level once its total
+// size exceeds its target, which is levelMultiplier times that of the level
+// above.
+type Compactor struct {
+	manifest        *Manifest
+	sstableSearcher *SSTableSearcher
+	snapshots       *SnapshotList
+
+	sstableConfig       SSTableConfig
+	l0CompactionTrigger int
+	baseLevelByteSize   int64
+	levelMultiplier     int64
+	targetFileByteSize  int64
+
+	// compactMu serializes compactions, compactPointer is guarded by it
+	compactMu      sync.Mutex
+	compactPointer [numLevels]string
+
+	mu      sync.Mutex
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	active  bool
+}
+
+var (
+	ErrCompactorNotActive     = errors.New("compactor not active")
+	ErrCompactorAlreadyActive = errors.New("compactor already active")
+)
+
+func NewCompactor(
+	manifest *Manifest,
+	sstableSearcher *SSTableSearcher,
+	snapshots *SnapshotList,
+	sstableConfig SSTableConfig,
+	l0CompactionTrigger int,
+	baseLevelByteSize, levelMultiplier, targetFileByteSize int64,
+) *Compactor {
+	return &Compactor{
+		manifest:            manifest,
+		sstableSearcher:     sstableSearcher,
+		snapshots:           snapshots,
+		sstableConfig:       sstableConfig,
+		l0CompactionTrigger: l0CompactionTrigger,
+		baseLevelByteSize:   baseLevelByteSize,
+		levelMultiplier:     levelMultiplier,
+		targetFileByteSize:  targetFileByteSize,
+		trigger:             make(chan struct{}, 1),
+	}
+}
+
+func (c *Compactor) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.active {
+		return ErrCompactorAlreadyActive
+	}
+
+	c.done = make(chan struct{})
+	c.wg.Add(1)
+	go c.worker(ctx)
+
+	c.active = true
+	c.Schedule()
+	return nil
+}
+
+func (c *Compactor) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return ErrCompactorNotActive
+	}
+
+	// A running compaction is finished, not abandoned
+	close(c.done)
+	c.wg.Wait()
+
+	c.active = false
+	return nil
+}
+
+// Schedule asks the background worker to check whether a level needs
+// compaction. It never blocks.
+func (c *Compactor) Schedule() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Compactor) worker(ctx context.Context) {
+	defer c.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-c.trigger:
+			for {
+				select {
+				case <-c.done:
+					return
+				default:
+				}
+
+				// A failed compaction is retried on the next trigger
+				compacted, err := c.compactOnce()
+				if err != nil || !compacted {
+					break
+				}
+			}
+		}
+	}
+}
+
+// CompactAll runs compactions until no level needs one.
+func (c *Compactor) CompactAll() error {
+	for {
+		compacted, err := c.compactOnce()
+		if err != nil {
+			return err
+		}
+
+		if !compacted {
+			return nil
+		}
+	}
+}
+
+type compaction struct {
+	level int
+
+	// inputs are taken from level, newest first, overlaps from level+1
+	inputs   []*SSTableRead
+	overlaps []*SSTableRead
+}
+
+func (c *Compactor) compactOnce() (bool, error) {
+	c.compactMu.Lock()
+	defer c.compactMu.Unlock()
+
+	v := c.sstableSearcher.acquire()
+	defer c.sstableSearcher.release(v)
+
+	comp := c.pickCompaction(v)
+	if comp == nil {
+		return false, nil
+	}
+
+	if err := c.runCompaction(v, comp); err != nil {
+		return false, fmt.Errorf("run compaction: %w", err)
+	}
+
+	return true, nil
+}
+
+func (c *Compactor) pickCompaction(v *version) *compaction {
+	level := -1
+	bestScore := 0.0
+	for l := 0; l < numLevels-1; l++ {
+		var score float64
+		if l == 0 {
+			score = float64(len(v.levels[0])) / float64(c.l0CompactionTrigger)
+		} else {
+			score = float64(v.levelByteSize(l)) / float64(c.maxLevelByteSize(l))
+		}
+
+		if score >= 1 && score > bestScore {
+			level = l
+			bestScore = score
+		}
+	}
+
+	if level < 0 {
+		return nil
+	}
+
+	var inputs []*SSTableRead
+	if level == 0 {
+		// Level 0 tables overlap, all of them go down together so that no
+		// older version of a key stays behind a newer one
+		inputs = append(inputs, v.levels[0]...)
+	} else {
+		// Round robin over the key space of the level
+		sstables := v.levels[level]
+		picked := sstables[0]
+		for _, sstable := range sstables {
+			if sstable.Largest > c.compactPointer[level] {
+				picked = sstable
+				break
+			}
+		}
+
+		c.compactPointer[level] = picked.Largest
+		inputs = append(inputs, picked)
+	}
+
+	smallest, largest := inputs[0].Smallest, inputs[0].Largest
+	for _, sstable := range inputs[1:] {
+		smallest = min(smallest, sstable.Smallest)
+		largest = max(largest, sstable.Largest)
+	}
+
+	return &compaction{
+		level:    level,
+		inputs:   inputs,
+		overlaps: v.overlapping(level+1, smallest, largest),
+	}
+}
+
+func (c *Compactor) runCompaction(v *version, comp *compaction) error {
+	sstables := append(append([]*SSTableRead{}, comp.inputs...), comp.overlaps...)
+
+	children := make([]Iterator, 0, len(sstables))
+	for _, sstable := range sstables {
+		it, err := c.sstableSearcher.newIterator(v, sstable, false)
+		if err != nil {
+			for _, child := range children {
+				child.Close()
+			}
+			return fmt.Errorf("new iterator: %w", err)
+		}
+
+		children = append(children, it)
+	}
+
+	merged := NewMergingIterator(children...)
+	defer merged.Close()
+
+	outputLevel := comp.level + 1
+	outputs := make([]*SSTableRead, 0)
+	entries := make([]MemTableEntry, 0)
+	var entriesByteSize int64
+
+	removeOutputs := func() {
+		for _, output := range outputs {
+			os.Remove(filepath.Join(c.sstableSearcher.path, output.FileName))
+		}
+	}
+
+	// A version is only needed while a reader may ask for a sequence number
+	// between its own and the one of the next newer version
+	smallestSnapshot := c.snapshots.Smallest()
+
+	lastKey := ""
+	hasLastKey := false
+	var lastSeqForKey uint64
+	for merged.SeekToFirst(); merged.Valid(); merged.Next() {
+		key := merged.Key()
+		seq := merged.Seq()
+		if !hasLastKey || key != lastKey {
+			// Outputs are only cut between keys, so that every version of a
+			// key stays in one table of the level
+			if entriesByteSize >= c.targetFileByteSize {
+				output, err := c.writeOutput(outputLevel, entries)
+				if err != nil {
+					removeOutputs()
+					return fmt.Errorf("write output: %w", err)
+				}
+
+				outputs = append(outputs, output)
+				entries = make([]MemTableEntry, 0)
+				entriesByteSize = 0
+			}
+
+			lastKey = key
+			hasLastKey = true
+			lastSeqForKey = math.MaxUint64
+		}
+
+		shadowed := lastSeqForKey <= smallestSnapshot
+		lastSeqForKey = seq
+
+		if shadowed {
+			// Every reader sees a newer version already written
+			continue
+		}
+
+		if merged.Tombstone() && seq <= smallestSnapshot && isBaseLevelForKey(v, outputLevel, key) {
+			// Nothing older left to hide from any reader
+			continue
+		}
+
+		entries = append(entries, MemTableEntry{
+			Key:       key,
+			Value:     merged.Value(),
+			Seq:       seq,
+			Tombstone: merged.Tombstone(),
+		})
+		entriesByteSize += int64(len(key) + len(merged.Value()))
+	}
+
+	if err := merged.Err(); err != nil {
+		removeOutputs()
+		return fmt.Errorf("merged iterator: %w", err)
+	}
+
+	if len(entries) > 0 {
+		output, err := c.writeOutput(outputLevel, entries)
+		if err != nil {
+			removeOutputs()
+			return fmt.Errorf("write output: %w", err)
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	edit := &VersionEdit{}
+	for _, sstable := range sstables {
+		edit.Deleted = append(edit.Deleted, sstable.fileMeta())
+	}
+	for _, sstable := range outputs {
+		edit.Added = append(edit.Added, sstable.fileMeta())
+	}
+
+	if err := c.manifest.LogAndApply(edit); err != nil {
+		removeOutputs()
+		return fmt.Errorf("manifest log and apply: %w", err)
+	}
+
+	c.sstableSearcher.applyCompaction(sstables, outputs)
+
+	return nil
+}
+
+func (c *Compactor) writeOutput(level int, entries []MemTableEntry) (*SSTableRead, error) {
+	fileNum := c.manifest.NewFileNum()
+	fileName := sstableFileName(level, fileNum)
+
+	sstable := NewSSTableWrite(entries, c.sstableConfig)
+	sstable.Properties.CreatedBy = CreatedByCompaction
+	if err := writeSSTable(filepath.Join(c.sstableSearcher.path, fileName), sstable); err != nil {
+		return nil, fmt.Errorf("write sstable: %w", err)
+	}
+
+	output, err := loadSSTable(c.sstableSearcher.path, fileName)
+	if err != nil {
+		return nil, fmt.Errorf("load sstable: %w", err)
+	}
+
+	output.FileNum = fileNum
+	output.Level = level
+	return output, nil
+}
+
+func (c *Compactor) maxLevelByteSize(level int) int64 {
+	size := c.baseLevelByteSize
+	for range level - 1 {
+		size *= c.levelMultiplier
+	}
+
+	return size
+}
+
+// isBaseLevelForKey reports whether no level below level may hold key.
+func isBaseLevelForKey(v *version, level int, key string) bool {
+	for l := level + 1; l < numLevels; l++ {
+		for _, sstable := range v.levels[l] {
+			if sstable.contains(key) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,196 @@
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSSTableConfig = engine.SSTableConfig{DatablockByteSize: 200, RestartInterval: 4, BloomBitsPerKey: 10}
+
+// flushMemTables writes one level 0 table per memtable and returns the
+// manifest and a searcher that loaded them.
+func flushMemTables(t *testing.T, dir string, memTables []*engine.MemTable) (*engine.Manifest, *engine.SSTableSearcher) {
+	return flushMemTablesWithConfig(t, dir, testSSTableConfig, memTables)
+}
+
+func flushMemTablesWithConfig(t *testing.T, dir string, config engine.SSTableConfig, memTables []*engine.MemTable) (*engine.Manifest, *engine.SSTableSearcher) {
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+
+	f := engine.NewFlusher(dir, 1, config, m, s, nil, nil)
+	require.NoError(t, f.Start(context.Background()))
+	for _, memTable := range memTables {
+		f.EnqueueToBeFlushed(memTable, 0)
+	}
+	require.NoError(t, f.Stop())
+
+	return m, s
+}
+
+func newSnapshotList(lastSeq uint64) *engine.SnapshotList {
+	seq := &atomic.Uint64{}
+	seq.Store(lastSeq)
+	return engine.NewSnapshotList(seq)
+}
+
+func numFiles(t *testing.T, dir string, s *engine.SSTableSearcher) (int, int) {
+	live := 0
+	for level := range 7 {
+		live += s.NumFilesAtLevel(level)
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, engine.SSTablesDir))
+	require.NoError(t, err)
+	return live, len(files)
+}
+
+func TestCompactor_MergesLevels(t *testing.T) {
+	dir := t.TempDir()
+
+	expected := make(map[string]string)
+	var seq uint64
+	memTables := make([]*engine.MemTable, 0)
+	for round := range 8 {
+		m, err := engine.NewMemTable(4, 50)
+		require.NoError(t, err)
+
+		for i := round * 50; i < round*50+300; i++ {
+			key := fmt.Sprintf("key:%04d", i)
+			value := fmt.Sprintf("value-%d-%d", round, i)
+			seq++
+			require.NoError(t, m.Insert(seq, key, []byte(value)))
+			expected[key] = value
+		}
+
+		for i := round * 50; i < round*50+300; i += 7 + round {
+			key := fmt.Sprintf("key:%04d", i)
+			seq++
+			require.NoError(t, m.Delete(seq, key))
+			delete(expected, key)
+		}
+
+		memTables = append(memTables, m)
+	}
+
+	m, s := flushMemTables(t, dir, memTables)
+	require.Equal(t, 8, s.NumFilesAtLevel(0))
+
+	c := engine.NewCompactor(m, s, newSnapshotList(seq), testSSTableConfig, 2, 4<<10, 10, 2<<10)
+	require.NoError(t, c.CompactAll())
+
+	require.Equal(t, 0, s.NumFilesAtLevel(0))
+	require.Positive(t, s.NumFilesAtLevel(1))
+	live, onDisk := numFiles(t, dir, s)
+	require.Equal(t, live, onDisk)
+
+	check := func(s *engine.SSTableSearcher) {
+		for i := range 8*50 + 300 {
+			key := fmt.Sprintf("key:%04d", i)
+			v, ok, err := s.Search(key, math.MaxUint64)
+			require.NoError(t, err)
+
+			value, exists := expected[key]
+			require.Equal(t, exists, ok, key)
+			if exists {
+				require.Equal(t, []byte(value), v, key)
+			}
+		}
+	}
+
+	check(s)
+
+	// Levels survive a restart
+	require.NoError(t, m.Close())
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s = engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	require.Equal(t, 0, s.NumFilesAtLevel(0))
+	check(s)
+}
+
+func TestCompactor_DropsTombstonesAtBottomLevel(t *testing.T) {
+	dir := t.TempDir()
+
+	puts, err := engine.NewMemTable(4, 50)
+	require.NoError(t, err)
+	deletes, err := engine.NewMemTable(4, 50)
+	require.NoError(t, err)
+
+	for i := range 100 {
+		key := fmt.Sprintf("key:%04d", i)
+		require.NoError(t, puts.Insert(uint64(i+1), key, []byte("value")))
+		require.NoError(t, deletes.Delete(uint64(i+101), key))
+	}
+
+	m, s := flushMemTables(t, dir, []*engine.MemTable{puts, deletes})
+
+	c := engine.NewCompactor(m, s, newSnapshotList(200), testSSTableConfig, 2, 4<<10, 10, 2<<10)
+	require.NoError(t, c.CompactAll())
+
+	live, onDisk := numFiles(t, dir, s)
+	require.Equal(t, 0, live)
+	require.Equal(t, 0, onDisk)
+}
+
+func TestCompactor_KeepsVersionsVisibleToSnapshots(t *testing.T) {
+	dir := t.TempDir()
+
+	older, err := engine.NewMemTable(4, 50)
+	require.NoError(t, err)
+	newer, err := engine.NewMemTable(4, 50)
+	require.NoError(t, err)
+
+	for i := range 100 {
+		key := fmt.Sprintf("key:%04d", i)
+		require.NoError(t, older.Insert(uint64(i+1), key, []byte("old")))
+		if i%2 == 0 {
+			require.NoError(t, newer.Insert(uint64(i+101), key, []byte("new")))
+		} else {
+			require.NoError(t, newer.Delete(uint64(i+101), key))
+		}
+	}
+
+	m, s := flushMemTables(t, dir, []*engine.MemTable{older, newer})
+
+	lastSeq := &atomic.Uint64{}
+	lastSeq.Store(100)
+	snapshots := engine.NewSnapshotList(lastSeq)
+	snapshot := snapshots.New()
+	defer snapshots.Release(snapshot)
+	lastSeq.Store(200)
+
+	c := engine.NewCompactor(m, s, snapshots, testSSTableConfig, 2, 4<<10, 10, 2<<10)
+	require.NoError(t, c.CompactAll())
+	require.Equal(t, 0, s.NumFilesAtLevel(0))
+
+	for i := range 100 {
+		key := fmt.Sprintf("key:%04d", i)
+
+		v, ok, err := s.Search(key, snapshot.Seq())
+		require.NoError(t, err)
+		require.True(t, ok, key)
+		require.Equal(t, []byte("old"), v, key)
+
+		v, ok, err = s.Search(key, math.MaxUint64)
+		require.NoError(t, err)
+		require.Equal(t, i%2 == 0, ok, key)
+		if ok {
+			require.Equal(t, []byte("new"), v, key)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package engine
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"godb/internal/tooling/guard"
+	"io"
+)
+
+// CompressionType is stored in the trailer of every block, telling how its
+// content was compressed.
+type CompressionType uint8
+
+const (
+	NoCompression CompressionType = iota
+	DeflateCompression
+	LZCompression
+)
+
+// A block is stored compressed only when it saves at least an eighth of its
+// size, otherwise reading it is not worth the decompression.
+const minCompressionSavingsDivisor = 8
+
+type codec interface {
+	encode(src []byte) []byte
+	decode(src []byte) ([]byte, error)
+}
+
+var codecs = map[CompressionType]codec{
+	DeflateCompression: deflateCodec{},
+	LZCompression:      lzCodec{},
+}
+
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case DeflateCompression:
+		return "deflate"
+	case LZCompression:
+		return "lz"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+// compressBlock returns block compressed with compression and the type it
+// ended up stored as.
+func compressBlock(block []byte, compression CompressionType) ([]byte, CompressionType) {
+	c, ok := codecs[compression]
+	if !ok {
+		return block, NoCompression
+	}
+
+	compressed := c.encode(block)
+	if len(compressed) > len(block)-len(block)/minCompressionSavingsDivisor {
+		return block, NoCompression
+	}
+
+	return compressed, compression
+}
+
+var errUnknownCompression = errors.New("unknown compression type")
+
+func decompressBlock(block []byte, compression CompressionType) ([]byte, error) {
+	if compression == NoCompression {
+		return block, nil
+	}
+
+	c, ok := codecs[compression]
+	if !ok {
+		return nil, errUnknownCompression
+	}
+
+	return c.decode(block)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) encode(src []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	guard.Assert(err == nil, "The compression level is valid")
+
+	// Writes to a bytes.Buffer do not fail
+	w.Write(src)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func (deflateCodec) decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// lzCodec is an LZ77 codec in the spirit of LZ4, favouring speed over ratio.
+// A block is the uvarint of its decompressed size followed by sequences of
+//
+//	token, [literal length], literals, offset, [match length]
+//
+// The token holds the literal length in its high nibble and the match length
+// minus lzMinMatch in its low one, 15 meaning that the rest follows as a
+// uvarint. The offset is a little endian uint16 back into the output. The
+// last sequence stops after its literals.
+type lzCodec struct{}
+
+const (
+	lzMinMatch  = 4
+	lzMaxOffset = 1<<16 - 1
+	lzHashBits  = 14
+)
+
+func (lzCodec) encode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+
+	var table [1 << lzHashBits]int32 // position + 1 of the last occurrence
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 2654435761 >> (32 - lzHashBits)
+	}
+
+	anchor := 0
+	for i := 0; i+lzMinMatch <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || i-candidate > lzMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		matchLen := lzMinMatch
+		for i+matchLen < len(src) && src[candidate+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+
+		dst = lzAppendSequence(dst, src[anchor:i], i-candidate, matchLen)
+		i += matchLen
+		anchor = i
+	}
+
+	return lzAppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lzAppendSequence appends literals followed by a match, none when offset is
+// zero.
+func lzAppendSequence(dst, literals []byte, offset, matchLen int) []byte {
+	litNibble := min(len(literals), 15)
+	matchNibble := 0
+	if offset > 0 {
+		matchNibble = min(matchLen-lzMinMatch, 15)
+	}
+
+	dst = append(dst, byte(litNibble<<4|matchNibble))
+	if litNibble == 15 {
+		dst = binary.AppendUvarint(dst, uint64(len(literals)-15))
+	}
+	dst = append(dst, literals...)
+
+	if offset == 0 {
+		return dst
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	if matchNibble == 15 {
+		dst = binary.AppendUvarint(dst, uint64(matchLen-lzMinMatch-15))
+	}
+
+	return dst
+}
+
+var errLZCorrupted = errors.New("lz: corrupted input")
+
+func (lzCodec) decode(src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errLZCorrupted
+	}
+	src = src[n:]
+
+	// A corrupted size must not allocate much, the output grows as needed
+	dst := make([]byte, 0, min(size, uint64(len(src))*4))
+	for {
+		if len(src) == 0 {
+			return nil, errLZCorrupted
+		}
+		token := src[0]
+		src = src[1:]
+
+		litLen := uint64(token >> 4)
+		if litLen == 15 {
+			extra, n := binary.Uvarint(src)
+			if n <= 0 {
+				return nil, errLZCorrupted
+			}
+			litLen += extra
+			src = src[n:]
+		}
+		if litLen > uint64(len(src)) || uint64(len(dst))+litLen > size {
+			return nil, errLZCorrupted
+		}
+		dst = append(dst, src[:litLen]...)
+		src = src[litLen:]
+
+		if len(src) == 0 {
+			break
+		}
+
+		if len(src) < 2 {
+			return nil, errLZCorrupted
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+
+		matchLen := uint64(token&0x0f) + lzMinMatch
+		if token&0x0f == 15 {
+			extra, n := binary.Uvarint(src)
+			if n <= 0 {
+				return nil, errLZCorrupted
+			}
+			matchLen += extra
+			src = src[n:]
+		}
+
+		if offset == 0 || offset > len(dst) || uint64(len(dst))+matchLen > size {
+			return nil, errLZCorrupted
+		}
+
+		// The match may overlap the bytes it produces
+		start := len(dst) - offset
+		for i := range int(matchLen) {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != size {
+		return nil, errLZCorrupted
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,122 @@
+package engine_test
+
+import (
+	"bytes"
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.UintN(256))
+		}
+		return b
+	}
+
+	expected := make(map[string][]byte)
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	for i := range 100 {
+		key := fmt.Sprintf("user:%04d", i)
+		var value []byte
+		switch {
+		case i%5 == 0:
+			value = random(1 + i)
+		default:
+			value = fmt.Appendf(nil, `{"id":%d,"name":"user %d","active":true,"tags":["a","b","c"]}`, i, i)
+		}
+		require.NoError(t, mem.Insert(uint64(i+1), key, value))
+		expected[key] = value
+	}
+
+	// Runs longer than any offset or nibble
+	run := bytes.Repeat([]byte{'x'}, 70_000)
+	require.NoError(t, mem.Insert(101, "run", run))
+	expected["run"] = run
+
+	sizes := make(map[engine.CompressionType]int64)
+	for _, compression := range []engine.CompressionType{
+		engine.NoCompression,
+		engine.DeflateCompression,
+		engine.LZCompression,
+	} {
+		t.Run(compression.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			config := testSSTableConfig
+			config.Compression = compression
+
+			m, _ := flushMemTablesWithConfig(t, dir, config, []*engine.MemTable{mem})
+
+			// Through the block cache, twice, and straight from the file
+			cached := engine.NewSSTableSearcher(dir, m, 100, true, engine.NewBlockCache(64<<20))
+			require.NoError(t, cached.Start())
+			uncached := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+			require.NoError(t, uncached.Start())
+			for _, s := range []*engine.SSTableSearcher{cached, cached, uncached} {
+				for key, value := range expected {
+					v, ok, err := s.Search(key, math.MaxUint64)
+					require.NoError(t, err)
+					require.True(t, ok, key)
+					require.True(t, bytes.Equal(value, v), key)
+				}
+			}
+			require.Positive(t, cached.BlockCacheStats().Hits)
+			require.NoError(t, cached.Close())
+			require.NoError(t, uncached.Close())
+
+			sizes[compression] = dirSize(t, dir)
+		})
+	}
+
+	require.Less(t, sizes[engine.DeflateCompression], sizes[engine.NoCompression]/10)
+	require.Less(t, sizes[engine.LZCompression], sizes[engine.NoCompression]/10)
+}
+
+func TestCompression_StoresIncompressibleBlocksRaw(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	for i := range 100 {
+		value := make([]byte, 100)
+		for j := range value {
+			value[j] = byte(rng.UintN(256))
+		}
+		require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("key:%04d", i), value))
+	}
+
+	sizes := make([]int64, 0)
+	for _, compression := range []engine.CompressionType{engine.NoCompression, engine.LZCompression} {
+		dir := t.TempDir()
+		config := testSSTableConfig
+		config.Compression = compression
+		flushMemTablesWithConfig(t, dir, config, []*engine.MemTable{mem})
+		sizes = append(sizes, dirSize(t, dir))
+	}
+
+	require.Equal(t, sizes[0], sizes[1])
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	files, err := filepath.Glob(filepath.Join(dir, engine.SSTablesDir, "*"+engine.SSTableFileSuffix))
+	require.NoError(t, err)
+
+	var size int64
+	for _, f := range files {
+		info, err := os.Stat(f)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+
+	return size
+}
@@ -2,56 +2,155 @@ package engine
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"godb/internal/tooling/guard"
-	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+// Flusher writes read-only memtables to level 0 SSTables. Tables are written
+// concurrently but published in the order the memtables were enqueued, so a
+// newer table never becomes visible before an older one. A memtable stays
+// readable until its table is published.
 type Flusher struct {
-	fChan          chan *MemTable
-	rOnlyMemTables []*MemTable
-	mu             sync.Mutex
-
-	maxWorkers           int
-	maxDatablockByteSize int
-	path                 string
+	// done is closed by StopRetrying, a flush being retried gives up
+	done chan struct{}
+	// pending holds the enqueued memtables not published yet, oldest first.
+	// Workers take their tasks from it
+	pending []*flushTask
+	mu      sync.Mutex
+	// queued is signaled whenever a task is enqueued or the workers are to
+	// exit, retired whenever a memtable leaves pending or a flush is given
+	// up, both with mu held
+	queued  *sync.Cond
+	retired *sync.Cond
+	// closed tells the workers to exit once no task is left to take, stopCtx
+	// unregisters the wake up of the workers once their ctx is done
+	closed  bool
+	stopCtx func() bool
+	wg      sync.WaitGroup
+
+	// publishMu serializes publishing
+	publishMu sync.Mutex
+
+	maxWorkers    int
+	sstableConfig SSTableConfig
+	path          string
+
+	manifest        *Manifest
+	sstableSearcher *SSTableSearcher
+	snapshots       *SnapshotList
+	compactor       *Compactor
 
 	active bool
 }
 
+type flushTask struct {
+	memTable *MemTable
+	fileNum  uint64
+	// logNum is the first WAL segment holding writes newer than the memtable
+	logNum uint64
+
+	// Guarded by Flusher.mu
+	taken   bool
+	done    bool
+	sstable *SSTableRead
+	err     error
+}
+
+// A failed flush is retried after flushRetryMinDelay, the delay doubling up
+// to flushRetryMaxDelay with every failure.
+const (
+	flushRetryMinDelay = 10 * time.Millisecond
+	flushRetryMaxDelay = time.Second
+)
+
 var (
 	ErrFlusherNotActive     = errors.New("flusher not active")
 	ErrFlusherAlreadyActive = errors.New("flusher already active")
 )
 
-var seq = 0
+// NewFlusher returns a flusher that publishes its tables to sstableSearcher
+// and then schedules compactor, which may be nil. Versions no snapshot of
+// snapshots can see are not flushed, every version is when it is nil.
+func NewFlusher(
+	path string,
+	maxWorkers int,
+	sstableConfig SSTableConfig,
+	manifest *Manifest,
+	sstableSearcher *SSTableSearcher,
+	snapshots *SnapshotList,
+	compactor *Compactor,
+) *Flusher {
+	f := &Flusher{
+		manifest:        manifest,
+		sstableSearcher: sstableSearcher,
+		snapshots:       snapshots,
+		compactor:       compactor,
+		pending:         make([]*flushTask, 0),
+		mu:              sync.Mutex{},
+		maxWorkers:      maxWorkers,
+		sstableConfig:   sstableConfig,
+		path:            path,
+	}
+	f.queued = sync.NewCond(&f.mu)
+	f.retired = sync.NewCond(&f.mu)
+
+	return f
+}
+
+// ROnlyMemTables returns the memtables waiting to be published, oldest first.
+func (f *Flusher) ROnlyMemTables() []*MemTable {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-func NewFlusher(path string, maxWorkers, maxDatablockByteSize int) *Flusher {
-	return &Flusher{
-		rOnlyMemTables:       make([]*MemTable, 0),
-		mu:                   sync.Mutex{},
-		maxWorkers:           maxWorkers,
-		maxDatablockByteSize: maxDatablockByteSize,
-		path:                 path,
+	memTables := make([]*MemTable, 0, len(f.pending))
+	for _, task := range f.pending {
+		memTables = append(memTables, task.memTable)
 	}
+
+	return memTables
 }
 
-func (f *Flusher) AppendROnlyMemTable(m *MemTable) {
+// ByteSize returns the memory held by the memtables waiting to be published.
+func (f *Flusher) ByteSize() int {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	f.rOnlyMemTables = append(f.rOnlyMemTables, m)
+	return f.pendingByteSize()
 }
 
-func (f *Flusher) ROnlyMemTables() []*MemTable {
+// pendingByteSize must be called with f.mu held.
+func (f *Flusher) pendingByteSize() int {
+	size := 0
+	for _, task := range f.pending {
+		size += task.memTable.ByteSize()
+	}
+
+	return size
+}
+
+// WaitBelow blocks until the memtables waiting to be published hold less
+// than byteSize, or none is left. A failed flush holding the queue back is
+// waited for while it is retried, its error is returned once it is given up.
+func (f *Flusher) WaitBelow(byteSize int) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	return append([]*MemTable{}, f.rOnlyMemTables...)
+	for len(f.pending) > 0 && f.pendingByteSize() >= byteSize {
+		if head := f.pending[0]; head.done && head.err != nil {
+			return fmt.Errorf("flush: %w", head.err)
+		}
+		if !f.active {
+			return ErrFlusherNotActive
+		}
+
+		f.retired.Wait()
+	}
+
+	return nil
 }
 
 func (f *Flusher) Start(ctx context.Context) error {
@@ -62,9 +161,16 @@ func (f *Flusher) Start(ctx context.Context) error {
 		return ErrFlusherAlreadyActive
 	}
 
-	f.fChan = make(chan *MemTable, 3)
+	f.done = make(chan struct{})
+	f.closed = false
+	f.stopCtx = context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		f.queued.Broadcast()
+		f.mu.Unlock()
+	})
 
 	for range f.maxWorkers {
+		f.wg.Add(1)
 		go f.worker(ctx)
 	}
 
@@ -73,123 +179,207 @@ func (f *Flusher) Start(ctx context.Context) error {
 }
 
 func (f *Flusher) worker(ctx context.Context) {
+	defer f.wg.Done()
+
 	for {
-		select {
-		case <-ctx.Done():
+		f.mu.Lock()
+		task := f.take()
+		for task == nil && !f.closed && ctx.Err() == nil {
+			f.queued.Wait()
+			task = f.take()
+		}
+		f.mu.Unlock()
+
+		if task == nil {
 			return
-		case memTable, ok := <-f.fChan:
-			if !ok {
-				return
-			}
+		}
 
-			f.flush(memTable)
+		sstable, err := f.flushWithRetry(ctx, task)
 
-			// Delete
-			f.mu.Lock()
-			for i, v := range f.rOnlyMemTables {
-				if v == memTable {
-					f.rOnlyMemTables = append(
-						(f.rOnlyMemTables)[:i],
-						(f.rOnlyMemTables)[i+1:]...,
-					)
-					break
-				}
-			}
-			f.mu.Unlock()
+		f.mu.Lock()
+		task.done = true
+		task.sstable = sstable
+		task.err = err
+		if err != nil {
+			f.retired.Broadcast()
 		}
+		f.mu.Unlock()
+
+		f.publish()
 	}
 }
 
-func (f *Flusher) Stop() error {
-	if !f.active {
-		return ErrFlusherNotActive
+// take returns the oldest task no worker took yet, nil if there is none.
+// Must be called with f.mu held.
+func (f *Flusher) take() *flushTask {
+	for _, task := range f.pending {
+		if !task.taken {
+			task.taken = true
+			return task
+		}
 	}
 
-	close(f.fChan)
-
-	f.active = false
 	return nil
 }
 
-func (f *Flusher) EnqueueToBeFlushed(m *MemTable) {
-	f.fChan <- m
+// flushWithRetry flushes task until it succeeds, so that a transient
+// failure, a full disk for one, does not stop the queue for good. Once
+// retries stop it is attempted one last time.
+func (f *Flusher) flushWithRetry(ctx context.Context, task *flushTask) (*SSTableRead, error) {
+	delay := flushRetryMinDelay
+	for {
+		sstable, err := f.flush(task)
+		if err == nil {
+			return sstable, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-f.done:
+			return f.flush(task)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, flushRetryMaxDelay)
+	}
 }
 
-func (f *Flusher) flush(m *MemTable) error {
-	sstable := NewSSTableWriteFromMemTable(m, f.maxDatablockByteSize)
+// publish makes the flushed tables at the head of the queue visible and
+// retires their memtables. A flush given up on stops the queue, its memtable
+// and every newer one stay readable from memory. So does a failure to log
+// the edit, the manifest can not be appended to after a torn record.
+func (f *Flusher) publish() {
+	f.publishMu.Lock()
+	defer f.publishMu.Unlock()
 
-	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
-	filename := fmt.Sprint(seq) + SSTableFileSuffix
-	seq++
-	p := filepath.Join(f.path, SSTablesDir, filename)
-	file, err := os.OpenFile(p, flag, 0644)
-	if err != nil {
-		return fmt.Errorf("open file: %w", err)
-	}
-
-	defer func() {
-		fErr := file.Close()
-		guard.Assert(
-			fErr == nil,
-			"This raises only if it was already closed..",
-		)
-	}()
-
-	for _, datablock := range sstable.Datablocks {
-		buf := make([]byte, 0, datablock.EntriesByteSize+datablock.RestartTableSize)
-
-		for _, entry := range datablock.Entries {
-			buf = binary.LittleEndian.AppendUint32(buf, entry.SharedKeyLen)
-			buf = binary.LittleEndian.AppendUint32(buf, entry.UnsharedKeyLen)
-			buf = binary.LittleEndian.AppendUint32(buf, entry.ValueLen)
-			buf = append(buf, entry.KeySuffix...)
-			buf = append(buf, entry.Value...)
+	published := false
+	for {
+		f.mu.Lock()
+		if len(f.pending) == 0 || !f.pending[0].done || f.pending[0].err != nil {
+			f.mu.Unlock()
+			break
 		}
+		task := f.pending[0]
+		f.mu.Unlock()
 
-		for _, entry := range datablock.RestartTable {
-			buf = binary.LittleEndian.AppendUint32(buf, entry)
+		edit := &VersionEdit{
+			LogNum:  task.logNum,
+			LastSeq: task.memTable.LastSeq(),
+			Added:   []FileMeta{task.sstable.fileMeta()},
+		}
+		if err := f.manifest.LogAndApply(edit); err != nil {
+			f.mu.Lock()
+			task.err = fmt.Errorf("manifest log and apply: %w", err)
+			f.retired.Broadcast()
+			f.mu.Unlock()
+			break
 		}
 
-		buf = binary.LittleEndian.AppendUint32(buf, datablock.RestartTableLen)
+		// Publish the table before retiring the memtable, so that its keys
+		// are readable from one of them at all times
+		f.sstableSearcher.addFlushed(task.sstable)
 
-		if _, err := file.Write(buf); err != nil {
-			return fmt.Errorf("file write datablock: %w", err)
-		}
-	}
+		// The edit is synced, the segments of the memtable are no longer
+		// replayed. Those failing to go are removed on the next start
+		RemoveObsoleteWALs(f.path, edit.LogNum)
 
-	buf := make([]byte, 0, sstable.Footer.IndexSize)
-	for _, entry := range sstable.Index {
-		buf = binary.LittleEndian.AppendUint32(buf, entry.KeyLen)
-		buf = append(buf, entry.Key...)
-		buf = binary.LittleEndian.AppendUint32(buf, entry.Offset)
+		f.mu.Lock()
+		f.pending = f.pending[1:]
+		f.retired.Broadcast()
+		f.mu.Unlock()
+		published = true
 	}
 
-	if _, err := file.Write(buf); err != nil {
-		return fmt.Errorf("file write index: %w", err)
+	if published && f.compactor != nil {
+		f.compactor.Schedule()
 	}
+}
 
-	buf = make([]byte, 0, sstable.Footer.BloomFilterSize)
-	buf = append(buf, sstable.BloomFilter.BitArray...)
-	buf = binary.LittleEndian.AppendUint32(buf, sstable.BloomFilter.NumOfBits)
-	buf = binary.LittleEndian.AppendUint32(buf, sstable.BloomFilter.NumOfHashFuncs)
+// StopRetrying has a failing flush, current or later, attempted once more
+// and then given up on rather than retried, failing the writes waiting for
+// it. Stop calls it first.
+func (f *Flusher) StopRetrying() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 
-	if _, err := file.Write(buf); err != nil {
-		return fmt.Errorf("file write bloomfilter: %w", err)
+	if !f.active {
+		return
 	}
 
-	buf = make([]byte, 0, 5*uint32Bytes)
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(sstable.Footer.IndexOffset))
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(sstable.Footer.IndexSize))
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(sstable.Footer.BloomFilterOffset))
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(sstable.Footer.BloomFilterSize))
-	buf = binary.LittleEndian.AppendUint32(buf, uint32(sstable.Footer.MagicNumber))
-	if _, err := file.Write(buf); err != nil {
-		return fmt.Errorf("file write footer: %w", err)
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
 	}
+}
 
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("file sync: %w", err)
+func (f *Flusher) Stop() error {
+	if !f.active {
+		return ErrFlusherNotActive
+	}
+
+	// Let the workers drain the queue so every enqueued memtable is on disk,
+	// a failing flush is attempted once more and given up on
+	f.StopRetrying()
+	f.mu.Lock()
+	f.closed = true
+	f.queued.Broadcast()
+	f.mu.Unlock()
+	f.wg.Wait()
+	f.stopCtx()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active = false
+	f.retired.Broadcast()
+
+	// The memtables left are replayed from the WAL on the next start, but
+	// for writes that skipped it
+	if len(f.pending) > 0 && f.pending[0].err != nil {
+		return fmt.Errorf("flush: %w", f.pending[0].err)
 	}
 
 	return nil
 }
+
+// EnqueueToBeFlushed makes m readable as a read-only memtable and queues it
+// to be flushed. It does not wait for a worker, the write buffer bounds the
+// queue. Memtables are published in the order they are enqueued. logNum is
+// the first WAL segment holding writes newer than m, the older ones are
+// removed once m is published, zero keeping them all.
+func (f *Flusher) EnqueueToBeFlushed(m *MemTable, logNum uint64) {
+	task := &flushTask{memTable: m, fileNum: f.manifest.NewFileNum(), logNum: logNum}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	guard.Assert(!f.closed, "Memtables are enqueued before the flusher stops")
+	f.pending = append(f.pending, task)
+	f.queued.Signal()
+}
+
+func (f *Flusher) flush(task *flushTask) (*SSTableRead, error) {
+	// A snapshot taken later sees every version visible at Smallest
+	var smallestSnapshot uint64
+	if f.snapshots != nil {
+		smallestSnapshot = f.snapshots.Smallest()
+	}
+
+	sstable := NewSSTableWriteFromMemTable(task.memTable, smallestSnapshot, f.sstableConfig)
+	sstable.Properties.CreatedBy = CreatedByFlush
+
+	filename := sstableFileName(0, task.fileNum)
+	dir := filepath.Join(f.path, SSTablesDir)
+	if err := writeSSTable(filepath.Join(dir, filename), sstable); err != nil {
+		return nil, fmt.Errorf("write sstable: %w", err)
+	}
+
+	sstableRead, err := loadSSTable(dir, filename)
+	if err != nil {
+		return nil, fmt.Errorf("load sstable: %w", err)
+	}
+	sstableRead.FileNum = task.fileNum
+
+	return sstableRead, nil
+}
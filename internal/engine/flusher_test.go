@@ -0,0 +1,198 @@
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"godb/internal/engine"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlusher_WaitBelow(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	f := engine.NewFlusher(dir, 1, testSSTableConfig, m, s, nil, nil)
+	require.NoError(t, f.Start(context.Background()))
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Insert(1, "key", []byte("value")))
+	require.Greater(t, mem.ByteSize(), len("key")+len("value"))
+
+	f.EnqueueToBeFlushed(mem, 0)
+	require.NoError(t, f.WaitBelow(1))
+	require.Equal(t, 0, f.ByteSize())
+
+	// A flush that can not succeed holds the wait while it is retried
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, engine.SSTablesDir)))
+
+	mem, err = engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Delete(2, "key"))
+	f.EnqueueToBeFlushed(mem, 0)
+
+	waited := make(chan error, 1)
+	go func() { waited <- f.WaitBelow(1) }()
+	require.Equal(t, mem.ByteSize(), f.ByteSize())
+	require.NoError(t, f.WaitBelow(mem.ByteSize()+1))
+
+	// The queue moves on once the flush can succeed
+	require.NoError(t, os.Mkdir(filepath.Join(dir, engine.SSTablesDir), 0755))
+	require.NoError(t, <-waited)
+	require.Equal(t, 0, f.ByteSize())
+
+	require.NoError(t, f.Stop())
+}
+
+func TestFlusher_RetriesFailedFlush(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	// The disk is full until told otherwise
+	var failures atomic.Int64
+	var failing atomic.Bool
+	failing.Store(true)
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == engine.SSTableFileSuffix && failing.Load() {
+			failures.Add(1)
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	f := engine.NewFlusher(dir, 1, testSSTableConfig, m, s, nil, nil)
+	require.NoError(t, f.Start(context.Background()))
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Insert(1, "a", []byte("value")))
+	f.EnqueueToBeFlushed(mem, 0)
+
+	// The wait outlasts the failures, the flush being retried
+	waited := make(chan error, 1)
+	go func() { waited <- f.WaitBelow(1) }()
+	require.Eventually(t, func() bool {
+		return failures.Load() >= 3
+	}, 5*time.Second, time.Millisecond)
+	require.Empty(t, waited)
+
+	failing.Store(false)
+	require.NoError(t, <-waited)
+	require.Equal(t, 1, s.NumFilesAtLevel(0))
+
+	// A flush still failing when the flusher stops is given up on, failing
+	// the wait, and reported, its memtable left readable
+	failing.Store(true)
+	mem, err = engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Insert(2, "b", []byte("value")))
+	f.EnqueueToBeFlushed(mem, 0)
+
+	go func() { waited <- f.WaitBelow(1) }()
+	failed := failures.Load()
+	require.Eventually(t, func() bool {
+		return failures.Load() > failed
+	}, 5*time.Second, time.Millisecond)
+	require.Empty(t, waited)
+
+	require.ErrorIs(t, f.Stop(), syscall.ENOSPC)
+	require.ErrorIs(t, <-waited, syscall.ENOSPC)
+	require.Len(t, f.ROnlyMemTables(), 1)
+	require.Equal(t, 1, s.NumFilesAtLevel(0))
+}
+
+func TestFlusher_EnqueueDoesNotWaitForWorkers(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	// Flushes hang until released
+	release := make(chan struct{})
+	engine.SyncHook = func(path string) error {
+		if filepath.Ext(path) == engine.SSTableFileSuffix {
+			<-release
+		}
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	f := engine.NewFlusher(dir, 1, testSSTableConfig, m, s, nil, nil)
+	require.NoError(t, f.Start(context.Background()))
+
+	// Far more memtables than workers are queued while the first flush hangs
+	const memTables = 10
+	for i := range memTables {
+		mem, err := engine.NewMemTable(12, 25)
+		require.NoError(t, err)
+		require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("key:%02d", i), []byte("value")))
+		f.EnqueueToBeFlushed(mem, 0)
+	}
+	require.Len(t, f.ROnlyMemTables(), memTables)
+
+	close(release)
+	require.NoError(t, f.Stop())
+	require.Empty(t, f.ROnlyMemTables())
+	require.Equal(t, memTables, s.NumFilesAtLevel(0))
+}
+
+func TestFlusher_SyncOrder(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	syncs := recordSyncs(t, dir)
+
+	f := engine.NewFlusher(dir, 1, testSSTableConfig, m, s, nil, nil)
+	require.NoError(t, f.Start(context.Background()))
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Insert(1, "key", []byte("value")))
+	f.EnqueueToBeFlushed(mem, 0)
+	require.NoError(t, f.Stop())
+
+	// The table, then its directory entry, are durable before the manifest
+	// edit naming it
+	files, err := os.ReadDir(filepath.Join(dir, engine.SSTablesDir))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	table := files[0].Name()
+	require.Equal(t, []string{
+		filepath.Join(engine.SSTablesDir, table),
+		engine.SSTablesDir + "[" + table + "]",
+		"MANIFEST",
+	}, syncs())
+}
@@ -0,0 +1,203 @@
+package engine
+
+// Iterator walks the entries of a single source (a memtable, an SSTable) or of
+// several merged sources in ascending key order. Entries sharing a key are
+// yielded newest first, that is by descending sequence number, and neither
+// tombstones nor versions newer than any snapshot are hidden.
+type Iterator interface {
+	Valid() bool
+	SeekToFirst()
+	SeekToLast()
+	// Seek positions the iterator at the first entry with a key >= key.
+	Seek(key string)
+	Next()
+	Prev()
+	Key() string
+	Value() []byte
+	// Seq is the sequence number of the write that produced the entry.
+	Seq() uint64
+	Tombstone() bool
+	Err() error
+	Close() error
+}
+
+type direction int
+
+const (
+	forward direction = iota
+	reverse
+)
+
+// mergingIterator merges children ordered newest to oldest. On equal keys the
+// entry of the newer child comes first, so the merged stream keeps the newest
+// first order of its children. Once it ran off either end, Next moves it back
+// to the first entry and Prev to the last.
+type mergingIterator struct {
+	children  []Iterator
+	current   int
+	direction direction
+}
+
+func NewMergingIterator(children ...Iterator) Iterator {
+	return &mergingIterator{children: children, current: -1}
+}
+
+func (m *mergingIterator) Valid() bool {
+	return m.current >= 0 && m.children[m.current].Valid()
+}
+
+func (m *mergingIterator) SeekToFirst() {
+	for _, child := range m.children {
+		child.SeekToFirst()
+	}
+
+	m.findSmallest()
+	m.direction = forward
+}
+
+func (m *mergingIterator) SeekToLast() {
+	for _, child := range m.children {
+		child.SeekToLast()
+	}
+
+	m.findLargest()
+	m.direction = reverse
+}
+
+func (m *mergingIterator) Seek(key string) {
+	for _, child := range m.children {
+		child.Seek(key)
+	}
+
+	m.findSmallest()
+	m.direction = forward
+}
+
+func (m *mergingIterator) Next() {
+	if m.current < 0 {
+		m.SeekToFirst()
+		return
+	}
+
+	if m.direction != forward {
+		// Children are positioned before the current key. Newer children must
+		// move past their entries for the key, older ones stay on them since
+		// those come after the current entry.
+		key := m.Key()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+
+			child.Seek(key)
+			if i < m.current {
+				for child.Valid() && child.Key() == key {
+					child.Next()
+				}
+			}
+		}
+		m.direction = forward
+	}
+
+	m.children[m.current].Next()
+	m.findSmallest()
+}
+
+func (m *mergingIterator) Prev() {
+	if m.current < 0 {
+		m.SeekToLast()
+		return
+	}
+
+	if m.direction != reverse {
+		// Mirror of Next: newer children keep their entries for the current
+		// key, older children move before them.
+		key := m.Key()
+		for i, child := range m.children {
+			if i == m.current {
+				continue
+			}
+
+			child.Seek(key)
+			if i < m.current {
+				for child.Valid() && child.Key() == key {
+					child.Next()
+				}
+			}
+
+			if child.Valid() {
+				child.Prev()
+			} else {
+				child.SeekToLast()
+			}
+		}
+		m.direction = reverse
+	}
+
+	m.children[m.current].Prev()
+	m.findLargest()
+}
+
+func (m *mergingIterator) Key() string {
+	return m.children[m.current].Key()
+}
+
+func (m *mergingIterator) Value() []byte {
+	return m.children[m.current].Value()
+}
+
+func (m *mergingIterator) Seq() uint64 {
+	return m.children[m.current].Seq()
+}
+
+func (m *mergingIterator) Tombstone() bool {
+	return m.children[m.current].Tombstone()
+}
+
+func (m *mergingIterator) Err() error {
+	for _, child := range m.children {
+		if err := child.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mergingIterator) Close() error {
+	var firstErr error
+	for _, child := range m.children {
+		if err := child.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (m *mergingIterator) findSmallest() {
+	m.current = -1
+	for i, child := range m.children {
+		if !child.Valid() {
+			continue
+		}
+
+		if m.current < 0 || child.Key() < m.children[m.current].Key() {
+			m.current = i
+		}
+	}
+}
+
+func (m *mergingIterator) findLargest() {
+	m.current = -1
+	for i := len(m.children) - 1; i >= 0; i-- {
+		child := m.children[i]
+		if !child.Valid() {
+			continue
+		}
+
+		if m.current < 0 || child.Key() > m.children[m.current].Key() {
+			m.current = i
+		}
+	}
+}
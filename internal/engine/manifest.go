@@ -0,0 +1,521 @@
+package engine
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"godb/internal/tooling/guard"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Manifest is the log of version edits that decides which SSTables are live.
+// A table exists for readers only once an edit adding it is synced, and a
+// table removed by an edit is garbage even if its file is still on disk.
+//
+// On open the log is replayed and rewritten as a single snapshot edit, so it
+// does not grow across restarts.
+type Manifest struct {
+	path string
+
+	mu          sync.Mutex
+	file        *os.File
+	nextFileNum uint64
+	logNum      uint64
+	lastSeq     uint64
+	files       map[uint64]FileMeta
+}
+
+type FileMeta struct {
+	Level    int
+	FileNum  uint64
+	Size     int64
+	Smallest string
+	Largest  string
+}
+
+// VersionEdit describes a change of the live SSTable set. NextFileNum and
+// LogNum are filled in by the manifest when the edit is logged.
+type VersionEdit struct {
+	NextFileNum uint64
+	// LogNum is the oldest WAL whose data may not be in an SSTable yet, older
+	// ones are safe to drop.
+	LogNum uint64
+	// LastSeq is the highest sequence number written to an SSTable, it only
+	// grows
+	LastSeq uint64
+	Added   []FileMeta
+	Deleted []FileMeta
+}
+
+const (
+	manifestFileName    = "MANIFEST"
+	manifestTmpFileName = "MANIFEST.tmp"
+)
+
+var ErrManifestCorrupted = errors.New("manifest corrupted")
+
+// DatabaseExists reports whether path holds a database, one written before
+// the manifest existed included.
+func DatabaseExists(path string) (bool, error) {
+	for _, name := range []string{manifestFileName, legacyWALFileName, SSTablesDir} {
+		_, err := os.Stat(filepath.Join(path, name))
+		if err == nil {
+			return true, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, fmt.Errorf("stat %s: %w", name, err)
+		}
+	}
+
+	return false, nil
+}
+
+func OpenManifest(path string) (*Manifest, error) {
+	m := &Manifest{path: path, files: make(map[uint64]FileMeta)}
+
+	dataDir := filepath.Join(path, SSTablesDir)
+	if err := os.Mkdir(dataDir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("mkdir data: %w", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(path, manifestFileName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := m.adoptSSTables(); err != nil {
+			return nil, fmt.Errorf("adopt sstables: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("read file: %w", err)
+	default:
+		if err := m.replay(content); err != nil {
+			return nil, fmt.Errorf("replay: %w", err)
+		}
+	}
+
+	// A segment opened after the last logged edit may hold a number the
+	// manifest never saw
+	segments, err := walSegments(path)
+	if err != nil {
+		return nil, fmt.Errorf("wal segments: %w", err)
+	}
+	for _, segment := range segments {
+		m.nextFileNum = max(m.nextFileNum, segment.logNum+1)
+	}
+
+	if err := m.writeSnapshot(); err != nil {
+		return nil, fmt.Errorf("write snapshot: %w", err)
+	}
+
+	if err := m.removeOrphans(); err != nil {
+		return nil, fmt.Errorf("remove orphans: %w", err)
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.file.Close(); err != nil {
+		return fmt.Errorf("file close: %w", err)
+	}
+
+	return nil
+}
+
+// NewFileNum returns a file number no other file has used. It is persisted
+// with the next logged edit.
+func (m *Manifest) NewFileNum() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fileNum := m.nextFileNum
+	m.nextFileNum++
+	return fileNum
+}
+
+func (m *Manifest) LogNum() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.logNum
+}
+
+func (m *Manifest) LastSeq() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.lastSeq
+}
+
+// LiveFiles returns the live SSTables ordered by file number.
+func (m *Manifest) LiveFiles() []FileMeta {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.liveFilesLocked()
+}
+
+// LogAndApply durably appends the edit and applies it to the live set.
+func (m *Manifest) LogAndApply(edit *VersionEdit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	edit.NextFileNum = m.nextFileNum
+	edit.LogNum = max(edit.LogNum, m.logNum)
+	edit.LastSeq = max(edit.LastSeq, m.lastSeq)
+
+	if _, err := m.file.Write(frameRecord(edit.encode())); err != nil {
+		return fmt.Errorf("file write: %w", err)
+	}
+
+	if err := syncFile(m.file); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+
+	m.apply(edit)
+	return nil
+}
+
+func (m *Manifest) apply(edit *VersionEdit) {
+	for _, f := range edit.Deleted {
+		delete(m.files, f.FileNum)
+	}
+
+	for _, f := range edit.Added {
+		m.files[f.FileNum] = f
+		m.nextFileNum = max(m.nextFileNum, f.FileNum+1)
+	}
+
+	m.nextFileNum = max(m.nextFileNum, edit.NextFileNum)
+	m.logNum = max(m.logNum, edit.LogNum)
+	m.lastSeq = max(m.lastSeq, edit.LastSeq)
+}
+
+func (m *Manifest) liveFilesLocked() []FileMeta {
+	files := make([]FileMeta, 0, len(m.files))
+	for _, f := range m.files {
+		files = append(files, f)
+	}
+
+	slices.SortFunc(files, func(a, b FileMeta) int {
+		return cmp.Compare(a.FileNum, b.FileNum)
+	})
+
+	return files
+}
+
+func (m *Manifest) replay(content []byte) error {
+	off := 0
+	for off < len(content) {
+		if len(content)-off < lengthBytes {
+			// Torn tail, the edit was never acknowledged
+			return nil
+		}
+
+		length := int(binary.BigEndian.Uint32(content[off : off+lengthBytes]))
+		off += lengthBytes
+		if len(content)-off < length {
+			return nil
+		}
+
+		if length < crc32Bytes {
+			return fmt.Errorf("%w: record too short", ErrManifestCorrupted)
+		}
+
+		record := content[off : off+length]
+		off += length
+
+		payload := record[:length-crc32Bytes]
+		expectedCRC := binary.BigEndian.Uint32(record[length-crc32Bytes:])
+		if crc32.ChecksumIEEE(payload) != expectedCRC {
+			if off == len(content) {
+				return nil
+			}
+			return fmt.Errorf("%w: crc32 mismatch", ErrManifestCorrupted)
+		}
+
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrManifestCorrupted, err)
+		}
+
+		m.apply(edit)
+	}
+
+	return nil
+}
+
+// adoptSSTables builds the live set of a data directory written before the
+// manifest existed, from the tables found in it.
+func (m *Manifest) adoptSSTables() error {
+	dataDir := filepath.Join(m.path, SSTablesDir)
+	files, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	for _, file := range files {
+		level, fileNum, ok := parseSSTableFileName(file.Name())
+		if !ok {
+			continue
+		}
+		m.nextFileNum = max(m.nextFileNum, fileNum+1)
+
+		sstable, err := loadSSTable(dataDir, file.Name())
+		if errors.Is(err, errUnknownMagicNumber) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("load sstable %s: %w", file.Name(), err)
+		}
+
+		sstable.Level = level
+		sstable.FileNum = fileNum
+		m.files[fileNum] = sstable.fileMeta()
+	}
+
+	return nil
+}
+
+// writeSnapshot replaces the manifest with a single edit holding the live set
+// and keeps it open for appending.
+func (m *Manifest) writeSnapshot() error {
+	edit := &VersionEdit{
+		NextFileNum: m.nextFileNum,
+		LogNum:      m.logNum,
+		LastSeq:     m.lastSeq,
+		Added:       m.liveFilesLocked(),
+	}
+
+	tmpPath := filepath.Join(m.path, manifestTmpFileName)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	tmp, err := os.OpenFile(tmpPath, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("open tmp file: %w", err)
+	}
+
+	if _, err := tmp.Write(frameRecord(edit.encode())); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp file write: %w", err)
+	}
+
+	if err := syncFile(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("tmp file sync: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("tmp file close: %w", err)
+	}
+
+	p := filepath.Join(m.path, manifestFileName)
+	if err := os.Rename(tmpPath, p); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	if err := syncDir(m.path); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+	m.file = file
+
+	return nil
+}
+
+// removeOrphans deletes tables that are not live, left behind by flushes and
+// compactions that never got logged or by deletions that never happened.
+func (m *Manifest) removeOrphans() error {
+	dataDir := filepath.Join(m.path, SSTablesDir)
+	files, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
+
+	for _, file := range files {
+		level, fileNum, ok := parseSSTableFileName(file.Name())
+		if !ok {
+			continue
+		}
+
+		if f, live := m.files[fileNum]; live && f.Level == level {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dataDir, file.Name())); err != nil {
+			return fmt.Errorf("remove %s: %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// SyncHook, when set, runs before every fsync of a file or a directory with
+// its path, and fails the fsync with the error it returns. Tests set it to
+// check the order of fsyncs or to inject failures, while nothing is running.
+var SyncHook func(path string) error
+
+func syncFile(f *os.File) error {
+	if SyncHook != nil {
+		if err := SyncHook(f.Name()); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open dir: %w", err)
+	}
+
+	defer func() {
+		dErr := dir.Close()
+		guard.Assert(
+			dErr == nil,
+			"This raises only if it was already closed..",
+		)
+	}()
+
+	if err := syncFile(dir); err != nil {
+		return fmt.Errorf("dir sync: %w", err)
+	}
+
+	return nil
+}
+
+type versionEditTag byte
+
+const (
+	tagNextFileNum versionEditTag = 1
+	tagLogNum      versionEditTag = 2
+	tagDeletedFile versionEditTag = 3
+	tagAddedFile   versionEditTag = 4
+	tagLastSeq     versionEditTag = 5
+)
+
+func (e *VersionEdit) encode() []byte {
+	buf := make([]byte, 0)
+
+	buf = append(buf, byte(tagNextFileNum))
+	buf = binary.BigEndian.AppendUint64(buf, e.NextFileNum)
+
+	buf = append(buf, byte(tagLogNum))
+	buf = binary.BigEndian.AppendUint64(buf, e.LogNum)
+
+	buf = append(buf, byte(tagLastSeq))
+	buf = binary.BigEndian.AppendUint64(buf, e.LastSeq)
+
+	for _, f := range e.Deleted {
+		buf = append(buf, byte(tagDeletedFile))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(f.Level))
+		buf = binary.BigEndian.AppendUint64(buf, f.FileNum)
+	}
+
+	for _, f := range e.Added {
+		buf = append(buf, byte(tagAddedFile))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(f.Level))
+		buf = binary.BigEndian.AppendUint64(buf, f.FileNum)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(f.Size))
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Smallest)))
+		buf = append(buf, f.Smallest...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f.Largest)))
+		buf = append(buf, f.Largest...)
+	}
+
+	return buf
+}
+
+func decodeVersionEdit(buf []byte) (*VersionEdit, error) {
+	d := &editDecoder{buf: buf}
+	edit := &VersionEdit{}
+
+	for d.err == nil && d.off < len(d.buf) {
+		tag := versionEditTag(d.buf[d.off])
+		d.off++
+
+		switch tag {
+		case tagNextFileNum:
+			edit.NextFileNum = d.uint64()
+		case tagLogNum:
+			edit.LogNum = d.uint64()
+		case tagLastSeq:
+			edit.LastSeq = d.uint64()
+		case tagDeletedFile:
+			edit.Deleted = append(edit.Deleted, FileMeta{
+				Level:   int(d.uint32()),
+				FileNum: d.uint64(),
+			})
+		case tagAddedFile:
+			edit.Added = append(edit.Added, FileMeta{
+				Level:    int(d.uint32()),
+				FileNum:  d.uint64(),
+				Size:     int64(d.uint64()),
+				Smallest: d.string(),
+				Largest:  d.string(),
+			})
+		default:
+			return nil, fmt.Errorf("unknown tag %d", tag)
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return edit, nil
+}
+
+type editDecoder struct {
+	buf []byte
+	off int
+	err error
+}
+
+// next returns nil once the edit is exhausted.
+func (d *editDecoder) next(n int) []byte {
+	if d.err != nil || len(d.buf)-d.off < n {
+		d.err = errors.New("edit too short")
+		return nil
+	}
+
+	b := d.buf[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *editDecoder) uint32() uint32 {
+	b := d.next(uint32Bytes)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *editDecoder) uint64() uint64 {
+	b := d.next(uint64Bytes)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *editDecoder) string() string {
+	return string(d.next(int(d.uint32())))
+}
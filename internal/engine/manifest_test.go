@@ -0,0 +1,141 @@
+package engine_test
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newFilledMemTable(t *testing.T, from, to int) *engine.MemTable {
+	m, err := engine.NewMemTable(4, 50)
+	require.NoError(t, err)
+
+	for i := from; i < to; i++ {
+		require.NoError(t, m.Insert(uint64(i+1), fmt.Sprintf("key:%04d", i), []byte("value")))
+	}
+
+	return m
+}
+
+func TestManifest_SurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+
+	a := m.NewFileNum()
+	b := m.NewFileNum()
+	require.NoError(t, m.LogAndApply(&engine.VersionEdit{
+		Added: []engine.FileMeta{
+			{Level: 0, FileNum: a, Size: 10, Smallest: "a", Largest: "c"},
+			{Level: 0, FileNum: b, Size: 20, Smallest: "b", Largest: "d"},
+		},
+	}))
+
+	c := m.NewFileNum()
+	require.NoError(t, m.LogAndApply(&engine.VersionEdit{
+		LogNum:  3,
+		Added:   []engine.FileMeta{{Level: 1, FileNum: c, Size: 30, Smallest: "a", Largest: "d"}},
+		Deleted: []engine.FileMeta{{Level: 0, FileNum: a}, {Level: 0, FileNum: b}},
+	}))
+
+	// A file number handed out but never logged is not reused either
+	unlogged := m.NewFileNum()
+	require.NoError(t, m.LogAndApply(&engine.VersionEdit{}))
+	require.NoError(t, m.Close())
+
+	// Create the live file so that it is not taken for an orphan
+	name := fmt.Sprintf("%d.L1.sst", c)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, engine.SSTablesDir, name), nil, 0644))
+
+	m, err = engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.Equal(t, []engine.FileMeta{
+		{Level: 1, FileNum: c, Size: 30, Smallest: "a", Largest: "d"},
+	}, m.LiveFiles())
+	require.Equal(t, uint64(3), m.LogNum())
+	require.Greater(t, m.NewFileNum(), unlogged)
+}
+
+func TestManifest_IgnoresTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, m.LogAndApply(&engine.VersionEdit{
+		Added: []engine.FileMeta{{Level: 1, FileNum: m.NewFileNum(), Smallest: "a", Largest: "b"}},
+	}))
+	require.NoError(t, m.Close())
+
+	// An edit that was being appended when the process died
+	p := filepath.Join(dir, "MANIFEST")
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 40, 4, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, engine.SSTablesDir, "0.L1.sst"), nil, 0644))
+
+	m, err = engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.Len(t, m.LiveFiles(), 1)
+}
+
+func TestManifest_RemovesOrphans(t *testing.T) {
+	dir := t.TempDir()
+
+	_, s := flushMemTables(t, dir, []*engine.MemTable{newFilledMemTable(t, 0, 100)})
+	_, ok, err := s.Search("key:0042", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Written by a flush or a compaction that never got logged
+	orphan := filepath.Join(dir, engine.SSTablesDir, "99.sst")
+	require.NoError(t, os.WriteFile(orphan, []byte("half written"), 0644))
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.NoFileExists(t, orphan)
+	require.Len(t, m.LiveFiles(), 1)
+	require.Greater(t, m.NewFileNum(), m.LiveFiles()[0].FileNum)
+}
+
+func TestManifest_AdoptsSSTablesWithoutManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	flushMemTables(t, dir, []*engine.MemTable{
+		newFilledMemTable(t, 0, 100),
+		newFilledMemTable(t, 50, 150),
+	})
+
+	// A data directory from before the manifest existed
+	require.NoError(t, os.Remove(filepath.Join(dir, "MANIFEST")))
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	require.Len(t, m.LiveFiles(), 2)
+	require.Equal(t, uint64(2), m.NewFileNum())
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	for _, key := range []string{"key:0000", "key:0149"} {
+		_, ok, err := s.Search(key, math.MaxUint64)
+		require.NoError(t, err)
+		require.True(t, ok, key)
+	}
+}
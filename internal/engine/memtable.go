@@ -1,21 +1,54 @@
 package engine
 
 import (
-	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
 	"godb/internal/datastructures"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// MemTable keeps every version of a key. The skiplist orders versions by key
+// then by decreasing sequence number, so the versions of a key are ordered
+// newest first. Reads never block, they run alongside the writes.
 type MemTable struct {
-	sList  *datastructures.SkipList[[]byte]
-	frozen bool
+	// mu serializes writes with freezing
+	mu      sync.Mutex
+	sList   *datastructures.SkipList[memKey, memEntry]
+	frozen  bool
+	lastSeq atomic.Uint64
+	// dataByteSize is the size of the keys and values inserted, the
+	// skiplist accounts for its nodes
+	dataByteSize atomic.Int64
+	// arena, when set, holds a copy of the keys and values, guarded by mu
+	arena *datastructures.Arena
+}
+
+type memKey struct {
+	key string
+	seq uint64
+}
+
+func compareMemKeys(a, b memKey) int {
+	if c := strings.Compare(a.key, b.key); c != 0 {
+		return c
+	}
+
+	return cmp.Compare(b.seq, a.seq)
+}
+
+type memEntry struct {
+	value     []byte
+	tombstone bool
 }
 
 var ErrMemTableFrozen = errors.New("memtable is frozen")
 
 func NewMemTable(maxLevel, probability int) (*MemTable, error) {
-	sList, err := datastructures.NewSkipList[[]byte](maxLevel, probability)
+	sList, err := datastructures.NewSkipListFunc[memKey, memEntry](maxLevel, probability, compareMemKeys)
 	if err != nil {
 		return nil, fmt.Errorf("new skip list: %w", err)
 	}
@@ -23,40 +56,110 @@ func NewMemTable(maxLevel, probability int) (*MemTable, error) {
 	return &MemTable{sList: sList}, nil
 }
 
-func (m *MemTable) Insert(key string, value []byte) error {
+// NewArenaMemTable returns a memtable keeping its keys and values in an arena
+// of arenaChunkByteSize chunks and its skiplist nodes in slabs. A memtable
+// holding millions of entries is then a few thousand objects to the GC, all
+// freed together once the memtable is dropped. Inserted keys and values are
+// copied, the caller may reuse them.
+func NewArenaMemTable(maxLevel, probability, arenaChunkByteSize int) (*MemTable, error) {
+	nodesPerSlab := max(arenaChunkByteSize/memTableNodeEstimate, 16)
+	sList, err := datastructures.NewSkipListWithSlabs[memKey, memEntry](maxLevel, probability, compareMemKeys, nodesPerSlab)
+	if err != nil {
+		return nil, fmt.Errorf("new skip list: %w", err)
+	}
+
+	return &MemTable{sList: sList, arena: datastructures.NewArena(arenaChunkByteSize)}, nil
+}
+
+// memTableNodeEstimate is the size of a node with its key and value, to size
+// node slabs after the arena chunks
+const memTableNodeEstimate = 128
+
+// Insert adds a version of key written by seq.
+func (m *MemTable) Insert(seq uint64, key string, value []byte) error {
+	return m.insert(seq, key, memEntry{value: value})
+}
+
+// Delete adds a tombstone for key written by seq.
+func (m *MemTable) Delete(seq uint64, key string) error {
+	return m.insert(seq, key, memEntry{tombstone: true})
+}
+
+func (m *MemTable) insert(seq uint64, key string, e memEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if m.frozen {
 		return ErrMemTableFrozen
 	}
 
-	m.sList.Insert(key, value)
+	if m.arena != nil {
+		key = m.arena.CopyString(key)
+		e.value = m.arena.Copy(e.value)
+	}
+
+	if !m.sList.Insert(memKey{key: key, seq: seq}, e) {
+		m.dataByteSize.Add(int64(len(key) + len(e.value)))
+	}
+	if seq > m.lastSeq.Load() {
+		m.lastSeq.Store(seq)
+	}
 
 	return nil
 }
 
-func (m *MemTable) Delete(key string) error {
-	return m.Insert(key, tombstone)
-}
+// Search returns the newest version of key visible at seq.
+func (m *MemTable) Search(key string, seq uint64) ([]byte, bool, bool) {
+	it := m.sList.Seek(memKey{key: key, seq: seq})
+	if !it.Valid() || it.Key().key != key {
+		return nil, false, false
+	}
 
-func (m *MemTable) Search(key string) ([]byte, bool, bool) {
-	v, ok := m.sList.Search(key)
-	if ok && bytes.Equal(v, tombstone) {
+	e := it.Value()
+	if e.tombstone {
 		return []byte{}, true, false
 	}
 
-	return v, false, ok
+	return e.value, false, true
+}
+
+// LatestSeq returns the sequence number of the newest version of key,
+// tombstones included.
+func (m *MemTable) LatestSeq(key string) (uint64, bool) {
+	it := m.sList.Seek(memKey{key: key, seq: math.MaxUint64})
+	if !it.Valid() || it.Key().key != key {
+		return 0, false
+	}
+
+	return it.Key().seq, true
 }
 
 func (m *MemTable) Size() int {
-	return m.sList.ContentSize()
+	return m.sList.Len()
+}
+
+// ByteSize returns the approximate memory of the memtable: keys, values and
+// skiplist nodes.
+func (m *MemTable) ByteSize() int {
+	return m.sList.ByteSize() + int(m.dataByteSize.Load())
+}
+
+// LastSeq returns the highest sequence number inserted.
+func (m *MemTable) LastSeq() uint64 {
+	return m.lastSeq.Load()
 }
 
 func (m *MemTable) Freeze() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.frozen = true
 }
 
 type MemTableEntry struct {
 	Key       string
 	Value     []byte
+	Seq       uint64
 	Tombstone bool
 }
 
@@ -65,12 +168,63 @@ func (m *MemTable) Entries() []MemTableEntry {
 
 	for k, v := range m.sList.Iter {
 		entry := MemTableEntry{
-			Key:       k,
-			Value:     v,
-			Tombstone: bytes.Equal(v, tombstone),
+			Key:       k.key,
+			Value:     v.value,
+			Seq:       k.seq,
+			Tombstone: v.tombstone,
 		}
 		result = append(result, entry)
 	}
 
 	return result
 }
+
+// LiveEntries returns the entries a reader may still ask for: a version is
+// left out once a newer one of its key is visible at smallestSnapshot, and so
+// to every reader. Tombstones are kept, they hide older versions elsewhere.
+func (m *MemTable) LiveEntries(smallestSnapshot uint64) []MemTableEntry {
+	result := make([]MemTableEntry, 0)
+
+	// Versions of a key come newest first
+	var last *memKey
+	for k, v := range m.sList.Iter {
+		shadowed := last != nil && last.key == k.key && last.seq <= smallestSnapshot
+		last = &k
+		if shadowed {
+			continue
+		}
+
+		result = append(result, MemTableEntry{
+			Key:       k.key,
+			Value:     v.value,
+			Seq:       k.seq,
+			Tombstone: v.tombstone,
+		})
+	}
+
+	return result
+}
+
+type memTableIterator struct {
+	it *datastructures.SkipListIterator[memKey, memEntry]
+}
+
+func (m *MemTable) NewIterator() Iterator {
+	return &memTableIterator{it: m.sList.NewIterator()}
+}
+
+func (i *memTableIterator) Valid() bool     { return i.it.Valid() }
+func (i *memTableIterator) SeekToFirst()    { i.it.SeekToFirst() }
+func (i *memTableIterator) SeekToLast()     { i.it.SeekToLast() }
+func (i *memTableIterator) Seek(key string) { i.it.Seek(memKey{key: key, seq: math.MaxUint64}) }
+func (i *memTableIterator) Next()           { i.it.Next() }
+func (i *memTableIterator) Prev()           { i.it.Prev() }
+func (i *memTableIterator) Key() string     { return i.it.Key().key }
+func (i *memTableIterator) Value() []byte   { return i.it.Value().value }
+func (i *memTableIterator) Seq() uint64     { return i.it.Key().seq }
+func (i *memTableIterator) Err() error      { return nil }
+func (i *memTableIterator) Close() error    { return nil }
+
+func (i *memTableIterator) Tombstone() bool {
+	return i.it.Value().tombstone
+}
@@ -0,0 +1,144 @@
+package engine_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemTable_ArenaCopiesKeysAndValues(t *testing.T) {
+	mem, err := engine.NewArenaMemTable(12, 25, 1<<10)
+	require.NoError(t, err)
+
+	// The caller reuses its buffers, the memtable keeps what was inserted
+	key := []byte("key:0")
+	value := []byte("value:0")
+	for i := range 100 {
+		key[len(key)-1] = byte('0' + i%10)
+		value[len(value)-1] = byte('0' + i%10)
+		require.NoError(t, mem.Insert(uint64(i+1), string(key), value))
+	}
+	require.NoError(t, mem.Delete(101, "key:0"))
+	require.NoError(t, mem.Insert(102, "large", make([]byte, 4<<10)))
+
+	v, deleted, ok := mem.Search("key:0", math.MaxUint64)
+	require.True(t, deleted)
+	require.False(t, ok)
+	require.Empty(t, v)
+
+	for i := 1; i < 10; i++ {
+		v, _, ok = mem.Search(fmt.Sprintf("key:%d", i), math.MaxUint64)
+		require.True(t, ok)
+		require.Equal(t, fmt.Sprintf("value:%d", i), string(v))
+	}
+
+	v, _, ok = mem.Search("large", math.MaxUint64)
+	require.True(t, ok)
+	require.Len(t, v, 4<<10)
+
+	entries := mem.Entries()
+	require.Len(t, entries, 102)
+	require.Equal(t, "key:0", entries[0].Key)
+	require.True(t, entries[0].Tombstone)
+	require.Equal(t, uint64(101), entries[0].Seq)
+}
+
+func TestMemTable_LiveEntries(t *testing.T) {
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	for seq := uint64(1); seq <= 4; seq++ {
+		require.NoError(t, mem.Insert(seq, "a", []byte(fmt.Sprintf("value:%d", seq))))
+	}
+	require.NoError(t, mem.Delete(5, "b"))
+	require.NoError(t, mem.Insert(6, "c", []byte("value:6")))
+
+	type version struct {
+		key string
+		seq uint64
+	}
+	tests := []struct {
+		name             string
+		smallestSnapshot uint64
+		want             []version
+	}{
+		{name: "zero keeps every version", smallestSnapshot: 0, want: []version{{"a", 4}, {"a", 3}, {"a", 2}, {"a", 1}, {"b", 5}, {"c", 6}}},
+		{name: "snapshot in between", smallestSnapshot: 2, want: []version{{"a", 4}, {"a", 3}, {"a", 2}, {"b", 5}, {"c", 6}}},
+		{name: "no snapshot", smallestSnapshot: 6, want: []version{{"a", 4}, {"b", 5}, {"c", 6}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]version, 0)
+			for _, e := range mem.LiveEntries(tt.smallestSnapshot) {
+				got = append(got, version{e.Key, e.Seq})
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// BenchmarkMemTable_Insert fills memtables of a million entries the way the
+// database does, the write buffer keeping the last few alive, and reports
+// the GC pauses it causes along with the allocations.
+func BenchmarkMemTable_Insert(b *testing.B) {
+	const (
+		entriesPerMemTable = 1 << 20
+		liveMemTables      = 3
+	)
+
+	for _, bc := range []struct {
+		name        string
+		newMemTable func() (*engine.MemTable, error)
+	}{
+		{"heap", func() (*engine.MemTable, error) { return engine.NewMemTable(12, 25) }},
+		{"arena", func() (*engine.MemTable, error) { return engine.NewArenaMemTable(12, 25, 1<<20) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			key := make([]byte, 16)
+			value := make([]byte, 64)
+
+			live := make([]*engine.MemTable, 0, liveMemTables)
+			mem, err := bc.newMemTable()
+			require.NoError(b, err)
+
+			runtime.GC()
+			var before runtime.MemStats
+			runtime.ReadMemStats(&before)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				if mem.Size() == entriesPerMemTable {
+					if len(live) == liveMemTables {
+						live = live[1:]
+					}
+					live = append(live, mem)
+					mem, err = bc.newMemTable()
+					require.NoError(b, err)
+				}
+
+				binary.BigEndian.PutUint64(key, uint64(i)*0x9e3779b97f4a7c15)
+				binary.BigEndian.PutUint64(value, uint64(i))
+				// The heap memtable keeps the slices it is given
+				if bc.name == "heap" {
+					value = append([]byte(nil), value...)
+				}
+				if err := mem.Insert(uint64(i+1), string(key), value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			var after runtime.MemStats
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+			b.ReportMetric(float64(after.NumGC-before.NumGC), "gcs")
+			runtime.KeepAlive(live)
+		})
+	}
+}
@@ -1,14 +1,114 @@
 package engine
 
-var (
-	tombstone    = []byte("__TOMBSTONE__")
-	tombstoneLen = uint32(len(tombstone))
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrCorruption = errors.New("corruption")
+
+// Sections of a file, as reported by CorruptionError: the blocks and footer
+// of an SSTable, the records of a WAL segment.
+const (
+	sectionData        = "data block"
+	sectionIndex       = "index block"
+	sectionBloomFilter = "bloom filter block"
+	sectionProperties  = "properties block"
+	sectionFooter      = "footer"
+	sectionWALRecord   = "record"
+)
+
+// CorruptionError reports a part of a file, an SSTable block or a WAL
+// record, that does not match its checksum or can not be parsed. It matches
+// ErrCorruption.
+type CorruptionError struct {
+	File    string
+	Section string
+	Offset  int64
+	Reason  string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf(
+		"%v: %s at offset %d of %s: %s",
+		ErrCorruption, e.Section, e.Offset, e.File, e.Reason,
+	)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// EntryKind tells whether an entry sets its key or deletes it.
+type EntryKind uint8
+
+const (
+	KindValue EntryKind = iota
+	KindTombstone
+)
+
+// legacyTombstone is the value deletes were stored with before entries
+// carried a kind. Legacy tables still read it as a delete.
+var legacyTombstone = []byte("__TOMBSTONE__")
+
+const (
+	uint32Bytes          = 4
+	uint64Bytes          = 8
+	SSTablesDir          = "data"
+	SSTableFileSuffix    = ".sst"
+	SSTableFileSuffixLen = len(SSTableFileSuffix)
+	numLevels            = 7
 )
 
 const (
-	uint32Bytes                 = 4
-	DBMagicNumber        uint32 = 1337
-	SSTablesDir                 = "data"
-	SSTableFileSuffix           = ".sst"
-	SSTableFileSuffixLen        = len(SSTableFileSuffix)
+	// SSTableMagicNumber ends every table with a versioned footer, it reads
+	// "godb.sst" on disk.
+	SSTableMagicNumber uint64 = 0x7473732e62646f67
+	// SSTableFormatVersion is the layout of the tables being written: 64-bit
+	// offsets, a properties block, entries carrying a sequence number and a
+	// kind, and blocks ending with their compression type and a CRC32C.
+	SSTableFormatVersion uint32 = 1
+
+	// DBMagicNumber ends the legacy tables, written before the versioned
+	// footer, in a footer of 32-bit offsets. Their entries carry neither a
+	// sequence number nor a kind, they are read as if written before anything
+	// else, and their blocks no trailer.
+	DBMagicNumber uint32 = 1337
 )
+
+// sstableFileName names level 0 tables "<num>.sst" and deeper ones
+// "<num>.L<level>.sst". The manifest is what decides the level of a table,
+// the name only tells it apart at a glance.
+func sstableFileName(level int, fileNum uint64) string {
+	if level == 0 {
+		return fmt.Sprintf("%d%s", fileNum, SSTableFileSuffix)
+	}
+
+	return fmt.Sprintf("%d.L%d%s", fileNum, level, SSTableFileSuffix)
+}
+
+func parseSSTableFileName(name string) (int, uint64, bool) {
+	base, ok := strings.CutSuffix(name, SSTableFileSuffix)
+	if !ok {
+		return 0, 0, false
+	}
+
+	level := 0
+	num, levelStr, hasLevel := strings.Cut(base, ".L")
+	if hasLevel {
+		l, err := strconv.Atoi(levelStr)
+		if err != nil || l <= 0 || l >= numLevels {
+			return 0, 0, false
+		}
+		level = l
+	}
+
+	fileNum, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return level, fileNum, true
+}
@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Snapshot pins a sequence number. Reads through it ignore every later write
+// and compaction keeps the versions it can see.
+type Snapshot struct {
+	seq uint64
+}
+
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
+
+// SnapshotList tracks the live snapshots of a database.
+type SnapshotList struct {
+	lastSeq *atomic.Uint64
+
+	mu        sync.Mutex
+	snapshots map[*Snapshot]struct{}
+}
+
+// NewSnapshotList returns a list whose snapshots are taken at the value of
+// lastSeq, the sequence number of the last visible write.
+func NewSnapshotList(lastSeq *atomic.Uint64) *SnapshotList {
+	return &SnapshotList{
+		lastSeq:   lastSeq,
+		snapshots: make(map[*Snapshot]struct{}),
+	}
+}
+
+func (l *SnapshotList) New() *Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &Snapshot{seq: l.lastSeq.Load()}
+	l.snapshots[s] = struct{}{}
+	return s
+}
+
+func (l *SnapshotList) Release(s *Snapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.snapshots, s)
+}
+
+// Smallest returns the oldest sequence number a reader may still ask for,
+// the last sequence number when no snapshot is live. A snapshot taken later
+// can not see less than what is visible now.
+func (l *SnapshotList) Smallest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	smallest := l.lastSeq.Load()
+	for s := range l.snapshots {
+		smallest = min(smallest, s.seq)
+	}
+
+	return smallest
+}
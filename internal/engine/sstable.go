@@ -1,20 +1,42 @@
 package engine
 
 import (
+	"encoding/binary"
+	"fmt"
 	"godb/internal/datastructures"
+	"godb/internal/tooling/guard"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 const (
 	sharedKeyLenBytes      = uint32Bytes
 	unSharedKeyLenBytes    = uint32Bytes
 	valueLenBytes          = uint32Bytes
+	seqBytes               = uint64Bytes
+	kindBytes              = 1
 	restartTableLenBytes   = uint32Bytes
 	restartTableEntryBytes = uint32Bytes
 	indexKeyLenBytes       = uint32Bytes
-	indexOffsetBytes       = uint32Bytes
-	footerByteSize         = (5 * uint32Bytes)
+	indexOffsetBytes       = uint64Bytes
+	// footerByteSize holds the offsets and sizes of the index, the bloom
+	// filter and the properties, the format version and the magic number
+	footerByteSize = 6*uint64Bytes + uint32Bytes + uint64Bytes
+	// A block trailer is the compression type of the block followed by the
+	// CRC32C of both
+	blockTrailerBytes = 1 + crc32Bytes
 )
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// appendBlockTrailer appends the trailer of block, stored with compression.
+func appendBlockTrailer(block []byte, compression CompressionType) []byte {
+	block = append(block, byte(compression))
+	return binary.LittleEndian.AppendUint32(block, crc32.Checksum(block, castagnoli))
+}
+
 type (
 	SSTableDataBlock struct {
 		Entries         []*SSTableDataBlockEntry
@@ -24,25 +46,34 @@ type (
 		// Helper, Does not get written to file
 		EntriesByteSize  int
 		RestartTableSize int
+
+		// Encoded is the block as written to file, compressed and followed
+		// by its trailer
+		Encoded []byte
 	}
 	SSTableDataBlockEntry struct {
 		SharedKeyLen   uint32
 		UnsharedKeyLen uint32
 		ValueLen       uint32
+		Seq            uint64
+		Kind           EntryKind
 		KeySuffix      []byte
 		Value          []byte
 	}
 	SSTableIndexEntry struct {
 		KeyLen uint32
 		Key    []byte
-		Offset uint32
+		Offset uint64
 	}
 	SSTableFooter struct {
-		IndexOffset       uint32
-		IndexSize         uint32
-		BloomFilterOffset uint32
-		BloomFilterSize   uint32
-		MagicNumber       uint32
+		IndexOffset       uint64
+		IndexSize         uint64
+		BloomFilterOffset uint64
+		BloomFilterSize   uint64
+		PropertiesOffset  uint64
+		PropertiesSize    uint64
+		FormatVersion     uint32
+		MagicNumber       uint64
 	}
 )
 
@@ -50,26 +81,73 @@ type SSTableWrite struct {
 	Datablocks  []*SSTableDataBlock
 	Index       []*SSTableIndexEntry
 	BloomFilter *datastructures.BloomFilter
-	Footer      *SSTableFooter
+	// Properties are completed by the writer of the table, the size of
+	// their block is only known once they are
+	Properties *SSTableProperties
+	Footer     *SSTableFooter
 }
 
+// SSTableRead describes a table on disk, the table itself is read through the
+// TableCache.
 type SSTableRead struct {
-	FileName       string
-	Index          []SSTableIndexEntry
-	BloomFilter    *datastructures.BloomFilter
-	DataBlocksSize int
+	FileName string
+	FileNum  uint64
+	Level    int
+	Smallest string
+	Largest  string
+	Size     int64
+
+	// number of versions holding the table, guarded by SSTableSearcher.mu
+	refs int
 }
 
-func NewSSTableWriteFromMemTable(m *MemTable, datablockMaxEntriesByteSize int) *SSTableWrite {
-	// prefered Optimization over Readabillity to do only one loop incase we have million of entries
-	const restartInterval = 4
+func (s *SSTableRead) fileMeta() FileMeta {
+	return FileMeta{
+		Level:    s.Level,
+		FileNum:  s.FileNum,
+		Size:     s.Size,
+		Smallest: s.Smallest,
+		Largest:  s.Largest,
+	}
+}
+
+func (s *SSTableRead) contains(key string) bool {
+	return s.Smallest <= key && key <= s.Largest
+}
+
+// SSTableConfig holds the layout parameters of the SSTables being written.
+// Readers need none of them, every table describes its own layout.
+type SSTableConfig struct {
+	DatablockByteSize int
+	RestartInterval   int
+	BloomBitsPerKey   int
+	Compression       CompressionType
+}
+
+// NewSSTableWriteFromMemTable lays out the entries of m a reader at
+// smallestSnapshot or later may ask for, see MemTable.LiveEntries. Zero keeps
+// every version.
+func NewSSTableWriteFromMemTable(m *MemTable, smallestSnapshot uint64, config SSTableConfig) *SSTableWrite {
+	return NewSSTableWrite(m.LiveEntries(smallestSnapshot), config)
+}
 
-	entries := m.Entries()
+// NewSSTableWrite lays out sorted, non empty entries as an SSTable.
+func NewSSTableWrite(entries []MemTableEntry, config SSTableConfig) *SSTableWrite {
+	// prefered Optimization over Readabillity to do only one loop incase we have million of entries
+	datablockMaxEntriesByteSize := config.DatablockByteSize
+	restartInterval := config.RestartInterval
 
 	index := make([]*SSTableIndexEntry, 0)
 	bloomFilterSet := make(map[string]struct{})
 	datablocks := make([]*SSTableDataBlock, 0)
 
+	properties := &SSTableProperties{
+		Smallest:  entries[0].Key,
+		Largest:   entries[len(entries)-1].Key,
+		MinSeq:    entries[0].Seq,
+		CreatedAt: time.Now(),
+	}
+
 	previousKey := ""
 	currentDataBlock := &SSTableDataBlock{RestartTableSize: restartTableLenBytes}
 	currentDataBlock.RestartTable = make([]uint32, 0)
@@ -111,16 +189,12 @@ func NewSSTableWriteFromMemTable(m *MemTable, datablockMaxEntriesByteSize int) *
 		// Un Shared Key Length
 		unSharedKeyLen := uint32(len(entry.Key)) - sharedKeyLen
 
-		// Value Len
-		// Value
-		var valueLen uint32
-		var value []byte
+		// Kind, a tombstone has no value
+		kind := KindValue
+		value := entry.Value
 		if entry.Tombstone {
-			valueLen = tombstoneLen
-			value = tombstone
-		} else {
-			valueLen = uint32(len(entry.Value))
-			value = entry.Value
+			kind = KindTombstone
+			value = nil
 		}
 
 		// Key Suffix
@@ -129,50 +203,180 @@ func NewSSTableWriteFromMemTable(m *MemTable, datablockMaxEntriesByteSize int) *
 		dataBlockEntry := &SSTableDataBlockEntry{
 			SharedKeyLen:   sharedKeyLen,
 			UnsharedKeyLen: unSharedKeyLen,
-			ValueLen:       valueLen,
+			ValueLen:       uint32(len(value)),
+			Seq:            entry.Seq,
+			Kind:           kind,
 			KeySuffix:      keySuffix,
 			Value:          value,
 		}
 
+		properties.NumEntries++
+		if entry.Tombstone {
+			properties.NumTombstones++
+		}
+		properties.MinSeq = min(properties.MinSeq, entry.Seq)
+		properties.MaxSeq = max(properties.MaxSeq, entry.Seq)
+
 		currentDataBlock.Entries = append(currentDataBlock.Entries, dataBlockEntry)
 		bloomFilterSet[entry.Key] = struct{}{}
-		currentDataBlock.EntriesByteSize += sharedKeyLenBytes + unSharedKeyLenBytes + valueLenBytes + len(keySuffix) + len(value)
+		currentDataBlock.EntriesByteSize += sharedKeyLenBytes + unSharedKeyLenBytes + valueLenBytes + seqBytes + kindBytes + len(keySuffix) + len(value)
 		previousKey = entry.Key
 	}
 
 	offset := 0
 	indexSize := 0
 	for _, datablock := range datablocks {
+		datablock.Encoded = encodeDatablock(datablock, config.Compression)
+
 		key := datablock.Entries[0].KeySuffix
 		keyLen := len(key)
 
 		e := &SSTableIndexEntry{
 			KeyLen: uint32(keyLen),
 			Key:    datablock.Entries[0].KeySuffix,
-			Offset: uint32(offset),
+			Offset: uint64(offset),
 		}
 
 		index = append(index, e)
 		indexSize += indexKeyLenBytes + keyLen + indexOffsetBytes
-		offset += datablock.EntriesByteSize + datablock.RestartTableSize
+		offset += len(datablock.Encoded)
+
+		properties.RawDataByteSize += uint64(datablock.EntriesByteSize + datablock.RestartTableSize)
+		properties.DataByteSize += uint64(len(datablock.Encoded))
 	}
+	indexSize += blockTrailerBytes
 
 	indexOffset := offset
-	bloomFilter := datastructures.NewBloomFilterFromSet(7, uint32(len(bloomFilterSet)*10), bloomFilterSet)
+	bloomFilter := datastructures.NewBloomFilterFromSet(
+		bloomHashFuncs(config.BloomBitsPerKey),
+		uint32(max(len(bloomFilterSet)*config.BloomBitsPerKey, 64)),
+		bloomFilterSet,
+	)
 	bloomFilterOffset := indexOffset + indexSize
+	bloomFilterSize := bloomFilter.ByteSize() + blockTrailerBytes
 
 	footer := &SSTableFooter{
-		IndexOffset:       uint32(indexOffset),
-		IndexSize:         uint32(indexSize),
-		BloomFilterOffset: uint32(bloomFilterOffset),
-		BloomFilterSize:   uint32(bloomFilter.ByteSize()),
-		MagicNumber:       uint32(DBMagicNumber),
+		IndexOffset:       uint64(indexOffset),
+		IndexSize:         uint64(indexSize),
+		BloomFilterOffset: uint64(bloomFilterOffset),
+		BloomFilterSize:   uint64(bloomFilterSize),
+		PropertiesOffset:  uint64(bloomFilterOffset + bloomFilterSize),
+		FormatVersion:     SSTableFormatVersion,
+		MagicNumber:       SSTableMagicNumber,
 	}
 
 	return &SSTableWrite{
 		Datablocks:  datablocks,
 		BloomFilter: bloomFilter,
 		Index:       index,
+		Properties:  properties,
 		Footer:      footer,
 	}
 }
+
+// encodeDatablock returns the datablock as written to file.
+func encodeDatablock(datablock *SSTableDataBlock, compression CompressionType) []byte {
+	buf := make([]byte, 0, datablock.EntriesByteSize+datablock.RestartTableSize)
+
+	for _, entry := range datablock.Entries {
+		buf = binary.LittleEndian.AppendUint32(buf, entry.SharedKeyLen)
+		buf = binary.LittleEndian.AppendUint32(buf, entry.UnsharedKeyLen)
+		buf = binary.LittleEndian.AppendUint32(buf, entry.ValueLen)
+		buf = binary.LittleEndian.AppendUint64(buf, entry.Seq)
+		buf = append(buf, byte(entry.Kind))
+		buf = append(buf, entry.KeySuffix...)
+		buf = append(buf, entry.Value...)
+	}
+
+	for _, entry := range datablock.RestartTable {
+		buf = binary.LittleEndian.AppendUint32(buf, entry)
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, datablock.RestartTableLen)
+
+	buf, compression = compressBlock(buf, compression)
+	return appendBlockTrailer(buf, compression)
+}
+
+// bloomHashFuncs returns the number of hash functions minimizing the false
+// positive rate for bitsPerKey, bitsPerKey * ln(2).
+func bloomHashFuncs(bitsPerKey int) uint32 {
+	k := uint32(float64(bitsPerKey) * 0.69)
+	return min(max(k, 1), 30)
+}
+
+func writeSSTable(p string, sstable *SSTableWrite) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	file, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+
+	defer func() {
+		fErr := file.Close()
+		guard.Assert(
+			fErr == nil,
+			"This raises only if it was already closed..",
+		)
+	}()
+
+	for _, datablock := range sstable.Datablocks {
+		if _, err := file.Write(datablock.Encoded); err != nil {
+			return fmt.Errorf("file write datablock: %w", err)
+		}
+	}
+
+	buf := make([]byte, 0, sstable.Footer.IndexSize)
+	for _, entry := range sstable.Index {
+		buf = binary.LittleEndian.AppendUint32(buf, entry.KeyLen)
+		buf = append(buf, entry.Key...)
+		buf = binary.LittleEndian.AppendUint64(buf, entry.Offset)
+	}
+	buf = appendBlockTrailer(buf, NoCompression)
+
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("file write index: %w", err)
+	}
+
+	buf = make([]byte, 0, sstable.Footer.BloomFilterSize)
+	buf = append(buf, sstable.BloomFilter.BitArray...)
+	buf = binary.LittleEndian.AppendUint32(buf, sstable.BloomFilter.NumOfBits)
+	buf = binary.LittleEndian.AppendUint32(buf, sstable.BloomFilter.NumOfHashFuncs)
+	buf = appendBlockTrailer(buf, NoCompression)
+
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("file write bloomfilter: %w", err)
+	}
+
+	buf = appendBlockTrailer(sstable.Properties.encode(), NoCompression)
+	sstable.Footer.PropertiesSize = uint64(len(buf))
+
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("file write properties: %w", err)
+	}
+
+	buf = make([]byte, 0, footerByteSize)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.IndexOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.IndexSize)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.BloomFilterOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.BloomFilterSize)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.PropertiesOffset)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.PropertiesSize)
+	buf = binary.LittleEndian.AppendUint32(buf, sstable.Footer.FormatVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, sstable.Footer.MagicNumber)
+	if _, err := file.Write(buf); err != nil {
+		return fmt.Errorf("file write footer: %w", err)
+	}
+
+	if err := syncFile(file); err != nil {
+		return fmt.Errorf("file sync: %w", err)
+	}
+
+	// The table is only durable once its directory entry is, the manifest
+	// edit naming it must not reach the disk first
+	if err := syncDir(filepath.Dir(p)); err != nil {
+		return fmt.Errorf("sync dir: %w", err)
+	}
+
+	return nil
+}
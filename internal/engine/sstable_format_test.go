@@ -0,0 +1,131 @@
+package engine_test
+
+import (
+	"encoding/binary"
+	"godb/internal/datastructures"
+	"godb/internal/engine"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type legacyEntry struct {
+	key   string
+	value string
+}
+
+// writeLegacySSTable lays out entries the way tables ending with
+// DBMagicNumber were written: one data block, every entry a restart point.
+func writeLegacySSTable(t *testing.T, path string, entries []legacyEntry) {
+	block := make([]byte, 0)
+	restarts := make([]uint32, 0)
+	set := make(map[string]struct{})
+	for _, e := range entries {
+		restarts = append(restarts, uint32(len(block)))
+		block = binary.LittleEndian.AppendUint32(block, 0)
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(e.key)))
+		block = binary.LittleEndian.AppendUint32(block, uint32(len(e.value)))
+		block = append(block, e.key...)
+		block = append(block, e.value...)
+		set[e.key] = struct{}{}
+	}
+	for _, r := range restarts {
+		block = binary.LittleEndian.AppendUint32(block, r)
+	}
+	content := binary.LittleEndian.AppendUint32(block, uint32(len(restarts)))
+
+	indexOffset := len(content)
+	content = binary.LittleEndian.AppendUint32(content, uint32(len(entries[0].key)))
+	content = append(content, entries[0].key...)
+	content = binary.LittleEndian.AppendUint32(content, 0)
+
+	bloomOffset := len(content)
+	bloom := datastructures.NewBloomFilterFromSet(7, 64, set)
+	content = append(content, bloom.BitArray...)
+	content = binary.LittleEndian.AppendUint32(content, bloom.NumOfBits)
+	content = binary.LittleEndian.AppendUint32(content, bloom.NumOfHashFuncs)
+
+	footer := []uint32{
+		uint32(indexOffset),
+		uint32(bloomOffset - indexOffset),
+		uint32(bloomOffset),
+		uint32(len(content) - bloomOffset),
+		engine.DBMagicNumber,
+	}
+	for _, v := range footer {
+		content = binary.LittleEndian.AppendUint32(content, v)
+	}
+
+	require.NoError(t, os.WriteFile(path, content, 0644))
+}
+
+func TestSSTableFormat_ReadsLegacyTables(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, engine.SSTablesDir), 0755))
+
+	writeLegacySSTable(t, filepath.Join(dir, engine.SSTablesDir, "1.sst"), []legacyEntry{
+		{key: "a", value: "1"},
+		{key: "b", value: "__TOMBSTONE__"},
+		{key: "c", value: "3"},
+	})
+
+	// Without a manifest the table is adopted
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	v, ok, err := s.Search("a", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("1"), v)
+
+	_, ok, err = s.Search("b", math.MaxUint64)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// Entries without a sequence number read as written before anything else
+	seq, ok, err := s.LatestSeq("c")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), seq)
+}
+
+func TestSSTableFormat_VersionedFooter(t *testing.T) {
+	dir := t.TempDir()
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	require.NoError(t, mem.Insert(1, "key", []byte("value")))
+	flushMemTables(t, dir, []*engine.MemTable{mem})
+
+	files, err := filepath.Glob(filepath.Join(dir, engine.SSTablesDir, "*"+engine.SSTableFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+
+	require.Equal(t, "godb.sst", string(content[len(content)-8:]))
+	version := binary.LittleEndian.Uint32(content[len(content)-12:])
+	require.Equal(t, engine.SSTableFormatVersion, version)
+
+	// A table from a newer release is refused rather than misread
+	binary.LittleEndian.PutUint32(content[len(content)-12:], version+1)
+	require.NoError(t, os.WriteFile(files[0], content, 0644))
+
+	m, err := engine.OpenManifest(dir)
+	require.NoError(t, err)
+	defer m.Close()
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	_, _, err = s.Search("key", math.MaxUint64)
+	require.ErrorContains(t, err, "unknown format version")
+}
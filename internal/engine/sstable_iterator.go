@@ -0,0 +1,428 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// blockIterator walks the entries of a single data block. Keys are prefix
+// compressed against the previous entry, so seeking goes through the restart
+// table whose entries always carry the full key. Every length read from the
+// block is checked against it, a block read without checksum verification
+// may be corrupted.
+type blockIterator struct {
+	buf               []byte
+	restartTable      []uint32
+	restartTableStart int
+	// legacy blocks hold entries without sequence number nor kind
+	legacy bool
+
+	// offset is the start of the current entry, restartTableStart when the
+	// iterator is exhausted.
+	offset     int
+	nextOffset int
+	key        []byte
+	value      []byte
+	seq        uint64
+	tombstone  bool
+
+	// err is why the block can not be parsed, the iterator is invalid then
+	err error
+}
+
+var (
+	errRestartTableOutOfBounds = errors.New("restart table out of bounds")
+	errRestartOutOfBounds      = errors.New("restart point out of bounds")
+	errEntryOutOfBounds        = errors.New("entry out of bounds")
+	errSharedKeyTooLong        = errors.New("shared key longer than the previous key")
+)
+
+func newBlockIterator(buf []byte, legacy bool) (*blockIterator, error) {
+	if len(buf) < restartTableLenBytes {
+		return nil, errRestartTableOutOfBounds
+	}
+
+	restartTableLen := int(binary.LittleEndian.Uint32(buf[len(buf)-restartTableLenBytes:]))
+	if restartTableLen > (len(buf)-restartTableLenBytes)/restartTableEntryBytes {
+		return nil, errRestartTableOutOfBounds
+	}
+	restartTableStart := len(buf) - restartTableLenBytes - restartTableLen*restartTableEntryBytes
+
+	restartTable := make([]uint32, restartTableLen)
+	for i := range restartTable {
+		off := restartTableStart + i*restartTableEntryBytes
+		restartTable[i] = binary.LittleEndian.Uint32(buf[off : off+restartTableEntryBytes])
+		if int(restartTable[i]) >= restartTableStart {
+			return nil, errRestartOutOfBounds
+		}
+	}
+
+	return &blockIterator{
+		buf:               buf,
+		legacy:            legacy,
+		restartTable:      restartTable,
+		restartTableStart: restartTableStart,
+		offset:            restartTableStart,
+		nextOffset:        restartTableStart,
+	}, nil
+}
+
+func (b *blockIterator) Valid() bool {
+	return b.offset < b.restartTableStart
+}
+
+func (b *blockIterator) SeekToFirst() {
+	if len(b.restartTable) == 0 {
+		b.invalidate()
+		return
+	}
+
+	b.seekToRestart(0)
+	b.parseNext()
+}
+
+func (b *blockIterator) SeekToLast() {
+	if len(b.restartTable) == 0 {
+		b.invalidate()
+		return
+	}
+
+	b.seekToRestart(len(b.restartTable) - 1)
+	for b.parseNext() && b.nextOffset < b.restartTableStart {
+	}
+}
+
+func (b *blockIterator) Seek(key string) {
+	if len(b.restartTable) == 0 {
+		b.invalidate()
+		return
+	}
+
+	// Last restart point with a key strictly smaller than key. Duplicates of
+	// key may start in the restart before the first one equal to it.
+	searchPos := 0
+	low := 0
+	high := len(b.restartTable) - 1
+	for low <= high {
+		mid := low + (high-low)/2
+
+		restartKey, ok := b.restartKey(mid)
+		if !ok {
+			return
+		}
+
+		if string(restartKey) < key {
+			searchPos = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+
+	b.seekToRestart(searchPos)
+	for b.parseNext() {
+		if string(b.key) >= key {
+			return
+		}
+	}
+}
+
+func (b *blockIterator) Next() {
+	b.parseNext()
+}
+
+func (b *blockIterator) Prev() {
+	original := b.offset
+
+	restart := len(b.restartTable) - 1
+	for restart >= 0 && int(b.restartTable[restart]) >= original {
+		restart--
+	}
+
+	if restart < 0 {
+		b.invalidate()
+		return
+	}
+
+	b.seekToRestart(restart)
+	for b.parseNext() && b.nextOffset < original {
+	}
+}
+
+func (b *blockIterator) invalidate() {
+	b.offset = b.restartTableStart
+	b.nextOffset = b.restartTableStart
+}
+
+func (b *blockIterator) seekToRestart(i int) {
+	b.key = b.key[:0]
+	b.nextOffset = int(b.restartTable[i])
+}
+
+// fail invalidates the iterator for good, the block can not be parsed.
+func (b *blockIterator) fail(err error) {
+	b.err = err
+	b.invalidate()
+}
+
+// headerBytes is the size of the fixed part of an entry.
+func (b *blockIterator) headerBytes() int {
+	if b.legacy {
+		return sharedKeyLenBytes + unSharedKeyLenBytes + valueLenBytes
+	}
+
+	return sharedKeyLenBytes + unSharedKeyLenBytes + valueLenBytes + seqBytes + kindBytes
+}
+
+// restartKey returns the key of the i-th restart point, false when it is out
+// of the block.
+func (b *blockIterator) restartKey(i int) ([]byte, bool) {
+	offset := int(b.restartTable[i])
+	if offset+b.headerBytes() > b.restartTableStart {
+		b.fail(errEntryOutOfBounds)
+		return nil, false
+	}
+
+	unSharedKeyLen := int(binary.LittleEndian.Uint32(b.buf[offset+sharedKeyLenBytes:]))
+	offset += b.headerBytes()
+	if unSharedKeyLen > b.restartTableStart-offset {
+		b.fail(errEntryOutOfBounds)
+		return nil, false
+	}
+
+	return b.buf[offset : offset+unSharedKeyLen], true
+}
+
+func (b *blockIterator) parseNext() bool {
+	b.offset = b.nextOffset
+	if b.err != nil || b.offset >= b.restartTableStart {
+		b.invalidate()
+		return false
+	}
+
+	offset := b.offset
+	if offset+b.headerBytes() > b.restartTableStart {
+		b.fail(errEntryOutOfBounds)
+		return false
+	}
+
+	sharedKeyLen := binary.LittleEndian.Uint32(b.buf[offset : offset+sharedKeyLenBytes])
+	offset += sharedKeyLenBytes
+	unSharedKeyLen := int(binary.LittleEndian.Uint32(b.buf[offset : offset+unSharedKeyLenBytes]))
+	offset += unSharedKeyLenBytes
+	valueLen := int(binary.LittleEndian.Uint32(b.buf[offset : offset+valueLenBytes]))
+	offset += valueLenBytes
+
+	b.seq = 0
+	b.tombstone = false
+	if !b.legacy {
+		b.seq = binary.LittleEndian.Uint64(b.buf[offset : offset+seqBytes])
+		offset += seqBytes
+		b.tombstone = EntryKind(b.buf[offset]) == KindTombstone
+		offset += kindBytes
+	}
+
+	if int(sharedKeyLen) > len(b.key) {
+		b.fail(errSharedKeyTooLong)
+		return false
+	}
+	if unSharedKeyLen > b.restartTableStart-offset || valueLen > b.restartTableStart-offset-unSharedKeyLen {
+		b.fail(errEntryOutOfBounds)
+		return false
+	}
+
+	b.key = append(b.key[:sharedKeyLen], b.buf[offset:offset+unSharedKeyLen]...)
+	offset += unSharedKeyLen
+	b.value = b.buf[offset : offset+valueLen]
+	b.nextOffset = offset + valueLen
+	if b.legacy {
+		b.tombstone = bytes.Equal(b.value, legacyTombstone)
+	}
+
+	return true
+}
+
+// sstableIterator walks a whole SSTable, using the index to find the data
+// block for a key and reading one data block at a time.
+type sstableIterator struct {
+	table   *table
+	fileNum uint64
+
+	// cache is looked up before reading a data block, which is added to it
+	// when fillCache is set
+	cache     *BlockCache
+	fillCache bool
+
+	datablockIndex int
+	datablock      *blockIterator
+	err            error
+
+	// release is called on Close, when set
+	release func()
+}
+
+func newSSTableIterator(table *table, fileNum uint64, cache *BlockCache, fillCache bool) *sstableIterator {
+	return &sstableIterator{table: table, fileNum: fileNum, cache: cache, fillCache: fillCache}
+}
+
+func (s *sstableIterator) Valid() bool {
+	return s.datablock != nil && s.datablock.Valid()
+}
+
+func (s *sstableIterator) SeekToFirst() {
+	if s.loadDatablock(0) {
+		s.datablock.SeekToFirst()
+	}
+	s.skipEmptyDatablocksForward()
+}
+
+func (s *sstableIterator) SeekToLast() {
+	if s.loadDatablock(len(s.table.index) - 1) {
+		s.datablock.SeekToLast()
+	}
+	s.skipEmptyDatablocksBackward()
+}
+
+func (s *sstableIterator) Seek(key string) {
+	searchPos := 0
+	low := 0
+	high := len(s.table.index) - 1
+	for low <= high {
+		mid := low + (high-low)/2
+
+		if string(s.table.index[mid].Key) < key {
+			searchPos = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+
+	if s.loadDatablock(searchPos) {
+		s.datablock.Seek(key)
+	}
+	s.skipEmptyDatablocksForward()
+}
+
+// Next and Prev leave an iterator that ran off the table invalid.
+func (s *sstableIterator) Next() {
+	if s.datablock == nil {
+		return
+	}
+
+	s.datablock.Next()
+	s.skipEmptyDatablocksForward()
+}
+
+func (s *sstableIterator) Prev() {
+	if s.datablock == nil {
+		return
+	}
+
+	s.datablock.Prev()
+	s.skipEmptyDatablocksBackward()
+}
+
+func (s *sstableIterator) Key() string {
+	return string(s.datablock.key)
+}
+
+func (s *sstableIterator) Value() []byte {
+	return s.datablock.value
+}
+
+func (s *sstableIterator) Seq() uint64 {
+	return s.datablock.seq
+}
+
+func (s *sstableIterator) Tombstone() bool {
+	return s.datablock.tombstone
+}
+
+func (s *sstableIterator) Err() error {
+	return s.err
+}
+
+func (s *sstableIterator) Close() error {
+	if s.release != nil {
+		s.release()
+	}
+
+	return nil
+}
+
+func (s *sstableIterator) skipEmptyDatablocksForward() {
+	for s.datablock != nil && !s.datablock.Valid() {
+		if s.corrupted() {
+			return
+		}
+		if !s.loadDatablock(s.datablockIndex + 1) {
+			return
+		}
+		s.datablock.SeekToFirst()
+	}
+}
+
+func (s *sstableIterator) skipEmptyDatablocksBackward() {
+	for s.datablock != nil && !s.datablock.Valid() {
+		if s.corrupted() {
+			return
+		}
+		if !s.loadDatablock(s.datablockIndex - 1) {
+			return
+		}
+		s.datablock.SeekToLast()
+	}
+}
+
+// corrupted reports whether the data block could not be parsed, which stops
+// the iterator with the error.
+func (s *sstableIterator) corrupted() bool {
+	if s.datablock.err == nil {
+		return false
+	}
+
+	offset, _ := s.table.datablockBounds(s.datablockIndex)
+	s.err = s.table.corruption(sectionData, int64(offset), s.datablock.err.Error())
+	s.datablock = nil
+	return true
+}
+
+func (s *sstableIterator) loadDatablock(i int) bool {
+	if i < 0 || i >= len(s.table.index) {
+		s.datablock = nil
+		return false
+	}
+
+	if s.datablock != nil && s.datablockIndex == i {
+		return true
+	}
+
+	offset, size := s.table.datablockBounds(i)
+	buf, ok := s.cache.Get(s.fileNum, uint64(offset))
+	if !ok {
+		var err error
+		buf, err = s.table.readBlock(sectionData, int64(offset), size, s.table.verifyChecksums)
+		if err != nil {
+			s.err = err
+			s.datablock = nil
+			return false
+		}
+	}
+
+	datablock, err := newBlockIterator(buf, s.table.legacy)
+	if err != nil {
+		s.err = s.table.corruption(sectionData, int64(offset), err.Error())
+		s.datablock = nil
+		return false
+	}
+
+	if !ok && s.fillCache {
+		s.cache.Insert(s.fileNum, uint64(offset), buf)
+	}
+
+	s.datablock = datablock
+	s.datablockIndex = i
+	return true
+}
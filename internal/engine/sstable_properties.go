@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// SSTableProperties describe the content of an SSTable. Tables written
+// before they existed have none.
+type SSTableProperties struct {
+	Smallest      string
+	Largest       string
+	NumEntries    uint64
+	NumTombstones uint64
+	// RawDataByteSize is the size of the data blocks before compression,
+	// DataByteSize the one on disk
+	RawDataByteSize uint64
+	DataByteSize    uint64
+	MinSeq          uint64
+	MaxSeq          uint64
+	CreatedAt       time.Time
+	// CreatedBy names the component that wrote the table
+	CreatedBy string
+}
+
+const (
+	CreatedByFlush      = "flush"
+	CreatedByCompaction = "compaction"
+)
+
+// Properties are stored as a list of names each followed by a value, both
+// prefixed by their uvarint length, numbers as uvarint. Readers skip the
+// names they do not know, so that properties can be added freely.
+const (
+	propSmallest        = "smallest"
+	propLargest         = "largest"
+	propNumEntries      = "num.entries"
+	propNumTombstones   = "num.tombstones"
+	propRawDataByteSize = "raw.data.size"
+	propDataByteSize    = "data.size"
+	propMinSeq          = "min.seq"
+	propMaxSeq          = "max.seq"
+	propCreatedAt       = "created.at"
+	propCreatedBy       = "created.by"
+)
+
+var errPropertiesTruncated = errors.New("properties truncated")
+
+func (p *SSTableProperties) encode() []byte {
+	buf := make([]byte, 0, 128+len(p.Smallest)+len(p.Largest))
+
+	appendBytes := func(name string, value []byte) {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		buf = append(buf, value...)
+	}
+	appendUint := func(name string, value uint64) {
+		appendBytes(name, binary.AppendUvarint(nil, value))
+	}
+
+	appendBytes(propSmallest, []byte(p.Smallest))
+	appendBytes(propLargest, []byte(p.Largest))
+	appendUint(propNumEntries, p.NumEntries)
+	appendUint(propNumTombstones, p.NumTombstones)
+	appendUint(propRawDataByteSize, p.RawDataByteSize)
+	appendUint(propDataByteSize, p.DataByteSize)
+	appendUint(propMinSeq, p.MinSeq)
+	appendUint(propMaxSeq, p.MaxSeq)
+	appendUint(propCreatedAt, uint64(p.CreatedAt.UnixNano()))
+	appendBytes(propCreatedBy, []byte(p.CreatedBy))
+
+	return buf
+}
+
+func decodeSSTableProperties(buf []byte) (*SSTableProperties, error) {
+	next := func() ([]byte, error) {
+		n, l := binary.Uvarint(buf)
+		if l <= 0 || n > uint64(len(buf)-l) {
+			return nil, errPropertiesTruncated
+		}
+
+		b := buf[l : l+int(n)]
+		buf = buf[l+int(n):]
+		return b, nil
+	}
+
+	p := &SSTableProperties{}
+	for len(buf) > 0 {
+		name, err := next()
+		if err != nil {
+			return nil, err
+		}
+		value, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		var number uint64
+		switch string(name) {
+		case propSmallest, propLargest, propCreatedBy:
+		default:
+			var l int
+			number, l = binary.Uvarint(value)
+			if l <= 0 {
+				// Not a number, a property of a later release
+				continue
+			}
+		}
+
+		switch string(name) {
+		case propSmallest:
+			p.Smallest = string(value)
+		case propLargest:
+			p.Largest = string(value)
+		case propNumEntries:
+			p.NumEntries = number
+		case propNumTombstones:
+			p.NumTombstones = number
+		case propRawDataByteSize:
+			p.RawDataByteSize = number
+		case propDataByteSize:
+			p.DataByteSize = number
+		case propMinSeq:
+			p.MinSeq = number
+		case propMaxSeq:
+			p.MaxSeq = number
+		case propCreatedAt:
+			p.CreatedAt = time.Unix(0, int64(number))
+		case propCreatedBy:
+			p.CreatedBy = string(value)
+		}
+	}
+
+	return p, nil
+}
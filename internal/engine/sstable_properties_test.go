@@ -0,0 +1,96 @@
+package engine_test
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSTableProperties_DescribeTable(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now()
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	value := []byte(strings.Repeat("value", 20))
+	for i := range 100 {
+		require.NoError(t, mem.Insert(uint64(i+10), fmt.Sprintf("key:%04d", i), value))
+	}
+	require.NoError(t, mem.Delete(110, "key:0000"))
+	require.NoError(t, mem.Delete(111, "key:0100"))
+	config := testSSTableConfig
+	config.Compression = engine.LZCompression
+	_, s := flushMemTablesWithConfig(t, dir, config, []*engine.MemTable{mem})
+	defer s.Close()
+
+	properties, err := s.Properties()
+	require.NoError(t, err)
+	require.Len(t, properties, 1)
+
+	p := properties[0]
+	require.Equal(t, "key:0000", p.Smallest)
+	require.Equal(t, "key:0100", p.Largest)
+	require.Equal(t, uint64(102), p.NumEntries)
+	require.Equal(t, uint64(2), p.NumTombstones)
+	require.Equal(t, uint64(10), p.MinSeq)
+	require.Equal(t, uint64(111), p.MaxSeq)
+	require.Greater(t, p.RawDataByteSize, uint64(0))
+	require.Less(t, p.DataByteSize, p.RawDataByteSize)
+	require.Equal(t, engine.CreatedByFlush, p.CreatedBy)
+	require.False(t, p.CreatedAt.Before(before.Truncate(time.Second)))
+
+	// A reader older than every entry of the table finds nothing in it
+	_, ok, err := s.Search("key:0050", 9)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	v, ok, err := s.Search("key:0050", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, value, v)
+}
+
+func TestSSTableProperties_PruneIterators(t *testing.T) {
+	dir := t.TempDir()
+
+	memTables := make([]*engine.MemTable, 0)
+	seq := uint64(0)
+	for round := range 6 {
+		mem, err := engine.NewMemTable(12, 25)
+		require.NoError(t, err)
+		for i := range 20 {
+			seq++
+			require.NoError(t, mem.Insert(seq, fmt.Sprintf("key:%d:%04d", round, i), []byte("value")))
+		}
+		memTables = append(memTables, mem)
+	}
+	m, _ := flushMemTables(t, dir, memTables)
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	for _, tc := range []struct {
+		lower, upper string
+		expected     int
+	}{
+		{"", "", 6},
+		{"key:2", "key:3", 1},
+		{"key:2:0019", "key:4", 2},
+		{"key:9", "", 0},
+		{"", "key:0", 0},
+	} {
+		its, err := s.NewIterators(tc.lower, tc.upper)
+		require.NoError(t, err)
+		require.Len(t, its, tc.expected, "[%q, %q)", tc.lower, tc.upper)
+
+		for _, it := range its {
+			require.NoError(t, it.Close())
+		}
+	}
+}
@@ -1,26 +1,40 @@
 package engine
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"godb/internal/datastructures"
 	"godb/internal/tooling/guard"
+	"math"
 	"os"
 	"path/filepath"
 	"slices"
-	"strconv"
+	"sync"
 )
 
 type SSTableSearcher struct {
-	path     string
-	sstables []SSTableRead
+	path       string
+	manifest   *Manifest
+	tableCache *TableCache
+	blockCache *BlockCache
+
+	mu      sync.Mutex
+	version *version
 }
 
-func NewSSTableSearcher(dbpath string) *SSTableSearcher {
+var errUnknownMagicNumber = errors.New("unknown magic number")
+
+// NewSSTableSearcher returns a searcher over the tables of the manifest,
+// keeping up to maxOpenFiles of them open. Without verifyChecksums data
+// blocks are read without checking their checksum. blockCache may be nil.
+func NewSSTableSearcher(dbpath string, manifest *Manifest, maxOpenFiles int, verifyChecksums bool, blockCache *BlockCache) *SSTableSearcher {
 	p := filepath.Join(dbpath, SSTablesDir)
-	return &SSTableSearcher{path: p, sstables: make([]SSTableRead, 0)}
+	return &SSTableSearcher{
+		path:       p,
+		manifest:   manifest,
+		tableCache: NewTableCache(p, maxOpenFiles, verifyChecksums),
+		blockCache: blockCache,
+		version:    &version{refs: 1},
+	}
 }
 
 func (s *SSTableSearcher) Start() error {
@@ -31,215 +45,332 @@ func (s *SSTableSearcher) Start() error {
 	return nil
 }
 
+// loadSSTables installs the tables the manifest lists as live, which are only
+// opened once read. Any other file in the directory is ignored.
 func (s *SSTableSearcher) loadSSTables() error {
-	files, err := os.ReadDir(s.path)
+	var levels [numLevels][]*SSTableRead
+	for _, f := range s.manifest.LiveFiles() {
+		levels[f.Level] = append(levels[f.Level], &SSTableRead{
+			FileName: sstableFileName(f.Level, f.FileNum),
+			FileNum:  f.FileNum,
+			Level:    f.Level,
+			Smallest: f.Smallest,
+			Largest:  f.Largest,
+			Size:     f.Size,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.installLocked(levels)
+
+	return nil
+}
+
+// loadSSTable reads the description of a table from its file.
+func loadSSTable(dir, fname string) (*SSTableRead, error) {
+	t, err := openTable(filepath.Join(dir, fname), true)
 	if err != nil {
-		return fmt.Errorf("read dir: %w", err)
+		return nil, err
 	}
 
-	for _, file := range files {
-		fInfo, err := file.Info()
-		if err != nil {
-			return fmt.Errorf("file info: %w", err)
-		}
+	defer func() {
+		fErr := t.file.Close()
+		guard.Assert(
+			fErr == nil,
+			"This raises only if it was already closed..",
+		)
+	}()
 
-		fname := fInfo.Name()
+	fInfo, err := t.file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("file stat: %w", err)
+	}
 
-		if len(fname) < 3 || fname[len(fname)-SSTableFileSuffixLen:] != SSTableFileSuffix {
-			continue
-		}
+	if p := t.properties; p != nil {
+		return &SSTableRead{
+			FileName: fname,
+			Smallest: p.Smallest,
+			Largest:  p.Largest,
+			Size:     fInfo.Size(),
+		}, nil
+	}
 
-		fsize := fInfo.Size()
-		fpath := filepath.Join(s.path, fname)
-		f, err := os.Open(fpath)
-		if err != nil {
-			return fmt.Errorf("file open: %w", err)
-		}
+	// Without properties the first key of a table is the first index key, the
+	// last one is only known by reading the last data block
+	it := newSSTableIterator(t, 0, nil, false)
+	it.SeekToLast()
+	if it.Err() != nil {
+		return nil, fmt.Errorf("last key: %w", it.Err())
+	}
+	if !it.Valid() {
+		return nil, errors.New("sstable without entries")
+	}
 
-		if fsize < footerByteSize {
-			return errors.New("file size smaller than footer size")
-		}
+	return &SSTableRead{
+		FileName: fname,
+		Smallest: string(t.index[0].Key),
+		Largest:  it.Key(),
+		Size:     fInfo.Size(),
+	}, nil
+}
 
-		var buf []byte
+// Properties returns the properties of every live table, level by level,
+// nil for the tables written before tables carried them.
+func (s *SSTableSearcher) Properties() ([]*SSTableProperties, error) {
+	v := s.acquire()
+	defer s.release(v)
+
+	properties := make([]*SSTableProperties, 0)
+	for _, sstables := range v.levels {
+		for _, sstable := range sstables {
+			h, err := s.tableCache.acquire(sstable)
+			if err != nil {
+				return nil, fmt.Errorf("open table %s: %w", sstable.FileName, err)
+			}
 
-		footerOffset := fsize - footerByteSize
-		buf = make([]byte, footerByteSize)
-		if _, err = f.ReadAt(buf, footerOffset); err != nil {
-			return fmt.Errorf("file footer read at: %w", err)
+			properties = append(properties, h.table.properties)
+			s.tableCache.release(h)
 		}
+	}
 
-		indexOffset := binary.LittleEndian.Uint32(buf[:4])
-		indexSize := binary.LittleEndian.Uint32(buf[4:8])
-		bloomFilterOffset := binary.LittleEndian.Uint32(buf[8:12])
-		bloomFilterSize := binary.LittleEndian.Uint32(buf[12:16])
-		magicNumber := binary.LittleEndian.Uint32(buf[16:20])
+	return properties, nil
+}
 
-		if magicNumber != DBMagicNumber {
-			continue
-		}
+// Close closes the open tables, once every iterator is closed.
+func (s *SSTableSearcher) Close() error {
+	return s.tableCache.Close()
+}
 
-		index := make([]SSTableIndexEntry, 0)
+func (s *SSTableSearcher) NumOpenTables() int {
+	return s.tableCache.NumOpen()
+}
 
-		buf = make([]byte, indexSize)
-		if _, err = f.ReadAt(buf, int64(indexOffset)); err != nil {
-			return fmt.Errorf("file index read at: %w", err)
-		}
+func (s *SSTableSearcher) BlockCacheStats() BlockCacheStats {
+	return s.blockCache.Stats()
+}
 
-		off := 0
-		for off < int(indexSize) {
-			keyLen := binary.LittleEndian.Uint32(buf[off : off+uint32Bytes])
-			off += uint32Bytes
-			key := buf[off : off+int(keyLen)]
-			off += int(keyLen)
-			offset := binary.LittleEndian.Uint32(buf[off : off+uint32Bytes])
-			off += uint32Bytes
-
-			index = append(index, SSTableIndexEntry{
-				KeyLen: keyLen,
-				Key:    key,
-				Offset: offset,
-			})
-		}
+func (s *SSTableSearcher) NumFilesAtLevel(level int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		off = int(bloomFilterSize)
-		buf = make([]byte, bloomFilterSize)
-		if _, err = f.ReadAt(buf, int64(bloomFilterOffset)); err != nil {
-			return fmt.Errorf("file bloomfilter read at: %w", err)
-		}
+	return len(s.version.levels[level])
+}
 
-		numOfHashFuncs := binary.LittleEndian.Uint32(buf[off-uint32Bytes:])
-		off -= uint32Bytes
-		numOfBits := binary.LittleEndian.Uint32(buf[off-uint32Bytes : off])
-		off -= uint32Bytes
-		bitArray := buf[:off]
+// acquire returns the current version, which keeps its tables on disk until
+// it is released.
+func (s *SSTableSearcher) acquire() *version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		bloomFilter := datastructures.NewBloomFilter(numOfHashFuncs, numOfBits, bitArray)
+	s.version.refs++
+	return s.version
+}
 
-		sstable := &SSTableRead{
-			FileName:       fInfo.Name(),
-			Index:          index,
-			BloomFilter:    bloomFilter,
-			DataBlocksSize: int(indexOffset),
-		}
-		s.sstables = append(s.sstables, *sstable)
+func (s *SSTableSearcher) release(v *version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if err := f.Close(); err != nil {
-			return fmt.Errorf("file close: %w", err)
+	s.unrefLocked(v)
+}
+
+// addFlushed publishes a freshly flushed level 0 table to readers.
+func (s *SSTableSearcher) addFlushed(sstable *SSTableRead) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var levels [numLevels][]*SSTableRead
+	for level, sstables := range s.version.levels {
+		levels[level] = slices.Clone(sstables)
+	}
+	levels[0] = append(levels[0], sstable)
+
+	s.installLocked(levels)
+}
+
+// applyCompaction atomically replaces the compacted tables with their outputs.
+func (s *SSTableSearcher) applyCompaction(inputs, outputs []*SSTableRead) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var levels [numLevels][]*SSTableRead
+	for level, sstables := range s.version.levels {
+		for _, sstable := range sstables {
+			if !slices.Contains(inputs, sstable) {
+				levels[level] = append(levels[level], sstable)
+			}
 		}
 	}
 
-	slices.SortFunc(s.sstables, func(a, b SSTableRead) int {
-		aName, err := strconv.Atoi(a.FileName[:len(a.FileName)-SSTableFileSuffixLen])
-		guard.Assert(err == nil, "should always be convertable")
-		bName, err := strconv.Atoi(b.FileName[:len(b.FileName)-SSTableFileSuffixLen])
-		guard.Assert(err == nil, "should always be convertable")
+	for _, sstable := range outputs {
+		levels[sstable.Level] = append(levels[sstable.Level], sstable)
+	}
 
-		switch {
-		case aName > bName:
-			return -1
-		case bName < aName:
-			return 1
-		default:
-			return 0
+	s.installLocked(levels)
+}
+
+func (s *SSTableSearcher) installLocked(levels [numLevels][]*SSTableRead) {
+	sortLevels(&levels)
+
+	v := &version{levels: levels, refs: 1}
+	for _, sstables := range v.levels {
+		for _, sstable := range sstables {
+			sstable.refs++
 		}
-	})
+	}
 
-	return nil
+	old := s.version
+	s.version = v
+	s.unrefLocked(old)
 }
 
-func (s *SSTableSearcher) Search(key string) ([]byte, bool, error) {
-	k := []byte(key)
-	for _, sstable := range s.sstables {
-		if ok := sstable.BloomFilter.Contains(k); !ok {
-			continue
+// unrefLocked drops a reference to v. Once no version holds a table anymore
+// its file is deleted.
+func (s *SSTableSearcher) unrefLocked(v *version) {
+	v.refs--
+	if v.refs > 0 {
+		return
+	}
+
+	for _, sstables := range v.levels {
+		for _, sstable := range sstables {
+			sstable.refs--
+			if sstable.refs == 0 {
+				// Best effort, there is nothing a reader could do about it
+				s.tableCache.evict(sstable.FileNum)
+				s.blockCache.EvictFile(sstable.FileNum)
+				os.Remove(filepath.Join(s.path, sstable.FileName))
+			}
 		}
+	}
+}
+
+// Search returns the newest version of key visible at seq.
+func (s *SSTableSearcher) Search(key string, seq uint64) ([]byte, bool, error) {
+	v := s.acquire()
+	defer s.release(v)
 
-		fpath := filepath.Join(s.path, sstable.FileName)
-		f, err := os.Open(fpath)
+	for _, sstable := range v.candidates(key) {
+		entry, found, err := s.searchSSTable(sstable, key, seq)
 		if err != nil {
-			return nil, false, fmt.Errorf("open file: %w", err)
+			return nil, false, err
 		}
 
-		searchPos := 0
-		low := 0
-		high := len(sstable.Index) - 1
+		switch {
+		case found && entry.Tombstone:
+			return nil, false, nil
+		case found:
+			return entry.Value, true, nil
+		}
+	}
 
-		for low <= high {
-			mid := low + (high-low)/2
+	return nil, false, nil
+}
 
-			if string(sstable.Index[mid].Key) <= key {
-				searchPos = mid
-				low = mid + 1
-			} else {
-				high = mid - 1
-			}
-		}
+// LatestSeq returns the sequence number of the newest version of key,
+// tombstones included.
+func (s *SSTableSearcher) LatestSeq(key string) (uint64, bool, error) {
+	v := s.acquire()
+	defer s.release(v)
 
-		datablockOffset := int(sstable.Index[searchPos].Offset)
-		datablockSize := 0
-		if searchPos == len(sstable.Index)-1 {
-			datablockSize = sstable.DataBlocksSize - datablockOffset
-		} else {
-			nextDatablockOffset := sstable.Index[searchPos+1].Offset
-			datablockSize = int(nextDatablockOffset) - datablockOffset
+	for _, sstable := range v.candidates(key) {
+		entry, found, err := s.searchSSTable(sstable, key, math.MaxUint64)
+		if err != nil {
+			return 0, false, err
 		}
 
-		buf := make([]byte, datablockSize)
-		if _, err := f.ReadAt(buf, int64(datablockOffset)); err != nil {
-			return nil, false, fmt.Errorf("open file: %w", err)
+		if found {
+			return entry.Seq, true, nil
 		}
+	}
 
-		restartTableLen := int(binary.LittleEndian.Uint32(buf[len(buf)-uint32Bytes:]))
+	return 0, false, nil
+}
 
-		restartTable := make([]uint32, restartTableLen)
-		offset := datablockSize - uint32Bytes
-		for i := restartTableLen - 1; i >= 0; i-- {
-			res := binary.LittleEndian.Uint32(buf[offset-uint32Bytes : offset])
-			restartTable[i] = res
-			offset -= uint32Bytes
+// searchSSTable returns the newest entry of the table for key visible at seq,
+// tombstones included.
+func (s *SSTableSearcher) searchSSTable(sstable *SSTableRead, key string, seq uint64) (MemTableEntry, bool, error) {
+	h, err := s.tableCache.acquire(sstable)
+	if err != nil {
+		return MemTableEntry{}, false, fmt.Errorf("open table %s: %w", sstable.FileName, err)
+	}
+	defer s.tableCache.release(h)
+
+	// Every entry of the table is newer than what the reader may see
+	if p := h.table.properties; p != nil && p.MinSeq > seq {
+		return MemTableEntry{}, false, nil
+	}
+
+	if ok := h.table.bloomFilter.Contains([]byte(key)); !ok {
+		return MemTableEntry{}, false, nil
+	}
+
+	it := newSSTableIterator(h.table, sstable.FileNum, s.blockCache, true)
+	for it.Seek(key); it.Valid() && it.Key() == key; it.Next() {
+		if it.Seq() <= seq {
+			return MemTableEntry{
+				Key:       key,
+				Value:     it.Value(),
+				Seq:       it.Seq(),
+				Tombstone: it.Tombstone(),
+			}, true, nil
 		}
-		restartTableStart := offset
-
-		searchOffset := 0
-		low = 0
-		high = len(restartTable) - 1
-		for low <= high {
-			mid := low + (high-low)/2
-
-			keyOffset := int(restartTable[mid])
-			offset := keyOffset + uint32Bytes
-			unSharedKeylen := binary.LittleEndian.Uint32(buf[offset : offset+uint32Bytes])
-			offset += 2 * uint32Bytes
-			KeySuffix := buf[offset : offset+int(unSharedKeylen)]
-
-			if string(KeySuffix) <= key {
-				searchOffset = mid
-				low = mid + 1
-			} else {
-				high = mid - 1
+	}
+
+	if err := it.Err(); err != nil {
+		return MemTableEntry{}, false, err
+	}
+
+	return MemTableEntry{}, false, nil
+}
+
+// NewIterators opens an iterator per SSTable that may hold keys within
+// [lower, upper), newest table first. Empty bounds are unbounded. The tables
+// stay on disk until every iterator is closed.
+func (s *SSTableSearcher) NewIterators(lower, upper string) ([]Iterator, error) {
+	v := s.acquire()
+	defer s.release(v)
+
+	iterators := make([]Iterator, 0)
+	for _, sstables := range v.levels {
+		for _, sstable := range sstables {
+			if sstable.Largest < lower || (upper != "" && sstable.Smallest >= upper) {
+				continue
 			}
-		}
 
-		offset = int(restartTable[searchOffset])
-		previousKey := []byte("")
-		for offset < restartTableStart {
-			sharedKeyLen := binary.LittleEndian.Uint32(buf[offset : offset+uint32Bytes])
-			offset += uint32Bytes
-			unSharedKeylen := binary.LittleEndian.Uint32(buf[offset : offset+uint32Bytes])
-			offset += uint32Bytes
-			valueLen := binary.LittleEndian.Uint32(buf[offset : offset+uint32Bytes])
-			offset += uint32Bytes
-			keySuffix := buf[offset : offset+int(unSharedKeylen)]
-			offset += int(unSharedKeylen)
-			currentKey := append(previousKey[:sharedKeyLen], keySuffix...)
-			if bytes.Equal(currentKey, k) {
-				value := buf[offset : offset+int(valueLen)]
-				return value, !bytes.Equal(value, tombstone), nil
+			it, err := s.newIterator(v, sstable, true)
+			if err != nil {
+				for _, it := range iterators {
+					it.Close()
+				}
+				return nil, err
 			}
-			previousKey = currentKey
-			offset += int(valueLen)
+
+			iterators = append(iterators, it)
 		}
 	}
 
-	return nil, false, nil
+	return iterators, nil
+}
+
+// newIterator opens an iterator over sstable that holds a reference to v
+// until closed. Without fillCache the blocks it reads are not cached, for
+// reads that would only push hot blocks out.
+func (s *SSTableSearcher) newIterator(v *version, sstable *SSTableRead, fillCache bool) (Iterator, error) {
+	h, err := s.tableCache.acquire(sstable)
+	if err != nil {
+		return nil, fmt.Errorf("open table %s: %w", sstable.FileName, err)
+	}
+
+	s.mu.Lock()
+	v.refs++
+	s.mu.Unlock()
+
+	it := newSSTableIterator(h.table, sstable.FileNum, s.blockCache, fillCache)
+	it.release = func() {
+		s.tableCache.release(h)
+		s.release(v)
+	}
+
+	return it, nil
 }
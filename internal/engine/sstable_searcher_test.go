@@ -1,20 +1,143 @@
 package engine_test
 
 import (
+	"encoding/binary"
+	"fmt"
 	"godb/internal/engine"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
 func TestLoad(t *testing.T) {
-	s := engine.NewSSTableSearcher("../../db")
-	err := s.Start()
+	mem, err := engine.NewMemTable(3, 50)
 	require.NoError(t, err)
-	val, ok, err := s.Search("user:1:email")
+	for i := range 20 {
+		require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("user:%d:email", i), []byte("user@example.com")))
+	}
+
+	_, s := flushMemTables(t, t.TempDir(), []*engine.MemTable{mem})
+	val, ok, err := s.Search("user:1:email", math.MaxUint64)
 	require.NoError(t, err)
 	require.NotNil(t, val)
 	require.True(t, ok)
+}
+
+func TestSearch_DetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+	for i := range 100 {
+		require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("key:%04d", i), []byte("value")))
+	}
+	m, _ := flushMemTables(t, dir, []*engine.MemTable{mem})
+
+	// Flip a byte of the first data block, past the first entry header
+	files, err := filepath.Glob(filepath.Join(dir, engine.SSTablesDir, "*"+engine.SSTableFileSuffix))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	p := files[0]
+	content, err := os.ReadFile(p)
+	require.NoError(t, err)
+	content[20] ^= 0xff
+	require.NoError(t, os.WriteFile(p, content, 0644))
+
+	s := engine.NewSSTableSearcher(dir, m, 100, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+
+	_, _, err = s.Search("key:0000", math.MaxUint64)
+	require.ErrorIs(t, err, engine.ErrCorruption)
+
+	var corruption *engine.CorruptionError
+	require.ErrorAs(t, err, &corruption)
+	require.Equal(t, filepath.Base(p), corruption.File)
+	require.Equal(t, "data block", corruption.Section)
+	require.Equal(t, int64(0), corruption.Offset)
+
+	its, err := s.NewIterators("", "")
+	require.NoError(t, err)
+	its[0].SeekToFirst()
+	require.False(t, its[0].Valid())
+	require.ErrorIs(t, its[0].Err(), engine.ErrCorruption)
+	require.NoError(t, its[0].Close())
+
+	// Blocks past the corrupted one are still readable
+	_, ok, err := s.Search("key:0099", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Without verification the block is read as is
+	unverified := engine.NewSSTableSearcher(dir, m, 100, false, nil)
+	require.NoError(t, unverified.Start())
+	defer unverified.Close()
+	_, _, err = unverified.Search("key:0000", math.MaxUint64)
+	require.NoError(t, err)
+
+	// The index and the bloom filter are verified regardless
+	content[len(content)-30] ^= 0xff
+	require.NoError(t, os.WriteFile(p, content, 0644))
+	fresh := engine.NewSSTableSearcher(dir, m, 100, false, nil)
+	require.NoError(t, fresh.Start())
+	defer fresh.Close()
+	_, _, err = fresh.Search("key:0099", math.MaxUint64)
+	require.ErrorAs(t, err, &corruption)
+	require.NotEqual(t, "data block", corruption.Section)
+}
+
+func TestSearch_ReportsUnparsableBlocks(t *testing.T) {
+	tests := []struct {
+		name string
+		// field is the offset of a uint32 of the first entry, set to a
+		// length out of the block
+		field int
+	}{
+		{name: "shared key length", field: 0},
+		{name: "unshared key length", field: 4},
+		{name: "value length", field: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			mem, err := engine.NewMemTable(12, 25)
+			require.NoError(t, err)
+			for i := range 100 {
+				require.NoError(t, mem.Insert(uint64(i+1), fmt.Sprintf("key:%04d", i), []byte("value")))
+			}
+			m, _ := flushMemTables(t, dir, []*engine.MemTable{mem})
+
+			files, err := filepath.Glob(filepath.Join(dir, engine.SSTablesDir, "*"+engine.SSTableFileSuffix))
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+			content, err := os.ReadFile(files[0])
+			require.NoError(t, err)
+			binary.LittleEndian.PutUint32(content[tt.field:], math.MaxUint32)
+			require.NoError(t, os.WriteFile(files[0], content, 0644))
+
+			// Read without verification the block is parsed as is, and found
+			// corrupted rather than read out of bounds
+			s := engine.NewSSTableSearcher(dir, m, 100, false, nil)
+			require.NoError(t, s.Start())
+			defer s.Close()
+
+			_, _, err = s.Search("key:0000", math.MaxUint64)
+			var corruption *engine.CorruptionError
+			require.ErrorAs(t, err, &corruption)
+			require.Equal(t, "data block", corruption.Section)
+			require.Equal(t, int64(0), corruption.Offset)
 
-	print("S")
+			its, err := s.NewIterators("", "")
+			require.NoError(t, err)
+			for its[0].SeekToLast(); its[0].Valid(); its[0].Prev() {
+			}
+			require.ErrorIs(t, its[0].Err(), engine.ErrCorruption)
+			require.NoError(t, its[0].Close())
+		})
+	}
 }
@@ -1,8 +1,8 @@
 package engine_test
 
 import (
-	_ "context"
 	"godb/internal/engine"
+	"math"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -12,52 +12,83 @@ func TestMemTableToSSTable(t *testing.T) {
 	mem, err := engine.NewMemTable(3, 50)
 	require.NoError(t, err)
 
-	mem.Insert("apple", []byte("fruit"))
-	mem.Insert("apricot", []byte("fruit"))
-	mem.Insert("apricotpie", []byte("dessert"))
-	mem.Insert("banana", []byte("fruit"))
-	mem.Insert("berry", []byte("fruit"))
-	mem.Insert("blueberry", []byte("fruit"))
-	mem.Insert("blackberry", []byte("fruit"))
-	mem.Insert("cherry", []byte("fruit"))
-	mem.Insert("cranberry", []byte("fruit"))
-	mem.Insert("date", []byte("fruit"))
-	mem.Insert("dragonfruit", []byte("fruit"))
-	mem.Insert("elderberry", []byte("fruit"))
-	mem.Insert("fig", []byte("fruit"))
-	mem.Insert("grape", []byte("new fruit"))
-	mem.Insert("grape", []byte("fruit"))
-	mem.Insert("grape", []byte("old fruit"))
-	mem.Insert("grapefruit", []byte("fruit"))
-	mem.Insert("kiwi", []byte("fruit"))
-	mem.Insert("kumquat", []byte("fruit"))
-	mem.Insert("lemon", []byte("fruit"))
-	mem.Insert("lime", []byte("fruit"))
-	mem.Insert("mango", []byte("fruit"))
-	mem.Insert("nectarine", []byte("fruit"))
-	mem.Insert("orange", []byte("fruit"))
-	mem.Insert("papaya", []byte("fruit"))
-	mem.Insert("peach", []byte("fruit"))
-	mem.Delete("apple")
-	mem.Insert("pear", []byte("fruit"))
-	mem.Insert("pineapple", []byte("fruit"))
-	mem.Insert("plum", []byte("fruit"))
-	mem.Insert("pomegranate", []byte("fruit"))
-	mem.Insert("raspberry", []byte("fruit"))
-	mem.Insert("strawberry", []byte("fruit"))
-
-	// f := engine.NewFlusher("../../db", 3, 1000)
-	// err = f.Start(context.Background())
-	// require.NoError(t, err)
-	// f.EnqueueToBeFlushed(mem)
-
-	s := engine.NewSSTableSearcher("../../db")
-	err = s.Start()
-	require.NoError(t, err)
-	val, _, err := s.Search("apple")
-	require.NoError(t, err)
-	require.Equal(t, val, []byte("__TOMBSTONE__"))
-
-	// err = f.Stop()
+	mem.Insert(1, "apple", []byte("fruit"))
+	mem.Insert(2, "apricot", []byte("fruit"))
+	mem.Insert(3, "apricotpie", []byte("dessert"))
+	mem.Insert(4, "banana", []byte("fruit"))
+	mem.Insert(5, "berry", []byte("fruit"))
+	mem.Insert(6, "blueberry", []byte("fruit"))
+	mem.Insert(7, "blackberry", []byte("fruit"))
+	mem.Insert(8, "cherry", []byte("fruit"))
+	mem.Insert(9, "cranberry", []byte("fruit"))
+	mem.Insert(10, "date", []byte("fruit"))
+	mem.Insert(11, "dragonfruit", []byte("fruit"))
+	mem.Insert(12, "elderberry", []byte("fruit"))
+	mem.Insert(13, "fig", []byte("fruit"))
+	mem.Insert(14, "grape", []byte("new fruit"))
+	mem.Insert(15, "grape", []byte("fruit"))
+	mem.Insert(16, "grape", []byte("old fruit"))
+	mem.Insert(17, "grapefruit", []byte("fruit"))
+	mem.Insert(18, "kiwi", []byte("fruit"))
+	mem.Insert(19, "kumquat", []byte("fruit"))
+	mem.Insert(20, "lemon", []byte("fruit"))
+	mem.Insert(21, "lime", []byte("fruit"))
+	mem.Insert(22, "mango", []byte("fruit"))
+	mem.Insert(23, "nectarine", []byte("fruit"))
+	mem.Insert(24, "orange", []byte("fruit"))
+	mem.Insert(25, "papaya", []byte("fruit"))
+	mem.Insert(26, "peach", []byte("fruit"))
+	mem.Delete(27, "apple")
+	mem.Insert(28, "pear", []byte("fruit"))
+	mem.Insert(29, "pineapple", []byte("fruit"))
+	mem.Insert(30, "plum", []byte("fruit"))
+	mem.Insert(31, "pomegranate", []byte("fruit"))
+	mem.Insert(32, "raspberry", []byte("fruit"))
+	mem.Insert(33, "strawberry", []byte("fruit"))
+
+	_, s := flushMemTables(t, t.TempDir(), []*engine.MemTable{mem})
+	_, ok, err := s.Search("apple", math.MaxUint64)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	val, ok, err := s.Search("grape", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("old fruit"), val)
+}
+
+func TestMemTableToSSTable_StoresTombstoneLookalike(t *testing.T) {
+	mem, err := engine.NewMemTable(12, 25)
+	require.NoError(t, err)
+
+	require.NoError(t, mem.Insert(1, "deleted", []byte("value")))
+	require.NoError(t, mem.Delete(2, "deleted"))
+	require.NoError(t, mem.Insert(3, "literal", []byte("__TOMBSTONE__")))
+	require.NoError(t, mem.Insert(4, "empty", []byte{}))
+
+	v, deleted, ok := mem.Search("literal", math.MaxUint64)
+	require.False(t, deleted)
+	require.True(t, ok)
+	require.Equal(t, []byte("__TOMBSTONE__"), v)
+
+	_, s := flushMemTables(t, t.TempDir(), []*engine.MemTable{mem})
+
+	v, ok, err = s.Search("literal", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("__TOMBSTONE__"), v)
+
+	v, ok, err = s.Search("empty", math.MaxUint64)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Empty(t, v)
+
+	_, ok, err = s.Search("deleted", math.MaxUint64)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	v, ok, err = s.Search("deleted", 1)
 	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []byte("value"), v)
 }
@@ -0,0 +1,403 @@
+package engine
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"godb/internal/datastructures"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// table is an open SSTable, its file along with the parsed index and bloom
+// filter.
+type table struct {
+	name           string
+	file           *os.File
+	index          []SSTableIndexEntry
+	bloomFilter    *datastructures.BloomFilter
+	dataBlocksSize int
+	// legacy is set for tables ending with DBMagicNumber, whose entries carry
+	// no sequence number nor kind and whose blocks carry no trailer
+	legacy          bool
+	verifyChecksums bool
+
+	// properties is nil for legacy tables
+	properties *SSTableProperties
+}
+
+// openTable opens the table at fpath. The index and the bloom filter are
+// always verified, verifyChecksums only decides for data blocks.
+func openTable(fpath string, verifyChecksums bool) (*table, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("file open: %w", err)
+	}
+
+	t := &table{name: filepath.Base(fpath), file: f, verifyChecksums: verifyChecksums}
+	if err := t.parse(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *table) parse() error {
+	fInfo, err := t.file.Stat()
+	if err != nil {
+		return fmt.Errorf("file stat: %w", err)
+	}
+
+	footer, err := t.readFooter(fInfo.Size())
+	if err != nil {
+		return err
+	}
+
+	indexOffset := footer.indexOffset
+	if min(indexOffset, footer.indexSize, footer.bloomFilterOffset, footer.bloomFilterSize) < 0 ||
+		min(footer.propertiesOffset, footer.propertiesSize) < 0 ||
+		indexOffset+footer.indexSize > footer.bloomFilterOffset ||
+		footer.bloomFilterOffset+footer.bloomFilterSize > footer.offset ||
+		footer.propertiesOffset+footer.propertiesSize > footer.offset {
+		return t.corruption(sectionFooter, footer.offset, "sections out of bounds")
+	}
+
+	buf, err := t.readBlock(sectionIndex, indexOffset, int(footer.indexSize), true)
+	if err != nil {
+		return err
+	}
+
+	index := make([]SSTableIndexEntry, 0)
+	off := 0
+	for off < len(buf) {
+		if off+uint32Bytes > len(buf) {
+			return t.corruption(sectionIndex, indexOffset, "truncated entry")
+		}
+		keyLen := binary.LittleEndian.Uint32(buf[off : off+uint32Bytes])
+		off += uint32Bytes
+		if off+int(keyLen)+footer.indexOffsetBytes > len(buf) {
+			return t.corruption(sectionIndex, indexOffset, "truncated entry")
+		}
+		key := buf[off : off+int(keyLen)]
+		off += int(keyLen)
+
+		var offset uint64
+		if footer.indexOffsetBytes == uint64Bytes {
+			offset = binary.LittleEndian.Uint64(buf[off : off+uint64Bytes])
+		} else {
+			offset = uint64(binary.LittleEndian.Uint32(buf[off : off+uint32Bytes]))
+		}
+		off += footer.indexOffsetBytes
+
+		if offset >= uint64(indexOffset) || (len(index) > 0 && offset <= index[len(index)-1].Offset) {
+			return t.corruption(sectionIndex, indexOffset, "data block offset out of order")
+		}
+
+		index = append(index, SSTableIndexEntry{
+			KeyLen: keyLen,
+			Key:    key,
+			Offset: offset,
+		})
+	}
+
+	if len(index) == 0 {
+		return errors.New("sstable without entries")
+	}
+
+	buf, err = t.readBlock(sectionBloomFilter, footer.bloomFilterOffset, int(footer.bloomFilterSize), true)
+	if err != nil {
+		return err
+	}
+	if len(buf) < 2*uint32Bytes {
+		return t.corruption(sectionBloomFilter, footer.bloomFilterOffset, "truncated bloom filter")
+	}
+
+	off = len(buf)
+	numOfHashFuncs := binary.LittleEndian.Uint32(buf[off-uint32Bytes:])
+	off -= uint32Bytes
+	numOfBits := binary.LittleEndian.Uint32(buf[off-uint32Bytes : off])
+	off -= uint32Bytes
+	bitArray := buf[:off]
+
+	if footer.propertiesSize > 0 {
+		buf, err = t.readBlock(sectionProperties, footer.propertiesOffset, int(footer.propertiesSize), true)
+		if err != nil {
+			return err
+		}
+
+		t.properties, err = decodeSSTableProperties(buf)
+		if err != nil {
+			return t.corruption(sectionProperties, footer.propertiesOffset, err.Error())
+		}
+	}
+
+	t.index = index
+	t.bloomFilter = datastructures.NewBloomFilter(numOfHashFuncs, numOfBits, bitArray)
+	t.dataBlocksSize = int(indexOffset)
+
+	return nil
+}
+
+// tableFooter locates the sections of a table, whatever its format.
+type tableFooter struct {
+	offset            int64
+	indexOffset       int64
+	indexSize         int64
+	bloomFilterOffset int64
+	bloomFilterSize   int64
+	propertiesOffset  int64
+	propertiesSize    int64
+	indexOffsetBytes  int
+}
+
+// Legacy tables end with five uint32: the offsets and sizes of the index and
+// the bloom filter and DBMagicNumber.
+const legacyFooterByteSize = 5 * uint32Bytes
+
+var errUnknownFormatVersion = errors.New("unknown format version")
+
+// readFooter reads the footer of a table of fsize bytes and sets the layout
+// of the table accordingly.
+func (t *table) readFooter(fsize int64) (tableFooter, error) {
+	if fsize < legacyFooterByteSize {
+		return tableFooter{}, t.corruption(sectionFooter, 0, "file size smaller than footer size")
+	}
+
+	tail := make([]byte, min(fsize, footerByteSize))
+	if _, err := t.file.ReadAt(tail, fsize-int64(len(tail))); err != nil {
+		return tableFooter{}, fmt.Errorf("file footer read at: %w", err)
+	}
+
+	if binary.LittleEndian.Uint64(tail[len(tail)-uint64Bytes:]) == SSTableMagicNumber {
+		if len(tail) < footerByteSize {
+			return tableFooter{}, t.corruption(sectionFooter, 0, "file size smaller than footer size")
+		}
+
+		if version := binary.LittleEndian.Uint32(tail[len(tail)-uint64Bytes-uint32Bytes:]); version != SSTableFormatVersion {
+			return tableFooter{}, fmt.Errorf("%w %d", errUnknownFormatVersion, version)
+		}
+
+		return tableFooter{
+			offset:            fsize - footerByteSize,
+			indexOffset:       int64(binary.LittleEndian.Uint64(tail[0:8])),
+			indexSize:         int64(binary.LittleEndian.Uint64(tail[8:16])),
+			bloomFilterOffset: int64(binary.LittleEndian.Uint64(tail[16:24])),
+			bloomFilterSize:   int64(binary.LittleEndian.Uint64(tail[24:32])),
+			propertiesOffset:  int64(binary.LittleEndian.Uint64(tail[32:40])),
+			propertiesSize:    int64(binary.LittleEndian.Uint64(tail[40:48])),
+			indexOffsetBytes:  uint64Bytes,
+		}, nil
+	}
+
+	buf := tail[len(tail)-legacyFooterByteSize:]
+	if binary.LittleEndian.Uint32(buf[16:20]) != DBMagicNumber {
+		return tableFooter{}, errUnknownMagicNumber
+	}
+	t.legacy = true
+
+	return tableFooter{
+		offset:            fsize - legacyFooterByteSize,
+		indexOffset:       int64(binary.LittleEndian.Uint32(buf[0:4])),
+		indexSize:         int64(binary.LittleEndian.Uint32(buf[4:8])),
+		bloomFilterOffset: int64(binary.LittleEndian.Uint32(buf[8:12])),
+		bloomFilterSize:   int64(binary.LittleEndian.Uint32(buf[12:16])),
+		indexOffsetBytes:  uint32Bytes,
+	}, nil
+}
+
+// readBlock reads the block of section at offset and returns its content,
+// decompressed and checked against its checksum when verify is set.
+func (t *table) readBlock(section string, offset int64, size int, verify bool) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := t.file.ReadAt(buf, offset); err != nil {
+		return nil, fmt.Errorf("file %s read at: %w", section, err)
+	}
+
+	if t.legacy {
+		return buf, nil
+	}
+
+	if size < blockTrailerBytes {
+		return nil, t.corruption(section, offset, "block smaller than its trailer")
+	}
+
+	// The checksum covers the compression type
+	checked := buf[:size-crc32Bytes]
+	expected := binary.LittleEndian.Uint32(buf[size-crc32Bytes:])
+	if verify && crc32.Checksum(checked, castagnoli) != expected {
+		return nil, t.corruption(section, offset, "checksum mismatch")
+	}
+
+	compression := CompressionType(checked[len(checked)-1])
+	block, err := decompressBlock(checked[:len(checked)-1], compression)
+	if err != nil {
+		return nil, t.corruption(section, offset, fmt.Sprintf("decompress %v: %v", compression, err))
+	}
+
+	return block, nil
+}
+
+func (t *table) corruption(section string, offset int64, reason string) error {
+	return &CorruptionError{File: t.name, Section: section, Offset: offset, Reason: reason}
+}
+
+// datablockBounds returns the file offset and byte size of the i-th data
+// block, trailer included.
+func (t *table) datablockBounds(i int) (int, int) {
+	offset := int(t.index[i].Offset)
+	if i == len(t.index)-1 {
+		return offset, t.dataBlocksSize - offset
+	}
+
+	return offset, int(t.index[i+1].Offset) - offset
+}
+
+// TableCache keeps SSTables open across reads. Tables in use are never
+// closed, the least recently used idle ones are once more than maxOpenFiles
+// tables are open.
+type TableCache struct {
+	dir             string
+	maxOpenFiles    int
+	verifyChecksums bool
+
+	mu      sync.Mutex
+	handles map[uint64]*tableHandle
+	idle    *list.List // handles without references, most recently used first
+}
+
+type tableHandle struct {
+	fileNum uint64
+	table   *table
+
+	// guarded by TableCache.mu
+	refs    int
+	elem    *list.Element
+	evicted bool
+}
+
+func NewTableCache(dir string, maxOpenFiles int, verifyChecksums bool) *TableCache {
+	return &TableCache{
+		dir:             dir,
+		maxOpenFiles:    maxOpenFiles,
+		verifyChecksums: verifyChecksums,
+		handles:         make(map[uint64]*tableHandle),
+		idle:            list.New(),
+	}
+}
+
+// acquire returns the open table of sstable, which stays open until
+// released.
+func (c *TableCache) acquire(sstable *SSTableRead) (*tableHandle, error) {
+	c.mu.Lock()
+	if h, ok := c.handles[sstable.FileNum]; ok {
+		c.refLocked(h)
+		c.mu.Unlock()
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	// Opened without the lock, a concurrent open of the same table loses
+	t, err := openTable(filepath.Join(c.dir, sstable.FileName), c.verifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h, ok := c.handles[sstable.FileNum]; ok {
+		t.file.Close()
+		c.refLocked(h)
+		return h, nil
+	}
+
+	h := &tableHandle{fileNum: sstable.FileNum, table: t, refs: 1}
+	c.handles[sstable.FileNum] = h
+	c.closeExcessLocked()
+
+	return h, nil
+}
+
+func (c *TableCache) release(h *tableHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h.refs--
+	if h.refs > 0 {
+		return
+	}
+
+	if h.evicted {
+		h.table.file.Close()
+		return
+	}
+
+	h.elem = c.idle.PushFront(h)
+	c.closeExcessLocked()
+}
+
+func (c *TableCache) refLocked(h *tableHandle) {
+	if h.refs == 0 {
+		c.idle.Remove(h.elem)
+		h.elem = nil
+	}
+	h.refs++
+}
+
+func (c *TableCache) closeExcessLocked() {
+	for len(c.handles) > c.maxOpenFiles && c.idle.Len() > 0 {
+		h := c.idle.Remove(c.idle.Back()).(*tableHandle)
+		delete(c.handles, h.fileNum)
+		h.table.file.Close()
+	}
+}
+
+// evict closes the table of fileNum once nobody uses it anymore, before its
+// file is deleted.
+func (c *TableCache) evict(fileNum uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.handles[fileNum]
+	if !ok {
+		return
+	}
+	delete(c.handles, fileNum)
+
+	if h.refs > 0 {
+		h.evicted = true
+		return
+	}
+
+	c.idle.Remove(h.elem)
+	h.table.file.Close()
+}
+
+// NumOpen returns the number of open tables.
+func (c *TableCache) NumOpen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.handles)
+}
+
+// Close closes every table. Tables must not be in use anymore.
+func (c *TableCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for fileNum, h := range c.handles {
+		if err := h.table.file.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(c.handles, fileNum)
+	}
+	c.idle.Init()
+
+	return errors.Join(errs...)
+}
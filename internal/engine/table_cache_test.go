@@ -0,0 +1,85 @@
+package engine_test
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableCache_BoundsOpenTables(t *testing.T) {
+	dir := t.TempDir()
+
+	memTables := make([]*engine.MemTable, 0)
+	seq := uint64(0)
+	for round := range 6 {
+		mem, err := engine.NewMemTable(12, 25)
+		require.NoError(t, err)
+		for i := range 50 {
+			seq++
+			require.NoError(t, mem.Insert(seq, fmt.Sprintf("key:%d:%04d", round, i), []byte("value")))
+		}
+		memTables = append(memTables, mem)
+	}
+	m, _ := flushMemTables(t, dir, memTables)
+
+	s := engine.NewSSTableSearcher(dir, m, 2, true, nil)
+	require.NoError(t, s.Start())
+	defer s.Close()
+	require.Equal(t, 0, s.NumOpenTables())
+
+	for range 3 {
+		for round := range 6 {
+			_, ok, err := s.Search(fmt.Sprintf("key:%d:0010", round), math.MaxUint64)
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.LessOrEqual(t, s.NumOpenTables(), 2)
+		}
+	}
+
+	// Tables in use stay open past the limit, until released
+	its, err := s.NewIterators("", "")
+	require.NoError(t, err)
+	require.Equal(t, 6, s.NumOpenTables())
+
+	for _, it := range its {
+		it.SeekToFirst()
+		require.True(t, it.Valid())
+		require.NoError(t, it.Close())
+	}
+	require.Equal(t, 2, s.NumOpenTables())
+}
+
+func TestTableCache_ClosesCompactedTables(t *testing.T) {
+	dir := t.TempDir()
+
+	memTables := make([]*engine.MemTable, 0)
+	seq := uint64(0)
+	for range 4 {
+		mem, err := engine.NewMemTable(12, 25)
+		require.NoError(t, err)
+		for i := range 100 {
+			seq++
+			require.NoError(t, mem.Insert(seq, fmt.Sprintf("key:%04d", i), []byte("value")))
+		}
+		memTables = append(memTables, mem)
+	}
+	m, s := flushMemTables(t, dir, memTables)
+
+	for i := range 100 {
+		_, ok, err := s.Search(fmt.Sprintf("key:%04d", i), math.MaxUint64)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	require.Positive(t, s.NumOpenTables())
+
+	c := engine.NewCompactor(m, s, newSnapshotList(seq), testSSTableConfig, 2, 1<<20, 10, 1<<20)
+	require.NoError(t, c.CompactAll())
+
+	// The inputs are deleted and closed, the output was never read
+	require.Equal(t, 0, s.NumOpenTables())
+	live, onDisk := numFiles(t, dir, s)
+	require.Equal(t, live, onDisk)
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"cmp"
+	"slices"
+)
+
+// version is an immutable set of SSTables split in levels. Level 0 holds
+// flushed tables that may overlap, newest first. Every other level holds
+// tables with disjoint key ranges sorted by key, each level older than the
+// one above it.
+type version struct {
+	levels [numLevels][]*SSTableRead
+	refs   int
+}
+
+// candidates returns the tables that may hold key, newest first.
+func (v *version) candidates(key string) []*SSTableRead {
+	result := make([]*SSTableRead, 0)
+	for _, sstable := range v.levels[0] {
+		if sstable.contains(key) {
+			result = append(result, sstable)
+		}
+	}
+
+	for level := 1; level < numLevels; level++ {
+		sstables := v.levels[level]
+		i, _ := slices.BinarySearchFunc(sstables, key, func(s *SSTableRead, key string) int {
+			return cmp.Compare(s.Largest, key)
+		})
+
+		if i < len(sstables) && sstables[i].contains(key) {
+			result = append(result, sstables[i])
+		}
+	}
+
+	return result
+}
+
+// overlapping returns the tables of level whose key range intersects
+// [smallest, largest].
+func (v *version) overlapping(level int, smallest, largest string) []*SSTableRead {
+	result := make([]*SSTableRead, 0)
+	for _, sstable := range v.levels[level] {
+		if sstable.Largest < smallest || sstable.Smallest > largest {
+			continue
+		}
+
+		result = append(result, sstable)
+	}
+
+	return result
+}
+
+func (v *version) levelByteSize(level int) int64 {
+	var size int64
+	for _, sstable := range v.levels[level] {
+		size += sstable.Size
+	}
+
+	return size
+}
+
+func sortLevels(levels *[numLevels][]*SSTableRead) {
+	slices.SortFunc(levels[0], func(a, b *SSTableRead) int {
+		return cmp.Compare(b.FileNum, a.FileNum)
+	})
+
+	for level := 1; level < numLevels; level++ {
+		slices.SortFunc(levels[level], func(a, b *SSTableRead) int {
+			return cmp.Compare(a.Smallest, b.Smallest)
+		})
+	}
+}
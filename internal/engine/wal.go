@@ -1,32 +1,136 @@
 package engine
 
 import (
+	"cmp"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"godb/internal/tooling/guard"
 	"hash/crc32"
-	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// WAL is the write-ahead log, a sequence of numbered segments. The database
+// starts a segment with every memtable and removes it once the SSTable of
+// the memtable is in the manifest, so only unflushed writes are replayed.
+//
+// Appends and Rotate are not safe for concurrent use, the database commits
+// one group of writes at a time, but Sync may run alongside them.
 type WAL struct {
-	file *os.File
+	path string
+
+	// mu guards file and logNum for Sync, which runs alongside Rotate
+	mu     sync.Mutex
+	file   *os.File
+	logNum uint64
+	// sync makes every append wait for fsync, without it a crash loses what
+	// the OS did not write back yet
+	sync bool
+	// syncErr is the first fsync failure. The kernel may have dropped the
+	// pages it failed to write, so every later write fails with it
+	syncErr atomic.Pointer[error]
+
+	records         atomic.Uint64
+	groups          atomic.Uint64
+	syncs           atomic.Uint64
+	bytes           atomic.Uint64
+	syncedBytes     atomic.Uint64
+	maxGroupRecords atomic.Uint64
 }
 
-const wALFileName = "WAL.log"
+// WALStats counts what was appended to the WAL. Records/Groups is the mean
+// number of records committed by a single write, and fsync when syncing.
+type WALStats struct {
+	Records uint64
+	Groups  uint64
+	Syncs   uint64
+	Bytes   uint64
+	// SyncedBytes is the part of Bytes known to be on disk, the log a machine
+	// crash would leave
+	SyncedBytes uint64
+	// MaxGroupRecords is the largest number of records written at once
+	MaxGroupRecords uint64
+}
+
+const (
+	walFileSuffix = ".log"
+	// legacyWALFileName is the single log written before segments, it is
+	// replayed ahead of them
+	legacyWALFileName = "WAL.log"
+)
+
+func walFileName(logNum uint64) string {
+	return fmt.Sprintf("%d%s", logNum, walFileSuffix)
+}
+
+// NewWAL returns a WAL appending to the segment logNum of path.
+func NewWAL(path string, logNum uint64, sync bool) (*WAL, error) {
+	f, err := createSegment(path, logNum)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WAL{path: path, file: f, logNum: logNum, sync: sync}, nil
+}
+
+// LogNum returns the number of the segment being appended to.
+func (w *WAL) LogNum() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-func NewWAL(path string) (*WAL, error) {
-	f, err := getWalFile(filepath.Join(path, wALFileName))
+	return w.logNum
+}
+
+// Rotate fsyncs and closes the current segment and goes on appending to the
+// segment logNum. The old segment is durable whatever the sync setting, its
+// memtable is on its way to an SSTable and later fsyncs only cover the new
+// one.
+func (w *WAL) Rotate(logNum uint64) error {
+	if err := w.Sync(); err != nil {
+		return err
+	}
+
+	f, err := createSegment(w.path, logNum)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	old := w.file
+	w.file = f
+	w.logNum = logNum
+	w.mu.Unlock()
+
+	if err := old.Close(); err != nil {
+		return fmt.Errorf("file close: %w", err)
+	}
+
+	return nil
+}
+
+// createSegment opens the segment logNum of path, its directory entry synced
+// so that the fsyncs of its appends are enough to keep them.
+func createSegment(path string, logNum uint64) (*os.File, error) {
+	f, err := getWalFile(filepath.Join(path, walFileName(logNum)))
 	if err != nil {
 		return nil, fmt.Errorf("get wal file: %w", err)
 	}
 
-	return &WAL{file: f}, nil
+	if err := syncDir(path); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("sync dir: %w", err)
+	}
+
+	return f, nil
 }
 
-func (w WAL) Close() error {
+func (w *WAL) Close() error {
 	if err := w.file.Close(); err != nil {
 		return fmt.Errorf("file close: %w", err)
 	}
@@ -34,39 +138,159 @@ func (w WAL) Close() error {
 	return nil
 }
 
-func (w WAL) Append(op OpType, key, value []byte) error {
-	entry := w.encodeRecord(byte(op), key, value)
+func (w *WAL) Append(op OpType, key, value []byte) error {
+	return w.write(w.encodeRecord(byte(op), key, value), 1)
+}
+
+// AppendBatch writes every entry as a single checksummed record, so replay
+// either sees the whole batch or none of it. Once written the entries are
+// stamped with the sequence numbers seq, seq+1, ... in order.
+func (w *WAL) AppendBatch(seq uint64, entries []WALMemEntry) error {
+	return w.AppendBatches(seq, [][]WALMemEntry{entries})
+}
+
+// AppendBatches commits a group of batches with a single write, and a single
+// fsync when syncing. Each batch is still its own record, replayed all or
+// nothing, and the batches take consecutive sequence numbers from seq on in
+// order.
+func (w *WAL) AppendBatches(seq uint64, batches [][]WALMemEntry) error {
+	var group []byte
+	next := seq
+	for _, entries := range batches {
+		group = append(group, w.encodeBatchRecord(next, entries)...)
+		next += uint64(len(entries))
+	}
 
-	if _, err := w.file.Write(entry); err != nil {
+	if err := w.write(group, len(batches)); err != nil {
+		return err
+	}
+
+	for _, entries := range batches {
+		seq = AssignSeqs(seq, entries)
+	}
+
+	return nil
+}
+
+// AssignSeqs stamps the entries with the sequence numbers seq, seq+1, ... in
+// order and returns the next one. Entries written to the WAL get theirs
+// from it.
+func AssignSeqs(seq uint64, entries []WALMemEntry) uint64 {
+	for i := range entries {
+		entries[i].seq = seq
+		seq++
+	}
+
+	return seq
+}
+
+// write appends the records, already framed, at once.
+func (w *WAL) write(records []byte, count int) error {
+	if err := w.syncErr.Load(); err != nil {
+		return fmt.Errorf("earlier fsync: %w", *err)
+	}
+
+	if _, err := w.file.Write(records); err != nil {
 		return fmt.Errorf("file write: %w", err)
 	}
 
-	if err := w.file.Sync(); err != nil {
+	w.records.Add(uint64(count))
+	w.groups.Add(1)
+	w.bytes.Add(uint64(len(records)))
+	storeMax(&w.maxGroupRecords, uint64(count))
+
+	if !w.sync {
+		return nil
+	}
+
+	return w.Sync()
+}
+
+// Sync fsyncs what was appended so far. It is what a WAL opened without sync
+// relies on to make appends durable, once in a while or when a write asks.
+func (w *WAL) Sync() error {
+	if err := w.syncErr.Load(); err != nil {
+		return fmt.Errorf("earlier fsync: %w", *err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Every byte counted was written before the fsync started
+	written := w.bytes.Load()
+	if err := syncFile(w.file); err != nil {
+		w.syncErr.CompareAndSwap(nil, &err)
 		return fmt.Errorf("fsync: %w", err)
 	}
 
+	w.syncs.Add(1)
+	storeMax(&w.syncedBytes, written)
 	return nil
 }
 
+// storeMax sets a to v unless it already holds more.
+func storeMax(a *atomic.Uint64, v uint64) {
+	for old := a.Load(); v > old && !a.CompareAndSwap(old, v); old = a.Load() {
+	}
+}
+
+func (w *WAL) Stats() WALStats {
+	return WALStats{
+		Records:         w.records.Load(),
+		Groups:          w.groups.Load(),
+		Syncs:           w.syncs.Load(),
+		Bytes:           w.bytes.Load(),
+		SyncedBytes:     w.syncedBytes.Load(),
+		MaxGroupRecords: w.maxGroupRecords.Load(),
+	}
+}
+
 const (
-	opBytes     = 1
-	lengthBytes = uint32Bytes
-	keyLenBytes = uint32Bytes
-	valLenBytes = uint32Bytes
-	crc32Bytes  = uint32Bytes
+	opBytes         = 1
+	lengthBytes     = uint32Bytes
+	keyLenBytes     = uint32Bytes
+	valLenBytes     = uint32Bytes
+	crc32Bytes      = uint32Bytes
+	batchCountBytes = uint32Bytes
+	batchSeqBytes   = uint64Bytes
 )
 
-func (w WAL) encodeRecord(op byte, key, value []byte) []byte {
-	keyLen := len(key)
-	valLen := len(value)
+func (w *WAL) encodeRecord(op byte, key, value []byte) []byte {
+	payload := make([]byte, 0, opBytes+keyLenBytes+valLenBytes+len(key)+len(value))
+	payload = appendEntryPayload(payload, op, key, value)
+
+	return frameRecord(payload)
+}
+
+func (w *WAL) encodeBatchRecord(seq uint64, entries []WALMemEntry) []byte {
+	size := opBytes + batchSeqBytes + batchCountBytes
+	for _, e := range entries {
+		size += opBytes + keyLenBytes + valLenBytes + len(e.key) + len(e.value)
+	}
 
-	payload := make([]byte, 0, opBytes+keyLenBytes+valLenBytes+keyLen+valLen)
+	payload := make([]byte, 0, size)
+	payload = append(payload, byte(WALSEQBATCH))
+	payload = binary.BigEndian.AppendUint64(payload, seq)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(entries)))
+	for _, e := range entries {
+		payload = appendEntryPayload(payload, byte(e.op), e.key, e.value)
+	}
+
+	return frameRecord(payload)
+}
+
+func appendEntryPayload(payload []byte, op byte, key, value []byte) []byte {
 	payload = append(payload, op)
-	payload = binary.BigEndian.AppendUint32(payload, uint32(keyLen))
-	payload = binary.BigEndian.AppendUint32(payload, uint32(valLen))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(key)))
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(value)))
 	payload = append(payload, key...)
 	payload = append(payload, value...)
 
+	return payload
+}
+
+// frameRecord appends the crc32 of the payload and prefixes the length.
+func frameRecord(payload []byte) []byte {
 	crc32 := crc32.ChecksumIEEE(payload)
 	record := make([]byte, 0, len(payload)+crc32Bytes)
 	record = append(record, payload...)
@@ -86,6 +310,7 @@ type WALEntry interface {
 
 type WALMemEntry struct {
 	op     OpType
+	seq    uint64
 	keyLen uint32
 	valLen uint32
 	key    []byte
@@ -93,10 +318,26 @@ type WALMemEntry struct {
 	crc32  uint32
 }
 
+func NewWALMemEntry(op OpType, key, value []byte) WALMemEntry {
+	return WALMemEntry{
+		op:     op,
+		keyLen: uint32(len(key)),
+		valLen: uint32(len(value)),
+		key:    key,
+		value:  value,
+	}
+}
+
 func (w WALMemEntry) Op() OpType {
 	return w.op
 }
 
+// Seq is the sequence number of the entry, assigned in log order on Load for
+// records written before the WAL stored them.
+func (w WALMemEntry) Seq() uint64 {
+	return w.seq
+}
+
 func (w WALMemEntry) Key() []byte {
 	return w.key
 }
@@ -113,58 +354,284 @@ func (w WALMemFlush) Op() OpType {
 	return w.op
 }
 
+type WALBatch struct {
+	op      OpType
+	entries []WALMemEntry
+}
+
+func (w WALBatch) Op() OpType {
+	return w.op
+}
+
+func (w WALBatch) Entries() []WALMemEntry {
+	return w.entries
+}
+
 type OpType byte
 
 const (
 	WALDEL   OpType = 0
 	WALPUT   OpType = 1
 	WALFLUSH OpType = 2
+	WALBATCH OpType = 3
+	// WALSEQBATCH is a batch whose first entry carries the sequence number
+	// stored with it, WALBATCH and the single entry records predate them
+	WALSEQBATCH OpType = 4
 )
 
-func (w *WAL) Load() ([]WALMemEntry, error) {
-	result := make([]WALMemEntry, 0)
+// WALRecoveryMode decides what replaying the WAL does with a record that is
+// cut short or does not match its checksum.
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTruncate keeps the log up to the first bad record and cuts
+	// it there, dropping every record after it. A torn tail, left by a crash
+	// in the middle of an append, is dropped this way.
+	WALRecoveryTruncate WALRecoveryMode = iota
+	// WALRecoveryStrict fails on the first bad record.
+	WALRecoveryStrict
+	// WALRecoverySkip drops the bad records and keeps replaying the records
+	// after them. A bad record whose length can not be trusted drops the
+	// rest of its segment.
+	WALRecoverySkip
+)
+
+// WALRecovery summarizes a replay of the WAL.
+type WALRecovery struct {
+	Segments       int
+	Records        int
+	RecoveredBytes int64
+	// DroppedRecords counts the bad records and, truncating, the records
+	// after the first one
+	DroppedRecords int
+	DroppedBytes   int64
+	// Corruptions tells where every bad record starts and what is wrong
+	// with it, in log order
+	Corruptions []*CorruptionError
+}
+
+// ReplayWALs returns the entries of the segments of path numbered logNum or
+// more, in log order, bad records handled as mode says. The log that
+// predates segments counts as number 0.
+func ReplayWALs(path string, logNum uint64, mode WALRecoveryMode) ([]WALMemEntry, *WALRecovery, error) {
+	segments, err := walSegments(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wal segments: %w", err)
+	}
+
+	r := &walReplay{mode: mode, entries: make([]WALMemEntry, 0)}
+	// cut is the first segment with a bad record when truncating, and
+	// cutAt the end of its last good record
+	cut := -1
+	var cutAt int
+	for i, segment := range segments {
+		if segment.logNum < logNum {
+			continue
+		}
 
-	for {
-		lengthBuf := make([]byte, lengthBytes)
-		_, err := io.ReadFull(w.file, lengthBuf)
-		if err == io.EOF {
-			return result, nil
+		content, err := os.ReadFile(filepath.Join(path, segment.name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", segment.name, err)
 		}
+
+		good, err := r.replay(segment.name, content)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if r.truncated && cut < 0 {
+			cut, cutAt = i, good
 		}
+	}
 
-		length := binary.BigEndian.Uint32(lengthBuf)
-		if length == 0 {
-			return nil, errors.New("zero-length WAL record")
+	// New writes go to a segment after the cut, the log must end there
+	if cut >= 0 {
+		if err := os.Truncate(filepath.Join(path, segments[cut].name), int64(cutAt)); err != nil {
+			return nil, nil, fmt.Errorf("truncate %s: %w", segments[cut].name, err)
 		}
 
-		record := make([]byte, length)
-		_, err = io.ReadFull(w.file, record)
-		if err != nil {
-			return nil, err
+		for _, segment := range segments[cut+1:] {
+			if err := os.Remove(filepath.Join(path, segment.name)); err != nil {
+				return nil, nil, fmt.Errorf("remove %s: %w", segment.name, err)
+			}
+		}
+
+		if err := syncDir(path); err != nil {
+			return nil, nil, fmt.Errorf("sync dir: %w", err)
+		}
+	}
+
+	return r.entries, &r.recovery, nil
+}
+
+type walReplay struct {
+	mode     WALRecoveryMode
+	entries  []WALMemEntry
+	lastSeq  uint64
+	recovery WALRecovery
+	// truncated is set by the first bad record when truncating, every
+	// record after it is dropped
+	truncated bool
+}
+
+// replay decodes the records of a segment and returns the end of the last
+// one kept. A WALFLUSH record, only found in the log that predates
+// segments, drops the entries before it.
+func (r *walReplay) replay(name string, content []byte) (int, error) {
+	r.recovery.Segments++
+
+	good := 0
+	for off := 0; off < len(content); {
+		record, n, reason := nextRecord(content[off:])
+		var entry WALEntry
+		if reason == "" {
+			var err error
+			if entry, err = decodeRecord(record); err != nil {
+				reason = err.Error()
+			}
 		}
 
-		entry, err := decodeRecord(record)
+		if reason != "" {
+			corruption := &CorruptionError{File: name, Section: sectionWALRecord, Offset: int64(off), Reason: reason}
+			if r.mode == WALRecoveryStrict {
+				return 0, corruption
+			}
+
+			// A record of unknown length takes the rest of the segment along
+			if n == 0 {
+				n = len(content) - off
+			}
 
-		if entry.Op() == WALFLUSH {
-			result = make([]WALMemEntry, 0)
+			r.recovery.Corruptions = append(r.recovery.Corruptions, corruption)
+			r.truncated = r.truncated || r.mode == WALRecoveryTruncate
+		}
+
+		if reason != "" || r.truncated {
+			r.recovery.DroppedRecords++
+			r.recovery.DroppedBytes += int64(n)
+			off += n
 			continue
 		}
 
-		memEntry, ok := entry.(WALMemEntry)
-		guard.Assert(ok, "This should always be a walmementry")
+		r.apply(entry)
+		r.recovery.Records++
+		r.recovery.RecoveredBytes += int64(n)
+		off += n
+		good = off
+	}
+
+	return good, nil
+}
 
+// nextRecord returns the record buf starts with and the bytes it spans, or
+// why it has none. A record of unknown length spans zero bytes.
+func nextRecord(buf []byte) ([]byte, int, string) {
+	if len(buf) < lengthBytes {
+		return nil, 0, "record length cut short"
+	}
+
+	length := int(binary.BigEndian.Uint32(buf))
+	switch {
+	case length == 0:
+		return nil, 0, "zero-length record"
+	case len(buf)-lengthBytes < length:
+		return nil, 0, "record cut short"
+	}
+
+	return buf[lengthBytes : lengthBytes+length], lengthBytes + length, ""
+}
+
+func (r *walReplay) apply(entry WALEntry) {
+	switch e := entry.(type) {
+	case WALMemFlush:
+		r.entries = make([]WALMemEntry, 0)
+	case WALBatch:
+		for _, entry := range e.entries {
+			if e.op != WALSEQBATCH {
+				entry.seq = r.lastSeq + 1
+			}
+			r.lastSeq = entry.seq
+			r.entries = append(r.entries, entry)
+		}
+	case WALMemEntry:
+		e.seq = r.lastSeq + 1
+		r.lastSeq = e.seq
+		r.entries = append(r.entries, e)
+	default:
+		guard.Assert(false, "decodeRecord returned an unknown wal entry")
+	}
+}
+
+// RemoveObsoleteWALs deletes the segments of path numbered below logNum,
+// whose writes are all in SSTables.
+func RemoveObsoleteWALs(path string, logNum uint64) error {
+	segments, err := walSegments(path)
+	if err != nil {
+		return fmt.Errorf("wal segments: %w", err)
+	}
+
+	for _, segment := range segments {
+		if segment.logNum >= logNum {
+			break
+		}
+
+		if err := os.Remove(filepath.Join(path, segment.name)); err != nil {
+			return fmt.Errorf("remove %s: %w", segment.name, err)
+		}
+	}
+
+	return nil
+}
+
+type walSegment struct {
+	name   string
+	logNum uint64
+	legacy bool
+}
+
+// walSegments returns the WAL files of path, oldest first. The log that
+// predates segments is number 0, ahead of a segment 0.
+func walSegments(path string) ([]walSegment, error) {
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("read dir: %w", err)
+	}
+
+	segments := make([]walSegment, 0)
+	for _, file := range files {
+		if file.Name() == legacyWALFileName {
+			segments = append(segments, walSegment{name: file.Name(), legacy: true})
+			continue
+		}
+
+		base, ok := strings.CutSuffix(file.Name(), walFileSuffix)
+		if !ok {
+			continue
+		}
+
+		logNum, err := strconv.ParseUint(base, 10, 64)
 		if err != nil {
-			return nil, err
+			continue
 		}
 
-		result = append(result, memEntry)
+		segments = append(segments, walSegment{name: file.Name(), logNum: logNum})
 	}
+
+	slices.SortFunc(segments, func(a, b walSegment) int {
+		if c := cmp.Compare(a.logNum, b.logNum); c != 0 || a.legacy == b.legacy {
+			return c
+		}
+		if a.legacy {
+			return -1
+		}
+
+		return 1
+	})
+
+	return segments, nil
 }
 
 func decodeRecord(buf []byte) (WALEntry, error) {
-	if len(buf) < opBytes+keyLenBytes+valLenBytes+crc32Bytes {
+	if len(buf) < opBytes+crc32Bytes {
 		return WALMemEntry{}, errors.New("record too short")
 	}
 
@@ -178,6 +645,74 @@ func decodeRecord(buf []byte) (WALEntry, error) {
 		return WALMemEntry{}, errors.New("crc32 mismatch")
 	}
 
+	switch OpType(payload[0]) {
+	case WALFLUSH:
+		return WALMemFlush{op: WALFLUSH}, nil
+	case WALBATCH, WALSEQBATCH:
+		return decodeBatch(payload, expectedCRC)
+	}
+
+	entry, n, err := decodeEntry(payload, expectedCRC)
+	if err != nil {
+		return WALMemEntry{}, err
+	}
+
+	if n != payloadLen {
+		return WALMemEntry{}, errors.New("length mismatch")
+	}
+
+	return entry, nil
+}
+
+func decodeBatch(payload []byte, crc32 uint32) (WALBatch, error) {
+	op := OpType(payload[0])
+	off := opBytes
+
+	var seq uint64
+	if op == WALSEQBATCH {
+		if len(payload) < off+batchSeqBytes {
+			return WALBatch{}, errors.New("batch too short")
+		}
+
+		seq = binary.BigEndian.Uint64(payload[off : off+batchSeqBytes])
+		off += batchSeqBytes
+	}
+
+	if len(payload) < off+batchCountBytes {
+		return WALBatch{}, errors.New("batch too short")
+	}
+
+	count := binary.BigEndian.Uint32(payload[off : off+batchCountBytes])
+	off += batchCountBytes
+
+	entries := make([]WALMemEntry, 0, count)
+	for i := range count {
+		entry, n, err := decodeEntry(payload[off:], crc32)
+		if err != nil {
+			return WALBatch{}, fmt.Errorf("batch entry: %w", err)
+		}
+
+		if op == WALSEQBATCH {
+			entry.seq = seq + uint64(i)
+		}
+
+		entries = append(entries, entry)
+		off += n
+	}
+
+	if off != len(payload) {
+		return WALBatch{}, errors.New("batch length mismatch")
+	}
+
+	return WALBatch{op: op, entries: entries}, nil
+}
+
+// decodeEntry decodes a single put or delete and returns the bytes it spans.
+func decodeEntry(payload []byte, crc32 uint32) (WALMemEntry, int, error) {
+	if len(payload) < opBytes+keyLenBytes+valLenBytes {
+		return WALMemEntry{}, 0, errors.New("record too short")
+	}
+
 	var off uint32 = 0
 
 	op := payload[off]
@@ -189,14 +724,15 @@ func decodeRecord(buf []byte) (WALEntry, error) {
 	valLen := binary.BigEndian.Uint32(payload[off : off+valLenBytes])
 	off += valLenBytes
 
-	if int(off+keyLen+valLen) != payloadLen {
-		return WALMemEntry{}, errors.New("length mismatch")
+	if uint64(off)+uint64(keyLen)+uint64(valLen) > uint64(len(payload)) {
+		return WALMemEntry{}, 0, errors.New("length mismatch")
 	}
 
 	key := payload[off : off+keyLen]
 	off += keyLen
 
 	value := payload[off : off+valLen]
+	off += valLen
 
 	return WALMemEntry{
 		op:     OpType(op),
@@ -204,8 +740,8 @@ func decodeRecord(buf []byte) (WALEntry, error) {
 		valLen: valLen,
 		key:    key,
 		value:  value,
-		crc32:  expectedCRC,
-	}, nil
+		crc32:  crc32,
+	}, int(off), nil
 }
 
 func getWalFile(path string) (*os.File, error) {
@@ -0,0 +1,283 @@
+package engine_test
+
+import (
+	"fmt"
+	"godb/internal/engine"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWAL_BatchIsReplayedAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := engine.NewWAL(dir, 1, true)
+	require.NoError(t, err)
+
+	require.NoError(t, wal.Append(engine.WALPUT, []byte("single"), []byte("1")))
+	require.NoError(t, wal.AppendBatch(2, []engine.WALMemEntry{
+		engine.NewWALMemEntry(engine.WALPUT, []byte("a"), []byte("1")),
+		engine.NewWALMemEntry(engine.WALPUT, []byte("b"), []byte("2")),
+		engine.NewWALMemEntry(engine.WALDEL, []byte("single"), nil),
+	}))
+	require.NoError(t, wal.Close())
+
+	entries, _, err := engine.ReplayWALs(dir, 0, engine.WALRecoveryStrict)
+	require.NoError(t, err)
+
+	require.Len(t, entries, 4)
+	require.Equal(t, engine.WALPUT, entries[1].Op())
+	require.Equal(t, []byte("b"), entries[2].Key())
+	require.Equal(t, []byte("2"), entries[2].Value())
+	require.Equal(t, engine.WALDEL, entries[3].Op())
+	require.Equal(t, []byte("single"), entries[3].Key())
+
+	// The single entry record carries no sequence number, it follows the log
+	for i, entry := range entries {
+		require.Equal(t, uint64(i+1), entry.Seq())
+	}
+
+	// Corrupt the last entry of the batch, nothing of it may be replayed
+	p := filepath.Join(dir, "1.log")
+	content, err := os.ReadFile(p)
+	require.NoError(t, err)
+	content[len(content)-6] ^= 0xff
+	require.NoError(t, os.WriteFile(p, content, 0644))
+
+	entries, _, err = engine.ReplayWALs(dir, 0, engine.WALRecoveryStrict)
+	require.Error(t, err)
+	require.Nil(t, entries)
+}
+
+func TestWAL_AppendBatchesIsOneGroup(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := engine.NewWAL(dir, 1, true)
+	require.NoError(t, err)
+
+	first := []engine.WALMemEntry{
+		engine.NewWALMemEntry(engine.WALPUT, []byte("a"), []byte("1")),
+		engine.NewWALMemEntry(engine.WALPUT, []byte("b"), []byte("2")),
+	}
+	second := []engine.WALMemEntry{
+		engine.NewWALMemEntry(engine.WALDEL, []byte("a"), nil),
+	}
+	require.NoError(t, wal.AppendBatches(10, [][]engine.WALMemEntry{first, second}))
+	require.Equal(t, uint64(12), second[0].Seq())
+
+	stats := wal.Stats()
+	require.Equal(t, uint64(2), stats.Records)
+	require.Equal(t, uint64(1), stats.Groups)
+	require.Equal(t, uint64(1), stats.Syncs)
+	require.Equal(t, uint64(2), stats.MaxGroupRecords)
+	require.NoError(t, wal.Close())
+
+	// The group is written at once, each batch a record of its own
+	p := filepath.Join(dir, "1.log")
+	content, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.Equal(t, stats.Bytes, uint64(len(content)))
+
+	entries, _, err := engine.ReplayWALs(dir, 0, engine.WALRecoveryStrict)
+	require.NoError(t, err)
+
+	require.Len(t, entries, 3)
+	for i, entry := range entries {
+		require.Equal(t, uint64(10+i), entry.Seq())
+	}
+	require.Equal(t, engine.WALDEL, entries[2].Op())
+}
+
+func TestWAL_Segments(t *testing.T) {
+	dir := t.TempDir()
+
+	// The log that predates segments goes first, then segments by number
+	legacy := filepath.Join(dir, "WAL.log")
+	require.NoError(t, os.WriteFile(legacy, nil, 0644))
+
+	wal, err := engine.NewWAL(dir, 2, false)
+	require.NoError(t, err)
+	for i, logNum := range []uint64{9, 10} {
+		require.NoError(t, wal.AppendBatch(uint64(i+1), []engine.WALMemEntry{
+			engine.NewWALMemEntry(engine.WALPUT, []byte(fmt.Sprint(wal.LogNum())), nil),
+		}))
+
+		// Rotating makes the segment durable even without sync
+		require.NoError(t, wal.Rotate(logNum))
+		require.Equal(t, logNum, wal.LogNum())
+		stats := wal.Stats()
+		require.Equal(t, stats.Bytes, stats.SyncedBytes)
+	}
+	require.NoError(t, wal.AppendBatch(3, []engine.WALMemEntry{
+		engine.NewWALMemEntry(engine.WALPUT, []byte("10"), nil),
+	}))
+	require.NoError(t, wal.Close())
+
+	keys := func(logNum uint64) []string {
+		entries, _, err := engine.ReplayWALs(dir, logNum, engine.WALRecoveryStrict)
+		require.NoError(t, err)
+
+		keys := make([]string, 0)
+		for _, e := range entries {
+			keys = append(keys, string(e.Key()))
+		}
+		return keys
+	}
+	require.Equal(t, []string{"2", "9", "10"}, keys(0))
+	require.Equal(t, []string{"9", "10"}, keys(3))
+	require.Equal(t, []string{}, keys(11))
+
+	require.NoError(t, engine.RemoveObsoleteWALs(dir, 10))
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "10.log", files[0].Name())
+}
+
+func TestWAL_RecoveryModes(t *testing.T) {
+	put := func(key string) []engine.WALMemEntry {
+		return []engine.WALMemEntry{engine.NewWALMemEntry(engine.WALPUT, []byte(key), []byte("value"))}
+	}
+
+	// Segment 1 holds a, b with a bad checksum and c, segment 2 holds d and
+	// the torn tail of an append
+	newWAL := func(t *testing.T) (string, []int64) {
+		dir := t.TempDir()
+		wal, err := engine.NewWAL(dir, 1, false)
+		require.NoError(t, err)
+
+		ends := make([]int64, 0)
+		for i, key := range []string{"a", "b", "c"} {
+			require.NoError(t, wal.AppendBatch(uint64(i+1), put(key)))
+			ends = append(ends, int64(wal.Stats().Bytes))
+		}
+		require.NoError(t, wal.Rotate(2))
+		require.NoError(t, wal.AppendBatch(4, put("d")))
+		require.NoError(t, wal.Close())
+
+		p := filepath.Join(dir, "1.log")
+		content, err := os.ReadFile(p)
+		require.NoError(t, err)
+		content[ends[0]+8] ^= 0xff
+		require.NoError(t, os.WriteFile(p, content, 0644))
+
+		f, err := os.OpenFile(filepath.Join(dir, "2.log"), os.O_WRONLY|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		return dir, ends
+	}
+
+	keys := func(entries []engine.WALMemEntry) []string {
+		keys := make([]string, 0)
+		for _, e := range entries {
+			keys = append(keys, string(e.Key()))
+		}
+		return keys
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		dir, ends := newWAL(t)
+		_, _, err := engine.ReplayWALs(dir, 0, engine.WALRecoveryStrict)
+
+		var corruption *engine.CorruptionError
+		require.ErrorAs(t, err, &corruption)
+		require.Equal(t, "1.log", corruption.File)
+		require.Equal(t, "record", corruption.Section)
+		require.Equal(t, ends[0], corruption.Offset)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		dir, ends := newWAL(t)
+		entries, recovery, err := engine.ReplayWALs(dir, 0, engine.WALRecoverySkip)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "c", "d"}, keys(entries))
+
+		require.Equal(t, 2, recovery.Segments)
+		require.Equal(t, 3, recovery.Records)
+		require.Equal(t, 2, recovery.DroppedRecords)
+		require.Equal(t, ends[1]-ends[0]+7, recovery.DroppedBytes)
+		require.Len(t, recovery.Corruptions, 2)
+		require.Equal(t, "2.log", recovery.Corruptions[1].File)
+
+		// Nothing is cut, the next replay drops the same records
+		again, _, err := engine.ReplayWALs(dir, 0, engine.WALRecoverySkip)
+		require.NoError(t, err)
+		require.Equal(t, keys(entries), keys(again))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		dir, ends := newWAL(t)
+		entries, recovery, err := engine.ReplayWALs(dir, 0, engine.WALRecoveryTruncate)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a"}, keys(entries))
+
+		require.Equal(t, 1, recovery.Records)
+		require.Equal(t, ends[0], recovery.RecoveredBytes)
+		require.Equal(t, 4, recovery.DroppedRecords)
+		require.Len(t, recovery.Corruptions, 2)
+
+		// The log ends at the cut, a segment written after it is replayed
+		// in full
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		info, err := files[0].Info()
+		require.NoError(t, err)
+		require.Equal(t, ends[0], info.Size())
+
+		entries, recovery, err = engine.ReplayWALs(dir, 0, engine.WALRecoveryStrict)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a"}, keys(entries))
+		require.Empty(t, recovery.Corruptions)
+	})
+}
+
+// recordSyncs returns the fsyncs made under dir in order, a file by its path
+// and a directory by its path and the entries it held.
+func recordSyncs(t *testing.T, dir string) func() []string {
+	var mu sync.Mutex
+	syncs := make([]string, 0)
+	engine.SyncHook = func(path string) error {
+		rel, _ := filepath.Rel(dir, path)
+		if entries, err := os.ReadDir(path); err == nil {
+			names := make([]string, 0)
+			for _, e := range entries {
+				names = append(names, e.Name())
+			}
+			rel = fmt.Sprint(rel, names)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		syncs = append(syncs, rel)
+		return nil
+	}
+	t.Cleanup(func() { engine.SyncHook = nil })
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, syncs...)
+	}
+}
+
+func TestWAL_SyncOrder(t *testing.T) {
+	dir := t.TempDir()
+	syncs := recordSyncs(t, dir)
+
+	// A segment is in its directory before a write goes to it, and the old
+	// one is durable before writes move on
+	wal, err := engine.NewWAL(dir, 1, false)
+	require.NoError(t, err)
+	require.NoError(t, wal.Append(engine.WALPUT, []byte("a"), nil))
+	require.NoError(t, wal.Rotate(2))
+	require.NoError(t, wal.Close())
+
+	require.Equal(t, []string{".[1.log]", "1.log", ".[1.log 2.log]"}, syncs())
+}